@@ -1,21 +1,49 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alvelcom/berny/pkg/api"
-	"github.com/alvelcom/berny/pkg/task"
+	"github.com/alvelcom/berny/pkg/client"
+	"github.com/alvelcom/berny/pkg/logging"
 )
 
 var (
-	fServer = flag.String("server", "http://127.0.0.1:2326", `Server to connect to`)
-	fDir    = flag.String("dir", "/var/run/schloss", `Directory for products`)
+	fServer = flag.String("server", "http://127.0.0.1:2326",
+		`Comma separated servers to connect to, tried in order: http(s) URLs or unix:///path/to/socket`)
+	fProxy = flag.String("proxy", "",
+		`Proxy URL, http(s) or socks5; HTTPS_PROXY and friends are used if empty`)
+	fTimeout = flag.Duration("timeout", api.DefaultTimeout,
+		`Timeout of a single request to a single server`)
+	fRetries = flag.Int("retries", api.DefaultRetries,
+		`Retries over all servers after transient errors, -1 disables`)
+	fDir   = flag.String("dir", "/var/run/schloss", `Directory for products`)
+	fCA    = flag.String("ca", "", `PEM bundle to verify the server against`)
+	fIdent = flag.String("identity", "",
+		`x509 product to use as a client certificate, if it was harvested before, as policy/name`)
+	fMaxRounds = flag.Int("max-rounds", client.DefaultMaxRounds,
+		`Give up when the server asks for tasks more times than that`)
+	fParallel = flag.Int("parallel", 0,
+		`How many tasks to solve at once, the number of CPUs if zero`)
+	fLogFormat = flag.String("log-format", "logfmt", `Log format: logfmt or json`)
+	fLogLevel  = flag.String("log-level", "info",
+		`Log entries of this level and above: debug, info, warn or error`)
 
 	info = api.MachineInfo{
 		Extra: map[string]string{
@@ -26,91 +54,124 @@ var (
 
 func main() {
 	prepareFlags()
-	log.Printf("MachineInfo: %+v", info)
+	level, err := logging.ParseLevel(*fLogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log, err := logging.New(os.Stderr, *fLogFormat, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log.Info("machine", "fqdn", info.FQDN, "ips", info.IPs)
 
-	c, err := api.NewHTTPClient(http.DefaultClient, *fServer, info)
+	httpClient, err := newHTTPClient(log, *fDir, *fIdent, *fCA, *fProxy)
 	if err != nil {
-		log.Printf("Can't initialize: %s", err)
+		log.Error("can't initialize", "error", err)
 		return
 	}
 
-	var taskResps []api.TaskResponse
+	// Servers give out paths to products in it
+	dir, err := filepath.Abs(*fDir)
+	if err != nil {
+		log.Error("can't initialize", "error", err)
+		return
+	}
 
-	newTasks := -1
-	for newTasks != 0 {
-		log.Printf("Harvesting with %d task response(s)", len(taskResps))
-		prods, tasks, errs, err := c.Harvest(taskResps)
-		if err != nil {
-			log.Printf("Can't harvest: %s", err)
-			return
-		}
+	c, err := api.NewHTTPClient(httpClient, strings.Split(*fServer, ","), info, api.ClientOptions{
+		Timeout: *fTimeout,
+		Retries: *fRetries,
+		Dir:     dir,
+	})
+	if err != nil {
+		log.Error("can't initialize", "error", err)
+		return
+	}
 
-		if len(errs) > 0 {
-			log.Printf("Errors:")
-			for _, err := range errs {
-				log.Printf("%7s: %s", err.Type, err.Message)
-			}
-			return
-		}
+	// Interrupting stops retries and task solving, products saved so far
+	// stay
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	h := client.New(c, client.Dir(*fDir), client.Options{
+		MaxRounds:   *fMaxRounds,
+		Parallelism: *fParallel,
+		Log:         log,
+	})
+	result, err := h.Harvest(ctx)
+	if err != nil {
+		log.Error("can't harvest", "rounds", result.Rounds, "error", err)
+		os.Exit(1)
+	}
+	log.Info("harvested", "rounds", result.Rounds, "products", len(result.Products),
+		"changed", len(result.Changed()))
+}
 
-		var taskProducts []api.Product
-		newTasks = len(tasks)
-		if len(tasks) > 0 {
-			log.Printf("Tasks:")
-		}
-		for i := range tasks {
-			log.Printf("- %s %v", tasks[i].Type, tasks[i].Name)
-			products, taskResp, err := task.Solve(tasks[i])
-			if err != nil {
-				log.Printf("Can't solve a task: %s", err)
-				return
-			}
-
-			taskResps = append(taskResps, taskResp)
-			taskProducts = append(taskProducts, products...)
+// newHTTPClient presents an identity certificate from a previous harvest,
+// so the server can skip heavyweight probes. A missing identity is fine:
+// that's how the very first harvest looks like.
+func newHTTPClient(log *logging.Logger, dir, identity, caFile, proxy string) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if len(proxy) > 0 {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
 		}
+		transport.Proxy = http.ProxyURL(u)
+	}
 
-		if len(taskProducts) > 0 {
-			log.Printf("Saving task products:")
-		}
-		if err := saveProducts(*fDir, taskProducts); err != nil {
-			log.Printf("saving error: %s", err)
-			return
+	tlsConfig := &tls.Config{}
+	if len(caFile) > 0 {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
 		}
 
-		if len(prods) > 0 {
-			log.Printf("Saving products:")
-		}
-		if err := saveProducts(*fDir, prods); err != nil {
-			log.Printf("saving error: %s", err)
-			return
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates in " + caFile)
 		}
 	}
-}
 
-func saveProducts(dir string, ps []api.Product) error {
-	for _, p := range ps {
-		name := path.Join(p.Name...)
-		log.Printf("- %s (%04o)", name, p.Mask)
-
-		name = path.Join(dir, name)
-		if err := os.MkdirAll(path.Dir(name), os.FileMode(0755)); err != nil {
-			return err
-		}
-
-		fd, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(p.Mask))
+	if len(identity) > 0 {
+		certFile, keyFile, err := identityFiles(dir, identity)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		_, err = fd.Write(p.Body)
-		fd.Close()
-		if err != nil {
-			return err
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		switch {
+		case err == nil:
+			log.Info("using identity", "file", certFile)
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		case os.IsNotExist(err):
+			log.Info("no identity found, harvesting without it")
+		default:
+			return nil, err
 		}
 	}
 
-	return nil
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// identityFiles are where an x509 product is saved: products are under
+// their policy's directory.
+func identityFiles(dir, identity string) (string, string, error) {
+	name := path.Clean(identity)
+	if !strings.Contains(name, "/") || path.IsAbs(name) || strings.HasPrefix(name, "..") {
+		return "", "", errors.New("identity must be policy/name of an x509 producer, got " + identity)
+	}
+	return path.Join(dir, name, "fullchain.pem"), path.Join(dir, name, "key.pem"), nil
 }
 
 func prepareFlags() {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/logging"
+)
+
+func TestIdentityFiles(t *testing.T) {
+	for _, c := range []struct {
+		identity, cert, key string
+	}{
+		{"kubelet/identity", "/out/kubelet/identity/fullchain.pem", "/out/kubelet/identity/key.pem"},
+		{"kubelet/tls/identity/", "/out/kubelet/tls/identity/fullchain.pem", "/out/kubelet/tls/identity/key.pem"},
+		{"identity", "", ""},
+		{"../kubelet/identity", "", ""},
+		{"kubelet/../identity", "", ""},
+		{"/kubelet/identity", "", ""},
+	} {
+		cert, key, err := identityFiles("/out", c.identity)
+		if len(c.cert) == 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.identity)
+			}
+			continue
+		}
+		if err != nil || cert != c.cert || key != c.key {
+			t.Errorf("%s: unexpected %s, %s, %v", c.identity, cert, key, err)
+		}
+	}
+}
+
+// writeIdentity saves a certificate the way a harvest of policy/name does.
+func writeIdentity(t *testing.T, dir, policy, name string) {
+	ca := testca.New(t, "CA")
+	cert, key := ca.Issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "web-1.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	productDir := filepath.Join(dir, policy, name)
+	if err := os.MkdirAll(productDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	chain := append(testca.CertPEM(cert.Raw), testca.CertPEM(ca.Cert.Raw)...)
+	err := ioutil.WriteFile(filepath.Join(productDir, "fullchain.pem"), chain, 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(productDir, "key.pem"), testca.KeyPEM(t, key), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewHTTPClientIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeIdentity(t, dir, "kubelet", "identity")
+
+	log, err := logging.New(ioutil.Discard, "logfmt", logging.Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificates := func(identity string) int {
+		c, err := newHTTPClient(log, dir, identity, "", "")
+		if err != nil {
+			t.Fatalf("%s: %v", identity, err)
+		}
+		return len(c.Transport.(*http.Transport).TLSClientConfig.Certificates)
+	}
+
+	if n := certificates("kubelet/identity"); n != 1 {
+		t.Errorf("expected the identity to be found under its policy, got %d certificates", n)
+	}
+	// The first harvest has nothing to present yet
+	if n := certificates("renew/identity"); n != 0 {
+		t.Errorf("expected no certificates, got %d", n)
+	}
+	if n := certificates(""); n != 0 {
+		t.Errorf("expected no certificates, got %d", n)
+	}
+
+	// A bare name used to mean <dir>/<name>, it must not go unnoticed
+	if _, err := newHTTPClient(log, dir, "identity", "", ""); err == nil {
+		t.Error("expected an identity without a policy to fail")
+	}
+}
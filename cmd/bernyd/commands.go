@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/audit"
+	"github.com/alvelcom/berny/pkg/inventory"
+	"github.com/alvelcom/berny/pkg/probes"
+	"github.com/alvelcom/berny/pkg/producers"
+	"github.com/alvelcom/berny/pkg/server"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// runCheck implements `bernyd check`: load the config the same way the
+// server does, but don't listen.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", "test.be", `Configuration file or directory to check`)
+	vars := make(varsFlag)
+	fs.Var(vars, "var", `Set a config variable, name=value, can be repeated`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	state, err := server.Load(*configFile, vars)
+	if err != nil {
+		server.WriteDiagnostics(stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: %d backend(s), %d policies\n", *configFile,
+		len(state.Backends.X509)+len(state.Backends.SSH)+len(state.Backends.Secret),
+		len(state.Policies))
+	return 0
+}
+
+// runExplain implements `bernyd explain`: show which policies a machine
+// would match and what it would get, without signing anything. Probes
+// that need the request itself can't be evaluated, producers only run the
+// phases they allow in dry runs.
+func runExplain(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", "test.be", `Configuration file or directory to use`)
+	vars := make(varsFlag)
+	fs.Var(vars, "var", `Set a config variable, name=value, can be repeated`)
+	machineFile := fs.String("machine", "machine.json", `JSON encoded api.MachineInfo`)
+	requestIP := fs.String("request-ip", "", `IP the request comes from, defaults to machine's first IP`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	state, err := server.Load(*configFile, vars)
+	if err != nil {
+		server.WriteDiagnostics(stderr, err)
+		return 1
+	}
+
+	data, err := ioutil.ReadFile(*machineFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var mi api.MachineInfo
+	if err := json.Unmarshal(data, &mi); err != nil {
+		fmt.Fprintln(stderr, "bad machine info:", err)
+		return 1
+	}
+
+	ip := *requestIP
+	if len(ip) == 0 && len(mi.IPs) > 0 {
+		ip = mi.IPs[0]
+	}
+
+	// Probes are printed with their policy's producers, once those ran
+	var policies []server.Policy
+	headers := make([]bytes.Buffer, len(state.Policies))
+	matched := make([]int, len(state.Policies))
+	for i, policy := range state.Policies {
+		matched[i] = -1
+		if explainProbes(&headers[i], &policy, &mi) {
+			matched[i] = len(policies)
+			policies = append(policies, policy)
+		}
+	}
+
+	// Producers with side effects aren't run, the ones that need them
+	// wait like they would for tasks
+	round := server.NewRound(policies, state.NewProducerContext(ip, &mi), 1)
+	round.DryRun = true
+	err = round.Prepare()
+	if err == nil {
+		err = round.Produce()
+	}
+	if err != nil {
+		server.WriteDiagnostics(stderr, state.ExplainError(err))
+		return 1
+	}
+
+	for i := range state.Policies {
+		headers[i].WriteTo(stdout)
+		if matched[i] < 0 {
+			continue
+		}
+		policy := &policies[matched[i]]
+		for j, step := range round.Steps[matched[i]] {
+			header := policy.Config.Produce[j]
+			fmt.Fprintf(stdout, "  produce %s %q\n", header.Type, header.Name)
+			explainStep(stdout, policy, &step)
+		}
+	}
+	return 0
+}
+
+// explainStep prints how far a producer got in a dry run.
+func explainStep(w io.Writer, policy *server.Policy, step *server.Step) {
+	switch {
+	case step.WaitsFor >= 0:
+		dep := policy.Config.Produce[step.WaitsFor]
+		fmt.Fprintf(w, "    waits for produce %s %q\n", dep.Type, dep.Name)
+		return
+	case !step.Prepared:
+		fmt.Fprintf(w, "    not run, it has side effects\n")
+		return
+	}
+
+	ids := make([]producers.TaskID, 0, len(step.Tasks))
+	for id := range step.Tasks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a].String() < ids[b].String() })
+	for _, id := range ids {
+		fmt.Fprintf(w, "    task %s %s\n", step.Tasks[id].ToAPI(id.Name()).Type, id)
+	}
+	if len(ids) > 0 {
+		return
+	}
+
+	if !step.Produced {
+		fmt.Fprintf(w, "    products not shown, producing has side effects\n")
+		return
+	}
+	for _, p := range step.Products {
+		fmt.Fprintf(w, "    product %s\n", strings.Join(task.Prefix([]string{policy.Name}, p.Name), "/"))
+	}
+}
+
+// explainProbes prints whether the machine would pass policy's probes,
+// false if it surely wouldn't. Probes that need the request are unknown.
+func explainProbes(w io.Writer, policy *server.Policy, mi *api.MachineInfo) bool {
+	var lines []string
+	unknown := false
+	for _, probe := range policy.Verify {
+		offline, ok := probe.(probes.OfflineVerifier)
+		if !ok {
+			lines = append(lines, probe.Type()+": unknown, needs the request")
+			unknown = true
+			continue
+		}
+		if err := offline.VerifyOffline(mi); err != nil {
+			fmt.Fprintf(w, "policy %q: doesn't match\n", policy.Name)
+			fmt.Fprintf(w, "  verify %s: fails: %v\n", probe.Type(), err)
+			return false
+		}
+		lines = append(lines, probe.Type()+": passes")
+	}
+
+	if unknown {
+		fmt.Fprintf(w, "policy %q: matches if the request passes probes\n", policy.Name)
+	} else {
+		fmt.Fprintf(w, "policy %q: matches\n", policy.Name)
+	}
+	for _, line := range lines {
+		fmt.Fprintf(w, "  verify %s\n", line)
+	}
+	return true
+}
+
+// runInventory implements `bernyd inventory certs|machines`: list and
+// search what was issued and who harvested.
+func runInventory(args []string) int {
+	if len(args) == 0 || (args[0] != "certs" && args[0] != "machines") {
+		fmt.Fprintln(os.Stderr, "usage: bernyd inventory certs|machines [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("inventory "+args[0], flag.ExitOnError)
+	path := fs.String("inventory", "", `Inventory to read`)
+	type_ := fs.String("inventory-type", "file", `Inventory store type`)
+	asJSON := fs.Bool("json", false, `Print JSON lines instead of a table`)
+	var q inventory.Query
+	fs.StringVar(&q.Serial, "serial", "", `Certificate serial number, hex`)
+	fs.StringVar(&q.Subject, "subject", "", `Subject substring`)
+	fs.StringVar(&q.Machine, "machine", "", `Machine FQDN substring`)
+	fs.StringVar(&q.Policy, "policy", "", `Policy name substring`)
+	expiresWithin := fs.Duration("expires-within", 0, `Only certificates expiring within this duration`)
+	fs.Parse(args[1:])
+
+	if len(*path) == 0 {
+		fmt.Fprintln(os.Stderr, "-inventory is required")
+		return 2
+	}
+
+	store, err := inventory.New(*type_, *path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	if args[0] == "machines" {
+		hs, err := store.Machines()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if !*asJSON {
+			fmt.Fprintln(w, "MACHINE\tLAST HARVEST\tREQUEST IP\tPOLICIES\tERROR")
+		}
+		for _, h := range hs {
+			if !strings.Contains(h.Machine.FQDN, q.Machine) {
+				continue
+			}
+			if *asJSON {
+				printJSON(h)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", h.Machine.FQDN, h.At.Format(time.RFC3339),
+				h.RequestIP, strings.Join(h.Policies, ","), h.Error)
+		}
+		return 0
+	}
+
+	if *expiresWithin > 0 {
+		q.ExpiresBefore = time.Now().Add(*expiresWithin)
+	}
+
+	certs, err := store.Certificates(q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !*asJSON {
+		fmt.Fprintln(w, "KIND\tSERIAL\tSUBJECT\tMACHINE\tPOLICY/PRODUCER\tISSUED\tNOT AFTER")
+	}
+	for _, c := range certs {
+		if *asJSON {
+			printJSON(c)
+			continue
+		}
+		notAfter := "never"
+		if !c.NotAfter.IsZero() {
+			notAfter = c.NotAfter.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s/%s\t%s\t%s\n", c.Kind, c.Serial, c.Subject,
+			c.Machine.FQDN, c.Policy, c.Producer, c.IssuedAt.Format(time.RFC3339), notAfter)
+	}
+	return 0
+}
+
+// runRevoke implements `bernyd revoke <serial>...`. Served CRLs pick
+// revocations up when they are regenerated next time. SSH certificates
+// have no CRLs, they are reported and left valid.
+func runRevoke(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("inventory", "", `Inventory to record revocations in`)
+	type_ := fs.String("inventory-type", "file", `Inventory store type`)
+	reason := fs.Int("reason", inventory.ReasonUnspecified, `RFC 5280 revocation reason code`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if len(*path) == 0 || fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: bernyd revoke -inventory <dir> [-reason n] <serial>...")
+		return 2
+	}
+
+	store, err := inventory.New(*type_, *path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	var certs []inventory.Certificate
+	for _, serial := range fs.Args() {
+		found, err := store.Certificates(inventory.Query{Serial: serial})
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if len(found) == 0 {
+			fmt.Fprintf(stderr, "%s: no such certificate\n", serial)
+			return 1
+		}
+		certs = append(certs, found...)
+	}
+
+	certs, unrevocable := revocable(certs, stderr)
+	n, err := revoke(store, certs, *reason)
+	fmt.Fprintf(stdout, "%d certificate(s) revoked\n", n)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if unrevocable > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runDecommission implements `bernyd decommission <fqdn>`: revoke every
+// certificate the machine was issued.
+func runDecommission(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("inventory", "", `Inventory to record revocations in`)
+	type_ := fs.String("inventory-type", "file", `Inventory store type`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if len(*path) == 0 || fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: bernyd decommission -inventory <dir> <fqdn>")
+		return 2
+	}
+
+	store, err := inventory.New(*type_, *path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	// Query matches substrings, a machine's FQDN has to match exactly
+	found, err := store.Certificates(inventory.Query{Machine: fs.Arg(0)})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	var certs []inventory.Certificate
+	for _, c := range found {
+		if strings.EqualFold(c.Machine.FQDN, fs.Arg(0)) {
+			certs = append(certs, c)
+		}
+	}
+
+	certs, unrevocable := revocable(certs, stderr)
+	n, err := revoke(store, certs, inventory.ReasonCessationOfOperation)
+	fmt.Fprintf(stdout, "%s: %d certificate(s) revoked\n", fs.Arg(0), n)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if unrevocable > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runAudit implements `bernyd audit verify <log>`. A chain can't tell its
+// tail was cut off, -head checks a record noted earlier is still there.
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: bernyd audit verify [-head seq:hash] <log>")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	head := fs.String("head", "", `A record known to be in the log, seq:hash`)
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: bernyd audit verify [-head seq:hash] <log>")
+		return 2
+	}
+
+	found := len(*head) == 0
+	last, err := audit.Verify(fs.Arg(0), func(r *audit.Record) {
+		if fmt.Sprintf("%d:%s", r.Seq, r.Hash) == *head {
+			found = true
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if last == nil {
+		fmt.Println("empty log")
+		return 0
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "%s: record %s not found, the log was truncated\n", fs.Arg(0), *head)
+		return 1
+	}
+
+	fmt.Printf("%d record(s) verified, head %d:%s\n", last.Seq+1, last.Seq, last.Hash)
+	return 0
+}
+
+// revocable keeps only x509 certificates of certs: bernyd serves no
+// revocation lists for SSH ones. Those are reported to w and counted.
+func revocable(certs []inventory.Certificate, w io.Writer) ([]inventory.Certificate, int) {
+	var keep []inventory.Certificate
+	n := 0
+	for _, c := range certs {
+		if c.Kind == "x509" {
+			keep = append(keep, c)
+			continue
+		}
+
+		notAfter := "never expires"
+		if !c.NotAfter.IsZero() {
+			notAfter = "expires " + c.NotAfter.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s: %s certificate %s can't be revoked, it %s\n", c.Serial, c.Kind, c.Subject, notAfter)
+		n++
+	}
+	return keep, n
+}
+
+// revoke adds certificates to the inventory's revocations, skipping ones
+// revoked already.
+func revoke(store inventory.Store, certs []inventory.Certificate, reason int) (int, error) {
+	revocations, err := store.Revocations()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	now := time.Now()
+next:
+	for _, c := range certs {
+		for _, r := range revocations {
+			if r.Issuer == c.Issuer && inventory.SameSerial(r.Serial, c.Serial) {
+				continue next
+			}
+		}
+
+		err := store.AddRevocation(inventory.Revocation{
+			Serial:    c.Serial,
+			Issuer:    c.Issuer,
+			RevokedAt: now,
+			Reason:    reason,
+		})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/inventory"
+)
+
+// commandDir holds a config with a file x509 backend "ca", a machine.json
+// and a plugin that leaves a marker file behind if it's ever run.
+type commandDir struct {
+	dir    string
+	config string
+	marker string
+}
+
+func newCommandDir(t *testing.T, config string) *commandDir {
+	dir, err := ioutil.TempDir("", "berny-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, data []byte, mode os.FileMode) string {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, data, mode); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+
+	ca := testca.New(t, "Test CA")
+	cd := &commandDir{dir: dir, marker: filepath.Join(dir, "plugin-ran")}
+	write("ca.pem", testca.CertPEM(ca.Cert.Raw), 0644)
+	write("ca-key.pem", testca.KeyPEM(t, ca.Key), 0600)
+	write("plugin", []byte("#!/bin/sh\ntouch "+cd.marker+"\n"), 0755)
+	write("machine.json", []byte(`{"fqdn": "web-1.example.com", "ips": ["10.0.0.1"]}`), 0644)
+
+	config = strings.Replace(config, "$DIR", dir, -1)
+	cd.config = write("berny.be", []byte(config), 0644)
+	return cd
+}
+
+func (cd *commandDir) Close() {
+	os.RemoveAll(cd.dir)
+}
+
+const commandConfig = `
+backend x509 "ca" {
+  type = "file"
+  cert = "$DIR/ca.pem"
+  key  = "$DIR/ca-key.pem"
+}
+
+policy "web" {
+  verify gcp {}
+
+  produce file "motd" {
+    content = "welcome to ${req.fqdn}"
+  }
+  produce x509 "tls" {
+    backend     = backend.x509.ca
+    common_name = req.fqdn
+  }
+  produce file "tls.txt" {
+    content = produce.x509.tls.cert
+  }
+  produce ca_bundle "ca" {
+    backends = [backend.x509.ca]
+  }
+  produce external "plugin" {
+    command = "$DIR/plugin"
+  }
+}
+
+policy "renew" {
+  verify identity {}
+
+  produce file "renewed" {
+    content = "again"
+  }
+}
+`
+
+func TestCheck(t *testing.T) {
+	cd := newCommandDir(t, commandConfig)
+	defer cd.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := runCheck([]string{"-config", cd.config}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	if want := cd.config + ": 1 backend(s), 2 policies\n"; stdout.String() != want {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	broken := newCommandDir(t, `
+policy "web" {
+  produce nope "motd" {}
+}
+`)
+	defer broken.Close()
+
+	stdout.Reset()
+	if code := runCheck([]string{"-config", broken.config}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit code 1 for a broken config, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "berny.be line 3") {
+		t.Errorf("expected a diagnostic pointing at the config, got %q", stderr.String())
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cd := newCommandDir(t, commandConfig)
+	defer cd.Close()
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-config", cd.config, "-machine", filepath.Join(cd.dir, "machine.json")}
+	if code := runExplain(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+
+	want := `policy "web": matches
+  verify gcp: passes
+  produce file "motd"
+    product web/motd
+  produce x509 "tls"
+    task ecdsa-key web/tls
+  produce file "tls.txt"
+    waits for produce x509 "tls"
+  produce ca_bundle "ca"
+    product web/ca/ca.pem
+  produce external "plugin"
+    not run, it has side effects
+policy "renew": matches if the request passes probes
+  verify identity: unknown, needs the request
+  produce file "renewed"
+    product renew/renewed
+`
+	if stdout.String() != want {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", stdout.String(), want)
+	}
+	if _, err := os.Stat(cd.marker); !os.IsNotExist(err) {
+		t.Errorf("explain ran the plugin")
+	}
+
+	broken := newCommandDir(t, `
+policy "web" {
+  produce file "motd" {
+    content = req.nope
+  }
+}
+`)
+	defer broken.Close()
+
+	stderr.Reset()
+	args = []string{"-config", broken.config, "-machine", filepath.Join(broken.dir, "machine.json")}
+	if code := runExplain(args, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "berny.be line 4") {
+		t.Errorf("expected a diagnostic pointing at the config, got %q", stderr.String())
+	}
+}
+
+func TestRevokeSSH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := inventory.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := api.MachineInfo{FQDN: "web-1.example.com"}
+	for _, c := range []inventory.Certificate{
+		{Kind: "x509", Serial: "1a", Issuer: "CN=CA", Subject: "CN=web-1", Machine: machine},
+		{Kind: "ssh", Serial: "2b", Subject: "web-1", Machine: machine},
+		{Kind: "x509", Serial: "3c", Issuer: "CN=CA", Subject: "CN=web-1", Machine: machine},
+	} {
+		if err := store.AddCertificate(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := runRevoke([]string{"-inventory", dir, "1a"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	if stdout.String() != "1 certificate(s) revoked\n" {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	// SSH certificates aren't counted as revoked, and fail the command
+	stdout.Reset()
+	if code := runRevoke([]string{"-inventory", dir, "2b"}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit code 1 revoking an SSH certificate, got %d", code)
+	}
+	if stdout.String() != "0 certificate(s) revoked\n" || !strings.Contains(stderr.String(), "2b: ssh certificate web-1 can't be revoked") {
+		t.Errorf("unexpected output %q, %q", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	if code := runDecommission([]string{"-inventory", dir, "web-1.example.com"}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit code 1 decommissioning a machine with an SSH certificate, got %d", code)
+	}
+	if stdout.String() != "web-1.example.com: 1 certificate(s) revoked\n" {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	store, err = inventory.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	revocations, err := store.Revocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 2 || revocations[0].Serial != "1a" || revocations[1].Serial != "3c" {
+		t.Errorf("unexpected revocations %+v", revocations)
+	}
+}
@@ -1,252 +1,163 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net"
 	"net/http"
 	"os"
+	"time"
 
-	"github.com/hashicorp/hcl2/gohcl"
-	"github.com/hashicorp/hcl2/hcl"
-	"github.com/hashicorp/hcl2/hcl/hclsyntax"
-	"github.com/zclconf/go-cty/cty"
-
-	"github.com/alvelcom/berny/pkg/api"
-	"github.com/alvelcom/berny/pkg/backend"
-	"github.com/alvelcom/berny/pkg/config"
-	"github.com/alvelcom/berny/pkg/probes"
-	"github.com/alvelcom/berny/pkg/producers"
-	"github.com/alvelcom/berny/pkg/task"
+	"github.com/alvelcom/berny/pkg/audit"
+	"github.com/alvelcom/berny/pkg/inventory"
+	"github.com/alvelcom/berny/pkg/logging"
+	"github.com/alvelcom/berny/pkg/server"
 )
 
 var (
 	listenAddr = flag.String("listen", "0.0.0.0:2326",
 		`Listen for incomming request there`)
 	configFile = flag.String("config", "test.be",
-		`Configuration file to use`)
+		`Configuration file or directory to use`)
+	tlsCert = flag.String("tls-cert", "",
+		`Serve HTTPS with this PEM certificate (chain)`)
+	tlsKey = flag.String("tls-key", "",
+		`Private key for -tls-cert`)
+	clientCA = flag.String("client-ca", "",
+		`PEM bundle to verify client identity certificates against`)
+	watchInterval = flag.Duration("watch", 5*time.Second,
+		`How often to check the config file for changes, 0 disables`)
+	inventoryPath = flag.String("inventory", "",
+		`Record issued certificates and harvests there, empty disables`)
+	inventoryType = flag.String("inventory-type", "file",
+		`Inventory store type`)
+	crlInterval = flag.Duration("crl-interval", server.DefaultCRLInterval,
+		`How often to regenerate CRLs, also OCSP responses' validity`)
+	parallelism = flag.Int("parallel", server.DefaultParallelism,
+		`How many producers of a harvest run at once`)
+	auditLog = flag.String("audit-log", "",
+		`Append a hash-chained record of every harvest there`)
+	logFormat = flag.String("log-format", "logfmt",
+		`Log format: logfmt or json`)
+	logLevel = flag.String("log-level", "info",
+		`Log entries of this level and above: debug, info, warn or error`)
+	configVars = make(varsFlag)
 )
 
-type Policy struct {
-	Name    string
-	Verify  []probes.Probe
-	Produce []producers.Producer
+func init() {
+	flag.Var(configVars, "var", `Set a config variable, name=value, can be repeated`)
 }
 
 func main() {
-	flag.Parse()
-	log := log.New(os.Stderr, "", log.LstdFlags)
-	log.Print(*listenAddr)
-
-	data, err := ioutil.ReadFile(*configFile)
-	if err != nil {
-		log.Fatal("Can't read config file: ", err)
-	}
-
-	file, diags := hclsyntax.ParseConfig(data, *configFile, hcl.Pos{1, 1, 0})
-	if len(diags) > 0 {
-		for _, diag := range diags {
-			fmt.Println(diag.Error())
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:], os.Stdout, os.Stderr))
+		case "explain":
+			os.Exit(runExplain(os.Args[2:], os.Stdout, os.Stderr))
+		case "inventory":
+			os.Exit(runInventory(os.Args[2:]))
+		case "revoke":
+			os.Exit(runRevoke(os.Args[2:], os.Stdout, os.Stderr))
+		case "decommission":
+			os.Exit(runDecommission(os.Args[2:], os.Stdout, os.Stderr))
+		case "audit":
+			os.Exit(runAudit(os.Args[2:]))
 		}
-		log.Fatal("Can't parse config")
 	}
 
-	var c config.Config
-	diags = gohcl.DecodeBody(file.Body, nil, &c)
-	if len(diags) > 0 {
-		for _, diag := range diags {
-			fmt.Println(diag.Error())
-		}
-		log.Fatal("Can't parse config")
+	flag.Parse()
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-
-	backends, err := castBackends(c.Backends)
+	log, err := logging.New(os.Stderr, *logFormat, level)
 	if err != nil {
-		log.Fatal("Can't cast backends: ", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	log.Info("starting", "listen", *listenAddr)
 
-	policies, err := castPolicies(c.Policies)
+	state, err := server.Load(*configFile, configVars)
 	if err != nil {
-		log.Fatal("Can't initialize policies: ", err)
+		server.LogDiagnostics(log, err)
+		log.Fatal("can't load config", "config", *configFile)
 	}
 
-	http.Handle("/v1/harvest", &harvestHandler{backends, policies, log})
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
-}
-
-func castBackends(bs []config.Backend) (*backend.Map, error) {
-	m := backend.NewMap()
-	for _, b := range bs {
-		err := m.Add(b)
-		if err != nil {
-			return m, err
-		}
+	opts := server.Options{
+		Log:         log,
+		CRLInterval: *crlInterval,
+		Parallelism: *parallelism,
 	}
-	return m, nil
-}
-
-func castPolicies(ps []config.Policy) ([]Policy, error) {
-	policies := []Policy{}
-	for _, p := range ps {
-		policy := Policy{
-			Name: p.Name,
-		}
-
-		for _, probe := range p.Verify {
-			probe, err := probes.New(probe)
-			if err != nil {
-				return nil, err
-			}
-			policy.Verify = append(policy.Verify, probe)
+	if len(*inventoryPath) > 0 {
+		opts.Inventory, err = inventory.New(*inventoryType, *inventoryPath)
+		if err != nil {
+			log.Fatal("can't open inventory", "error", err)
 		}
-
-		for _, producer := range p.Produce {
-			producer, err := producers.New(producer)
-			if err != nil {
-				return nil, err
+		if c, ok := opts.Inventory.(inventory.Compacter); ok {
+			if err := c.Compact(); err != nil {
+				log.Fatal("can't compact inventory", "error", err)
 			}
-			policy.Produce = append(policy.Produce, producer)
 		}
-
-		policies = append(policies, policy)
 	}
-	return policies, nil
-}
-
-// A bit of middleware sugar
-func ReadJSON(r *http.Request, j interface{}) error {
-	if r.Body == nil {
-		return errors.New("read json: no body")
-	}
-	return json.NewDecoder(r.Body).Decode(j)
-}
-
-func WriteJSON(w http.ResponseWriter, j interface{}) {
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(w).Encode(j); err != nil {
-		log.Print("WriteJSON failed: ", err)
-	}
-}
-
-type harvestHandler struct {
-	backends *backend.Map
-	policies []Policy
-	log      *log.Logger
-}
-
-func printJSON(j interface{}) error {
-	return json.NewEncoder(os.Stdout).Encode(j)
-}
-
-func (h *harvestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.log.Printf("%s: harvest", r.RemoteAddr)
-
-	var req api.Request
-	if err := ReadJSON(r, &req); err != nil {
-		log.Print("Bad request: ", err)
-		WriteJSON(w, map[string]string{"error": "bad"})
-		return
-	}
-
-	producerContext := &producers.Context{
-		Backends: h.backends,
-		EvalContext: &hcl.EvalContext{
-			Variables: map[string]cty.Value{
-				"req":     getReqVar(r, req.Machine),
-				"backend": getBackendVar(h.backends),
-			},
-		},
-		TaskResponses: make(producers.TaskResponses),
-	}
-
-	for i := range req.TaskResponses {
-		taskResp, err := task.FromAPIResponse(req.TaskResponses[i])
+	if len(*auditLog) > 0 {
+		opts.Audit, err = audit.Open(*auditLog)
 		if err != nil {
-			log.Printf("error = %v", err)
-			WriteJSON(w, map[string]string{"error": err.Error()})
-			return
+			log.Fatal("can't open audit log", "error", err)
 		}
-
-		var key [4]string
-		copy(key[:], req.TaskResponses[i].Name[:])
-		producerContext.TaskResponses[key] = taskResp
 	}
 
-	log.Printf("req = %#v", req)
-	log.Printf("ctx = %#v", producerContext)
-
-	var resp api.Response
-	for _, policy := range h.policies {
-		for _, producer := range policy.Produce {
-			tasks, err := producer.Prepare(producerContext)
-			if err != nil {
-				log.Printf("error = %v", err)
-				WriteJSON(w, map[string]string{"error": err.Error()})
-				return
-			}
-			for key := range tasks {
-				resp.Tasks = append(resp.Tasks, tasks[key].ToAPI(key[:]))
-			}
-		}
+	handler := server.New(state, opts)
+	go watchConfig(*configFile, configVars, *watchInterval, handler, log)
+	if opts.Inventory != nil {
+		go handler.WatchCRLs(*crlInterval)
 	}
-
-	if len(resp.Tasks) > 0 {
-		WriteJSON(w, resp)
-		return
+	handler.Routes(http.DefaultServeMux)
+	if len(*tlsCert) == 0 {
+		err := http.ListenAndServe(*listenAddr, nil)
+		log.Fatal("can't serve", "error", err)
 	}
 
-	for _, policy := range h.policies {
-		for _, producer := range policy.Produce {
-			p, err := producer.Produce(producerContext)
-			if err != nil {
-				log.Printf("error = %v", err.Error())
-				WriteJSON(w, map[string]string{"error": err.Error()})
-				return
-			}
-			resp.Products = append(resp.Products, p...)
-		}
+	tlsConfig, err := serverTLSConfig(*clientCA)
+	if err != nil {
+		log.Fatal("can't load client CA", "error", err)
 	}
-	WriteJSON(w, resp)
-}
-
-func getBackendVar(b *backend.Map) cty.Value {
-	x509 := make(map[string]cty.Value)
-	for key, value := range b.X509 {
-		var tmp *backend.X509 = &value
-		x509[key] = cty.ObjectVal(map[string]cty.Value{
-			"_x509": cty.CapsuleVal(backend.X509Type, &tmp),
-		})
+	srv := &http.Server{
+		Addr:      *listenAddr,
+		TLSConfig: tlsConfig,
 	}
-
-	return cty.ObjectVal(map[string]cty.Value{
-		"x509": cty.ObjectVal(x509),
-	})
+	err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	log.Fatal("can't serve", "error", err)
 }
 
-func getReqVar(hr *http.Request, mi *api.MachineInfo) cty.Value {
-	var ips []cty.Value
-	for i := range mi.IPs {
-		ips = append(ips, cty.StringVal(mi.IPs[i]))
+// serverTLSConfig asks clients for their identity certificates, but
+// doesn't insist on them: bootstrapping machines don't have one yet.
+func serverTLSConfig(caFile string) (*tls.Config, error) {
+	if len(caFile) == 0 {
+		return &tls.Config{}, nil
 	}
 
-	extra := make(map[string]cty.Value)
-	for key := range mi.Extra {
-		extra[key] = cty.StringVal(mi.Extra[key])
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
 	}
 
-	requestIP, _, err := net.SplitHostPort(hr.RemoteAddr)
-	if err != nil {
-		panic(err)
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates in " + caFile)
 	}
 
-	return cty.ObjectVal(map[string]cty.Value{
-		"fqdn":       cty.StringVal(mi.FQDN),
-		"ips":        cty.ListVal(ips),
-		"request_ip": cty.StringVal(requestIP),
-		"extra":      cty.MapVal(extra),
-	})
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
+
+func printJSON(j interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(j)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/alvelcom/berny/pkg/logging"
+	"github.com/alvelcom/berny/pkg/server"
+)
+
+// watchConfig reloads the config on SIGHUP and whenever modification time
+// of any config file changes. A broken config is logged and ignored, the
+// handler keeps serving the previous one.
+func watchConfig(fn string, vars map[string]string, interval time.Duration, h *server.Handler, log *logging.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	r := newReloader(fn, vars, h, log)
+	for {
+		select {
+		case <-hup:
+			log.Info("SIGHUP received, reloading config")
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+			log.Info("config file changed, reloading", "config", fn)
+		}
+		r.reload()
+	}
+}
+
+// reloader loads a config into a handler, remembering when its files were
+// last modified.
+type reloader struct {
+	fn   string
+	vars map[string]string
+	h    *server.Handler
+	log  *logging.Logger
+
+	lastMod time.Time
+}
+
+func newReloader(fn string, vars map[string]string, h *server.Handler, log *logging.Logger) *reloader {
+	return &reloader{
+		fn:      fn,
+		vars:    vars,
+		h:       h,
+		log:     log,
+		lastMod: modTime(fn, h.Current().Files),
+	}
+}
+
+// changed tells whether any config file was modified since the last load.
+func (r *reloader) changed() bool {
+	return !modTime(r.fn, r.h.Current().Files).Equal(r.lastMod)
+}
+
+// reload swaps a freshly loaded config in, or keeps the old one if the
+// new one is broken.
+func (r *reloader) reload() error {
+	state, err := server.Load(r.fn, r.vars)
+	if state != nil {
+		r.lastMod = modTime(r.fn, state.Files)
+	} else {
+		// A broken config isn't loaded again until it changes
+		r.lastMod = modTime(r.fn, r.h.Current().Files)
+	}
+	if err != nil {
+		server.LogDiagnostics(r.log, err)
+		r.log.Warn("can't reload config, keeping the old one", "config", r.fn)
+		return err
+	}
+
+	if err := r.h.Swap(state); err != nil {
+		r.log.Warn("can't reload config, keeping the old one", "config", r.fn, "error", err)
+		return err
+	}
+	r.log.Info("config reloaded", "config", r.fn)
+	return nil
+}
+
+// modTime is the latest modification time of the config path itself
+// (directories change when files are added or removed) and its files.
+func modTime(fn string, files map[string]*hcl.File) time.Time {
+	var latest time.Time
+	check := func(fn string) {
+		fi, err := os.Stat(fn)
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	check(fn)
+	for name := range files {
+		check(name)
+	}
+	return latest
+}
+
+// varsFlag collects -var name=value flags.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	var pairs []string
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varsFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return errors.New("expected name=value")
+	}
+	v[kv[0]] = kv[1]
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/logging"
+	"github.com/alvelcom/berny/pkg/server"
+)
+
+func discardLogger(t *testing.T) *logging.Logger {
+	log, err := logging.New(ioutil.Discard, "logfmt", logging.Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+// writeConfig replaces fn and moves its modification time forward, file
+// systems with coarse timestamps would miss a quick rewrite otherwise.
+func writeConfig(t *testing.T, fn, src string, mod time.Time) {
+	if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fn, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestReloader serves a config of a single policy named name.
+func newTestReloader(t *testing.T, name string) (*reloader, string) {
+	dir, err := ioutil.TempDir("", "berny-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "berny.be")
+	writeConfig(t, fn, `policy "`+name+`" {}`, time.Now().Add(-time.Hour))
+
+	state, err := server.Load(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := server.New(state, server.Options{})
+	return newReloader(fn, nil, h, discardLogger(t)), dir
+}
+
+func policyName(s *server.State) string {
+	if len(s.Policies) != 1 {
+		return ""
+	}
+	return s.Policies[0].Name
+}
+
+func TestReloadBrokenConfig(t *testing.T) {
+	r, dir := newTestReloader(t, "old")
+	defer os.RemoveAll(dir)
+	old := r.h.Current()
+
+	writeConfig(t, r.fn, `policy "new" {`, time.Now())
+	if err := r.reload(); err == nil {
+		t.Fatal("expected a broken config to fail")
+	}
+	if r.h.Current() != old || policyName(old) != "old" {
+		t.Errorf("broken config replaced the old one")
+	}
+	// Not retried until it changes again
+	if r.changed() {
+		t.Errorf("broken config is still reported as changed")
+	}
+}
+
+func TestReloadSwap(t *testing.T) {
+	r, dir := newTestReloader(t, "old")
+	defer os.RemoveAll(dir)
+	old := r.h.Current()
+
+	// Requests in flight see either config as a whole
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if name := policyName(r.h.Current()); name != "old" && name != "new" {
+					t.Errorf("unexpected policies %q", name)
+					return
+				}
+			}
+		}()
+	}
+
+	writeConfig(t, r.fn, `policy "new" {}`, time.Now())
+	err := r.reload()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := policyName(r.h.Current()); name != "new" {
+		t.Errorf("expected the new config, got policy %q", name)
+	}
+	if policyName(old) != "old" {
+		t.Errorf("reload changed the old state")
+	}
+}
+
+func TestReloadOnChange(t *testing.T) {
+	r, dir := newTestReloader(t, "old")
+	defer os.RemoveAll(dir)
+
+	if r.changed() {
+		t.Fatal("config reported changed right after loading")
+	}
+
+	writeConfig(t, r.fn, `policy "new" {}`, time.Now())
+	if !r.changed() {
+		t.Fatal("modified config isn't reported changed")
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.changed() {
+		t.Errorf("reloaded config is still reported changed")
+	}
+	if name := policyName(r.h.Current()); name != "new" {
+		t.Errorf("expected the new config, got policy %q", name)
+	}
+}
@@ -0,0 +1,59 @@
+// Package registry keeps what extension points of berny register by type
+// name: producers, probes, tasks and backends. Registries are safe for
+// concurrent use, packages wrap them with typed functions.
+package registry
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry maps type names to values of a single kind, constructors
+// usually.
+type Registry struct {
+	kind string
+
+	mu    sync.RWMutex
+	types map[string]interface{}
+}
+
+// New makes an empty registry, kind names it in panics.
+func New(kind string) *Registry {
+	return &Registry{
+		kind:  kind,
+		types: make(map[string]interface{}),
+	}
+}
+
+// Register adds a type, it panics if the type is taken.
+func (r *Registry) Register(type_ string, v interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, dup := r.types[type_]; dup {
+		panic(r.kind + ": Register called twice for " + type_)
+	}
+	r.types[type_] = v
+}
+
+// Lookup returns what type_ was registered with.
+func (r *Registry) Lookup(type_ string) (interface{}, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	v, ok := r.types[type_]
+	return v, ok
+}
+
+// Types lists registered types, sorted.
+func (r *Registry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var types []string
+	for type_ := range r.types {
+		types = append(types, type_)
+	}
+	sort.Strings(types)
+	return types
+}
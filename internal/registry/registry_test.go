@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New("things")
+	r.Register("b", 2)
+	r.Register("a", 1)
+
+	if v, ok := r.Lookup("a"); !ok || v != 1 {
+		t.Errorf("unexpected lookup %v, %v", v, ok)
+	}
+	if _, ok := r.Lookup("c"); ok {
+		t.Error("found a type that wasn't registered")
+	}
+	if types := r.Types(); !reflect.DeepEqual(types, []string{"a", "b"}) {
+		t.Errorf("unexpected types %v", types)
+	}
+
+	defer func() {
+		if p := recover(); p != "things: Register called twice for a" {
+			t.Errorf("unexpected panic %v", p)
+		}
+	}()
+	r.Register("a", 3)
+}
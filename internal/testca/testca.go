@@ -0,0 +1,118 @@
+// Package testca makes throwaway certificate authorities and certificates
+// for tests. Keys are ECDSA, certificates are valid from an hour ago to an
+// hour from now unless templates say otherwise.
+package testca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// CA is a self-signed certificate authority.
+type CA struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// New makes a CA named cn with a P-256 key.
+func New(t testing.TB, cn string) *CA {
+	return NewFrom(t, elliptic.P256(), &x509.Certificate{
+		Subject: pkix.Name{CommonName: cn},
+	})
+}
+
+// NewFrom makes a CA with a key on curve from template, filling in what
+// it leaves empty: serial number, validity, basic constraints and key
+// usage.
+func NewFrom(t testing.TB, curve elliptic.Curve, template *x509.Certificate) *CA {
+	t.Helper()
+	key := NewKey(t, curve)
+
+	tmpl := *template
+	fillIn(&tmpl)
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	if tmpl.KeyUsage == 0 {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CA{Cert: cert, Key: key}
+}
+
+// Issue signs template for a new P-256 key, filling in serial number and
+// validity if it leaves them empty.
+func (ca *CA) Issue(t testing.TB, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key := NewKey(t, elliptic.P256())
+
+	tmpl := *template
+	fillIn(&tmpl)
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// Sign signs template for template.PublicKey as is, the way x509 backends
+// do: the certificate comes with the chain, the CA alone.
+func (ca *CA) Sign(template *x509.Certificate) ([]byte, [][]byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, template.PublicKey, ca.Key)
+	return der, [][]byte{ca.Cert.Raw}, err
+}
+
+// NewKey generates a key on curve.
+func NewKey(t testing.TB, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// CertPEM encodes a DER certificate.
+func CertPEM(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// KeyPEM encodes a key the way ECDSA key tasks save it.
+func KeyPEM(t testing.TB, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func fillIn(tmpl *x509.Certificate) {
+	if tmpl.SerialNumber == nil {
+		tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+}
@@ -2,11 +2,18 @@ package api
 
 import "encoding/json"
 
+// RequestIDHeader names a harvest request, bernyd logs it with everything
+// about the request.
+const RequestIDHeader = "X-Request-Id"
+
 type Request struct {
 	ClientVersion int    `json:"client_version"`
 	ServerCookie  string `json:"server_cookie,omitempty"`
 
 	Machine *MachineInfo `json:"machine,omitempty"`
+	// Dir is where the client saves products, paths producers give out
+	// are in it. They are relative to it if it's empty.
+	Dir string `json:"dir,omitempty"`
 
 	TaskResponses []TaskResponse `json:"task_responses,omitempty"`
 }
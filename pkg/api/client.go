@@ -2,59 +2,305 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Client interface {
-	Harvest(r []TaskResponse) ([]Product, []Task, []Error, error)
+	Harvest(ctx context.Context, r []TaskResponse) ([]Product, []Task, []Error, error)
+}
+
+const (
+	DefaultTimeout    = 30 * time.Second
+	DefaultRetries    = 4
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+var ErrNoServers = errors.New("api: no servers")
+
+type ClientOptions struct {
+	// Timeout bounds a single request to a single server, DefaultTimeout
+	// if zero
+	Timeout time.Duration
+	// Retries is how many more rounds over all servers are made after
+	// transient errors, DefaultRetries if zero, none if negative
+	Retries int
+	// Backoff is the delay before the first retry, it doubles with every
+	// round up to MaxBackoff. Delays are jittered.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Dir, an absolute path, is where products are saved. It's sent to
+	// servers so paths to products they give out are absolute.
+	Dir string
+}
+
+// StatusError is a response with a status other than 200.
+type StatusError struct {
+	Code    int
+	Message string
+	// RetryAfter is the delay the server asked for, if any
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Message) > 0 {
+		return fmt.Sprintf("api: server responded %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("api: server responded %d", e.Code)
+}
+
+// Temporary tells whether the request is worth retrying.
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests || e.Code == http.StatusRequestTimeout
+}
+
+// server is a base URL and the client to reach it with, unix sockets
+// need a client of their own.
+type server struct {
+	url    string
+	client *http.Client
 }
 
 type HTTPClient struct {
-	client       *http.Client
-	url          string
+	servers      []server
+	opts         ClientOptions
 	serverCookie string
 	info         MachineInfo
+
+	mu        sync.Mutex
+	current   int // server that answered last
+	requestID string
 }
 
-func NewHTTPClient(c *http.Client, url string, info MachineInfo) (*HTTPClient, error) {
-	return &HTTPClient{
-		client: c,
-		url:    url,
-		info:   info,
-	}, nil
+// NewHTTPClient talks to servers in order, sticking to the one that
+// answered last. A server is an http(s) URL, or unix:///path/to/socket.
+func NewHTTPClient(c *http.Client, urls []string, info MachineInfo, opts ClientOptions) (*HTTPClient, error) {
+	if len(urls) == 0 {
+		return nil, ErrNoServers
+	}
+	if c == nil {
+		c = &http.Client{}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+
+	hc := &HTTPClient{opts: opts, info: info}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		switch u.Scheme {
+		case "http", "https":
+			hc.servers = append(hc.servers, server{
+				url:    strings.TrimSuffix(raw, "/"),
+				client: c,
+			})
+		case "unix":
+			hc.servers = append(hc.servers, server{
+				url:    "http://unix",
+				client: unixClient(c, u.Path),
+			})
+		default:
+			return nil, errors.New("api: unsupported server URL " + raw)
+		}
+	}
+	return hc, nil
+}
+
+func unixClient(c *http.Client, socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+		CheckRedirect: c.CheckRedirect,
+		Jar:           c.Jar,
+	}
 }
 
-func (hc *HTTPClient) Harvest(r []TaskResponse) (p []Product, t []Task, e []Error, err error) {
+// Harvest makes a harvest round. Transient failures are retried on the
+// next server, and after every server was tried, again after a delay.
+func (hc *HTTPClient) Harvest(ctx context.Context, r []TaskResponse) (p []Product, t []Task, e []Error, err error) {
 	var b bytes.Buffer
 	if err = json.NewEncoder(&b).Encode(Request{
 		ClientVersion: 0,
 		ServerCookie:  hc.serverCookie,
 		Machine:       &hc.info,
+		Dir:           hc.opts.Dir,
 		TaskResponses: r,
 	}); err != nil {
 		return
 	}
 
-	req, err := http.NewRequest("POST", hc.url+"/v1/harvest", &b)
+	hc.mu.Lock()
+	first := hc.current
+	hc.mu.Unlock()
+
+	var answer *Response
+	for round := 0; ; round++ {
+		var wait time.Duration
+		for i := range hc.servers {
+			n := (first + i) % len(hc.servers)
+			answer, err = hc.post(ctx, hc.servers[n], b.Bytes())
+			if err == nil {
+				hc.mu.Lock()
+				hc.current = n
+				hc.mu.Unlock()
+				return answer.Products, answer.Tasks, answer.Errors, nil
+			}
+			if ctx.Err() != nil {
+				return nil, nil, nil, ctx.Err()
+			}
+			if !temporary(err) {
+				return nil, nil, nil, err
+			}
+			if d := retryAfter(err); d > wait {
+				wait = d
+			}
+		}
+
+		if round >= hc.opts.Retries {
+			return nil, nil, nil, err
+		}
+		if d := hc.backoff(round); d > wait {
+			wait = d
+		}
+		if wait > hc.opts.MaxBackoff {
+			wait = hc.opts.MaxBackoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RequestID is the ID the server gave the last harvest request, it's how
+// the server's logs refer to it.
+func (hc *HTTPClient) RequestID() string {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.requestID
+}
+
+func (hc *HTTPClient) post(ctx context.Context, s server, body []byte) (*Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, hc.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", s.url+"/v1/harvest", bytes.NewReader(body))
 	if err != nil {
-		return
+		return nil, err
 	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := hc.client.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	hc.mu.Lock()
+	hc.requestID = resp.Header.Get(RequestIDHeader)
+	hc.mu.Unlock()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
 	var answer Response
 	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
-		return
+		return nil, err
 	}
+	return &answer, nil
+}
 
-	p = answer.Products
-	t = answer.Tasks
-	e = answer.Errors
-	err = nil
-	return
+// statusError reads the reason out of an error response, bernyd sends
+// {"error": "..."}.
+func statusError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		body.Error = strings.TrimSpace(string(b))
+	}
+
+	err := &StatusError{Code: resp.StatusCode, Message: body.Error}
+	if s, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && s > 0 {
+		err.RetryAfter = time.Duration(s) * time.Second
+	}
+	return err
+}
+
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*StatusError); ok {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// temporary tells transient errors from ones that retrying won't fix:
+// client errors, broken responses and certificates that fail verification.
+func temporary(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Temporary()
+	}
+
+	// Verification errors come wrapped by crypto/tls
+	var verification *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &verification) || errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backoff is the delay after a round, jittered between half and all of
+// it, so clients that failed together don't come back together.
+func (hc *HTTPClient) backoff(round int) time.Duration {
+	d := hc.opts.Backoff << uint(round)
+	if d > hc.opts.MaxBackoff || d <= 0 {
+		d = hc.opts.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
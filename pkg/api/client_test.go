@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testInfo = MachineInfo{FQDN: "web-1.example.com"}
+
+// fast retries, so tests don't wait
+var testOptions = ClientOptions{
+	Timeout:    time.Second,
+	Retries:    2,
+	Backoff:    time.Millisecond,
+	MaxBackoff: 10 * time.Millisecond,
+	Dir:        "/var/run/berny",
+}
+
+// harvestServer answers with the product, after failing the first fails
+// requests with status.
+func harvestServer(t *testing.T, fails int32, status int) (*httptest.Server, *int32) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if r.URL.Path != "/v1/harvest" || r.Method != "POST" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad request: %v", err)
+		}
+		if req.Machine == nil || req.Machine.FQDN != testInfo.FQDN {
+			t.Errorf("unexpected machine: %+v", req.Machine)
+		}
+		if req.Dir != testOptions.Dir {
+			t.Errorf("unexpected dir %q", req.Dir)
+		}
+
+		w.Header().Set(RequestIDHeader, fmt.Sprintf("id-%d", n))
+		if n <= fails {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": "try later"})
+			return
+		}
+		json.NewEncoder(w).Encode(Response{
+			Products: []Product{{Name: []string{"greeting"}, Mask: 0644, Body: []byte("hi")}},
+		})
+	}))
+	return s, &calls
+}
+
+func TestHarvest(t *testing.T) {
+	s, calls := harvestServer(t, 0, 0)
+	defer s.Close()
+
+	c, err := NewHTTPClient(s.Client(), []string{s.URL}, testInfo, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	products, _, _, err := c.Harvest(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || string(products[0].Body) != "hi" {
+		t.Errorf("unexpected products: %+v", products)
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 call, got %d", *calls)
+	}
+	if c.RequestID() != "id-1" {
+		t.Errorf("unexpected request ID %q", c.RequestID())
+	}
+}
+
+func TestHarvestRetry(t *testing.T) {
+	s, calls := harvestServer(t, 2, http.StatusServiceUnavailable)
+	defer s.Close()
+
+	c, err := NewHTTPClient(s.Client(), []string{s.URL}, testInfo, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := c.Harvest(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected 3 calls, got %d", *calls)
+	}
+}
+
+func TestHarvestRetriesExhausted(t *testing.T) {
+	s, calls := harvestServer(t, 100, http.StatusBadGateway)
+	defer s.Close()
+
+	c, err := NewHTTPClient(s.Client(), []string{s.URL}, testInfo, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = c.Harvest(context.Background(), nil)
+	if e, ok := err.(*StatusError); !ok || e.Code != http.StatusBadGateway || e.Message != "try later" {
+		t.Errorf("expected a 502 status error, got %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected 3 calls, got %d", *calls)
+	}
+}
+
+func TestHarvestNoRetryOnClientError(t *testing.T) {
+	s, calls := harvestServer(t, 100, http.StatusBadRequest)
+	defer s.Close()
+
+	c, err := NewHTTPClient(s.Client(), []string{s.URL}, testInfo, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = c.Harvest(context.Background(), nil)
+	if e, ok := err.(*StatusError); !ok || e.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 status error, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 call, got %d", *calls)
+	}
+}
+
+func TestHarvestNoRetryOnUntrustedCertificate(t *testing.T) {
+	var conns int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request made over an untrusted connection")
+	}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	defer s.Close()
+
+	// The default client doesn't trust the test server's certificate, a
+	// handshake timing out on a busy machine would be retried
+	opts := testOptions
+	opts.Timeout = 10 * time.Second
+	c, err := NewHTTPClient(nil, []string{s.URL}, testInfo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = c.Harvest(context.Background(), nil)
+	var verification *tls.CertificateVerificationError
+	if !errors.As(err, &verification) {
+		t.Errorf("expected a verification error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestHarvestFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	s, calls := harvestServer(t, 0, 0)
+	defer s.Close()
+
+	c, err := NewHTTPClient(s.Client(), []string{down.URL, s.URL}, testInfo, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := c.Harvest(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second harvest goes straight to the server that answered
+	if *calls != 2 {
+		t.Errorf("expected 2 calls, got %d", *calls)
+	}
+}
+
+func TestHarvestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+
+	opts := testOptions
+	opts.Timeout = 50 * time.Millisecond
+	opts.Retries = -1
+	c, err := NewHTTPClient(s.Client(), []string{s.URL}, testInfo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, _, _, err := c.Harvest(context.Background(), nil); err == nil {
+		t.Error("expected a timeout")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("request wasn't cut short")
+	}
+}
+
+func TestHarvestCancel(t *testing.T) {
+	s, _ := harvestServer(t, 100, http.StatusServiceUnavailable)
+	defer s.Close()
+
+	opts := testOptions
+	opts.Retries = 100
+	opts.Backoff = time.Hour
+	opts.MaxBackoff = time.Hour
+	c, err := NewHTTPClient(s.Client(), []string{s.URL}, testInfo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, _, err := c.Harvest(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the context to expire, got %v", err)
+	}
+}
+
+func TestHarvestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "bernyd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, calls := harvestServer(t, 0, 0)
+	s.Close()
+	s = httptest.NewUnstartedServer(s.Config.Handler)
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	c, err := NewHTTPClient(nil, []string{"unix://" + socket}, testInfo, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.Harvest(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 call, got %d", *calls)
+	}
+}
+
+func TestNewHTTPClientBadURL(t *testing.T) {
+	if _, err := NewHTTPClient(nil, []string{"ftp://example.com"}, testInfo, testOptions); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := NewHTTPClient(nil, nil, testInfo, testOptions); err != ErrNoServers {
+		t.Errorf("expected ErrNoServers, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Package audit writes a hash-chained log of harvests: every record holds
+// the hash of the previous one, so editing or dropping records breaks the
+// chain. Records describe what was delivered, never the content itself.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+type Record struct {
+	Seq      uint64 `json:"seq"`
+	PrevHash string `json:"prev_hash"`
+
+	RequestID string          `json:"request_id"`
+	Time      time.Time       `json:"time"`
+	RequestIP string          `json:"request_ip"`
+	Machine   api.MachineInfo `json:"machine"`
+	Policies  []Policy        `json:"policies,omitempty"`
+	Tasks     []Task          `json:"tasks,omitempty"`
+	Products  []Product       `json:"products,omitempty"`
+	Error     string          `json:"error,omitempty"`
+
+	// Hash covers everything above, it is computed with Hash empty
+	Hash string `json:"hash"`
+}
+
+// Policy holds the probe results of a policy evaluated for the request,
+// whether it passed or not. Verified tells whether all of its probes passed.
+type Policy struct {
+	Name     string  `json:"name"`
+	Verified bool    `json:"verified"`
+	Probes   []Probe `json:"probes,omitempty"`
+}
+
+type Probe struct {
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+}
+
+// Task is a task asked of the client, its body may hold secrets and is
+// left out.
+type Task struct {
+	Type string   `json:"type"`
+	Name []string `json:"name"`
+}
+
+type Product struct {
+	Name   []string `json:"name"`
+	Mask   int      `json:"mask"`
+	SHA256 string   `json:"sha256"`
+}
+
+func NewProduct(p api.Product) Product {
+	sum := sha256.Sum256(p.Body)
+	return Product{
+		Name:   p.Name,
+		Mask:   p.Mask,
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// Log appends records to a file, continuing the chain found there.
+type Log struct {
+	mu   sync.Mutex
+	fd   *os.File
+	seq  uint64
+	prev string
+}
+
+func Open(fn string) (*Log, error) {
+	head, err := Verify(fn, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{fd: fd}
+	if head != nil {
+		l.seq = head.Seq + 1
+		l.prev = head.Hash
+	}
+	return l, nil
+}
+
+// Append chains the record and writes it out. Seq, PrevHash and Hash are
+// filled in.
+func (l *Log) Append(r *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Seq = l.seq
+	r.PrevHash = l.prev
+	hash, err := r.hash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.fd.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	l.seq++
+	l.prev = r.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	return l.fd.Close()
+}
+
+func (r Record) hash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks the chain of a log and returns its last record, nil for
+// an empty or missing log. Each record seen is passed to visit, if any.
+func Verify(fn string, visit func(r *Record)) (*Record, error) {
+	fd, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var last *Record
+	rd := bufio.NewReader(fd)
+	for line := 1; ; line++ {
+		b, err := rd.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return last, nil
+		}
+		if err == io.EOF {
+			return last, fmt.Errorf("audit: line %d: truncated record", line)
+		}
+		if err != nil {
+			return last, err
+		}
+
+		r := new(Record)
+		if err := json.Unmarshal(b, r); err != nil {
+			return last, fmt.Errorf("audit: line %d: %v", line, err)
+		}
+
+		if err := r.follows(last); err != nil {
+			return last, fmt.Errorf("audit: line %d: %v", line, err)
+		}
+		if visit != nil {
+			visit(r)
+		}
+		last = r
+	}
+}
+
+// follows checks r is intact and comes right after prev.
+func (r *Record) follows(prev *Record) error {
+	hash, err := r.hash()
+	if err != nil {
+		return err
+	}
+	if hash != r.Hash {
+		return errors.New("record was modified")
+	}
+
+	switch {
+	case prev == nil && (r.Seq != 0 || len(r.PrevHash) > 0):
+		return errors.New("log doesn't start with the first record")
+	case prev != nil && r.Seq != prev.Seq+1:
+		return fmt.Errorf("record %d follows %d", r.Seq, prev.Seq)
+	case prev != nil && r.PrevHash != prev.Hash:
+		return errors.New("chain is broken")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+func appendRecords(t *testing.T, fn string, fqdns ...string) {
+	l, err := Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, fqdn := range fqdns {
+		r := &Record{
+			RequestID: "req-" + fqdn,
+			Time:      time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC),
+			RequestIP: "10.0.0.1",
+			Machine:   api.MachineInfo{FQDN: fqdn},
+			Products:  []Product{NewProduct(api.Product{Name: []string{"tls", "cert.pem"}, Mask: 0644, Body: []byte(fqdn)})},
+		}
+		if err := l.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verified(t *testing.T, fn string) []string {
+	var fqdns []string
+	_, err := Verify(fn, func(r *Record) {
+		fqdns = append(fqdns, r.Machine.FQDN)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fqdns
+}
+
+func TestAppendVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "audit.log")
+
+	if head, err := Verify(fn, nil); head != nil || err != nil {
+		t.Fatalf("unexpected %+v, %v for a missing log", head, err)
+	}
+
+	appendRecords(t, fn, "a", "b", "c")
+	if fqdns := verified(t, fn); strings.Join(fqdns, ",") != "a,b,c" {
+		t.Fatalf("unexpected records %v", fqdns)
+	}
+
+	// Reopening continues the chain
+	appendRecords(t, fn, "d")
+	appendRecords(t, fn, "e")
+	if fqdns := verified(t, fn); strings.Join(fqdns, ",") != "a,b,c,d,e" {
+		t.Fatalf("unexpected records %v", fqdns)
+	}
+
+	head, err := Verify(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Seq != 4 || head.Machine.FQDN != "e" {
+		t.Errorf("unexpected last record %+v", head)
+	}
+}
+
+func TestVerifyTampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good.log")
+	appendRecords(t, good, "a", "b", "c", "d")
+	data, err := ioutil.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines = lines[:len(lines)-1]
+	if len(lines) != 4 {
+		t.Fatalf("unexpected log %q", data)
+	}
+
+	join := func(ls ...[]byte) []byte {
+		return bytes.Join(ls, nil)
+	}
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"modified", join(lines[0], bytes.Replace(lines[1], []byte(`"b"`), []byte(`"x"`), 1), lines[2], lines[3]),
+			"line 2: record was modified"},
+		{"modified seq", join(lines[0], bytes.Replace(lines[1], []byte(`"seq":1`), []byte(`"seq":7`), 1), lines[2], lines[3]),
+			"line 2: record was modified"},
+		{"deleted middle", join(lines[0], lines[1], lines[3]),
+			"line 3: record 3 follows 1"},
+		{"deleted first", join(lines[1], lines[2], lines[3]),
+			"line 1: log doesn't start with the first record"},
+		{"reordered", join(lines[0], lines[2], lines[1], lines[3]),
+			"line 2: record 2 follows 0"},
+		{"truncated last line", join(lines[0], lines[1], lines[2], lines[3][:len(lines[3])/2]),
+			"line 4: truncated record"},
+		{"missing newline", join(lines[0], lines[1], lines[2], lines[3][:len(lines[3])-1]),
+			"line 4: truncated record"},
+		{"garbage", join(lines[0], []byte("{\n"), lines[1]),
+			"line 2: "},
+	} {
+		fn := filepath.Join(dir, "tampered.log")
+		if err := ioutil.WriteFile(fn, c.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := Verify(fn, nil)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+		// A broken log isn't appended to
+		if l, err := Open(fn); err == nil {
+			l.Close()
+			t.Errorf("%s: expected Open to fail", c.name)
+		}
+	}
+}
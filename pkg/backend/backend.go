@@ -1,27 +1,41 @@
 package backend
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
 	"reflect"
+	"time"
 
 	"github.com/hashicorp/hcl2/gohcl"
 	"github.com/hashicorp/hcl2/hcl"
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/crypto/ocsp"
 
 	"github.com/alvelcom/berny/pkg/config"
 )
 
 type Map struct {
-	X509 map[string]X509
+	X509   map[string]X509
+	SSH    map[string]SSH
+	Secret map[string]Secret
 }
 
 type X509 interface {
 	Sign(cert *x509.Certificate) (derCert []byte, derChain [][]byte, err error)
+	// CA returns the issuing certificate followed by the rest of its chain
+	CA() (derChain [][]byte, err error)
+
+	// CRL signs a revocation list valid until next
+	CRL(revoked []pkix.RevokedCertificate, now, next time.Time) ([]byte, error)
+	// OCSP signs a response about a certificate the backend issued, the CA
+	// responds itself
+	OCSP(template ocsp.Response) ([]byte, error)
 }
 
 var (
@@ -31,31 +45,39 @@ var (
 
 func NewMap() *Map {
 	return &Map{
-		X509: make(map[string]X509),
+		X509:   make(map[string]X509),
+		SSH:    make(map[string]SSH),
+		Secret: make(map[string]Secret),
 	}
 }
 
-func (m *Map) Add(c config.Backend) error {
-	var x509 X509
+func (m *Map) Add(c config.Backend, ctx *hcl.EvalContext) error {
+	new, err := lookup(c.Kind, c.Type)
+	if err != nil {
+		return err
+	}
+	impl := new()
 
-	switch c.Kind {
-	case "x509":
-		x509 = new(x509File)
-	default:
-		return errors.New("backend: no backend found")
+	diags := gohcl.DecodeBody(c.Config, ctx, impl)
+	if len(diags) > 0 {
+		return diags
 	}
 
-	var diags hcl.Diagnostics
-	switch {
-	case x509 != nil:
-		diags = gohcl.DecodeBody(c.Config, nil, x509)
-		m.X509[c.Name] = x509
-	default:
-		panic("backend: Add: what?")
+	if v, ok := impl.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
 	}
 
-	if len(diags) > 0 {
-		return diags
+	switch c.Kind {
+	case KindX509:
+		m.X509[c.Name] = impl.(X509)
+	case KindSSH:
+		m.SSH[c.Name] = impl.(SSH)
+	case KindSecret:
+		m.Secret[c.Name] = impl.(Secret)
+	default:
+		panic("backend: Add: what?")
 	}
 	return nil
 }
@@ -64,6 +86,12 @@ type x509File struct {
 	Key   string `hcl:"key"`
 	Cert  string `hcl:"cert"`
 	Chain string `hcl:"chain,optional"`
+
+	// Where bernyd serves the CRL, OCSP and the CA itself, embedded into
+	// every certificate signed
+	CRLURL    string `hcl:"crl_url,optional"`
+	OCSPURL   string `hcl:"ocsp_url,optional"`
+	IssuerURL string `hcl:"issuer_url,optional"`
 }
 
 func (x *x509File) Sign(template *x509.Certificate) ([]byte, [][]byte, error) {
@@ -85,6 +113,16 @@ func (x *x509File) Sign(template *x509.Certificate) ([]byte, [][]byte, error) {
 		}
 	}
 
+	if len(x.CRLURL) > 0 {
+		template.CRLDistributionPoints = append(template.CRLDistributionPoints, x.CRLURL)
+	}
+	if len(x.OCSPURL) > 0 {
+		template.OCSPServer = append(template.OCSPServer, x.OCSPURL)
+	}
+	if len(x.IssuerURL) > 0 {
+		template.IssuingCertificateURL = append(template.IssuingCertificateURL, x.IssuerURL)
+	}
+
 	newCert, err := x509.CreateCertificate(rand.Reader, template, cert, template.PublicKey, key)
 	if err != nil {
 		return nil, nil, err
@@ -93,6 +131,68 @@ func (x *x509File) Sign(template *x509.Certificate) ([]byte, [][]byte, error) {
 	return newCert, append([][]byte{certDer}, chainDer...), nil
 }
 
+func (x *x509File) CA() ([][]byte, error) {
+	_, certDer, err := loadCertFile(x.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var chainDer [][]byte
+	if len(x.Chain) > 0 {
+		chainDer, err = loadChainFile(x.Chain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append([][]byte{certDer}, chainDer...), nil
+}
+
+func (x *x509File) CRL(revoked []pkix.RevokedCertificate, now, next time.Time) ([]byte, error) {
+	key, err := loadKeyFile(x.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, _, err := loadCertFile(x.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return createCRL(cert, key, revoked, now, next)
+}
+
+func (x *x509File) OCSP(template ocsp.Response) ([]byte, error) {
+	key, err := loadKeyFile(x.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, _, err := loadCertFile(x.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.CreateResponse(cert, cert, template, key)
+}
+
+// Validate makes sure the files are readable, they are loaded again on
+// every Sign, so they can be rotated on disk.
+func (x *x509File) Validate() error {
+	if _, err := loadKeyFile(x.Key); err != nil {
+		return err
+	}
+	if _, _, err := loadCertFile(x.Cert); err != nil {
+		return err
+	}
+	if len(x.Chain) > 0 {
+		if _, err := loadChainFile(x.Chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func loadKeyFile(fn string) (*ecdsa.PrivateKey, error) {
 	b, err := ioutil.ReadFile(fn)
 	if err != nil {
@@ -136,11 +236,10 @@ func loadChainFile(fn string) ([][]byte, error) {
 	for {
 		var block *pem.Block
 		block, rest = pem.Decode(rest)
-		if len(rest) == 0 {
-			break
-		}
-
 		if block == nil {
+			if len(bytes.TrimSpace(rest)) == 0 {
+				break
+			}
 			return nil, errors.New("backend: can't decode chain's pem")
 		}
 
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+)
+
+var (
+	oidCRLNumber              = asn1.ObjectIdentifier{2, 5, 29, 20}
+	oidAuthorityKeyIdentifier = asn1.ObjectIdentifier{2, 5, 29, 35}
+
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// tbsCertList is pkix.TBSCertificateList with the issuer kept raw:
+// re-encoding the CA's subject, as x509.CreateCRL does, loses attributes
+// like emailAddress and clients can't match the CRL to its CA.
+type tbsCertList struct {
+	Version             int `asn1:"optional,default:0"`
+	Signature           pkix.AlgorithmIdentifier
+	Issuer              asn1.RawValue
+	ThisUpdate          time.Time
+	NextUpdate          time.Time                 `asn1:"optional"`
+	RevokedCertificates []pkix.RevokedCertificate `asn1:"optional"`
+	Extensions          []pkix.Extension          `asn1:"tag:0,optional,explicit"`
+}
+
+type certList struct {
+	TBSCertList        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+// createCRL signs a v2 CRL. Seconds since epoch make a CRL number that
+// only grows.
+func createCRL(ca *x509.Certificate, key *ecdsa.PrivateKey, revoked []pkix.RevokedCertificate, now, next time.Time) ([]byte, error) {
+	hash, algo, err := ecdsaSignature(key)
+	if err != nil {
+		return nil, err
+	}
+
+	crlNumber, err := asn1.Marshal(big.NewInt(now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	extensions := []pkix.Extension{{Id: oidCRLNumber, Value: crlNumber}}
+
+	if len(ca.SubjectKeyId) > 0 {
+		aki, err := asn1.Marshal(struct {
+			KeyIdentifier []byte `asn1:"optional,tag:0"`
+		}{ca.SubjectKeyId})
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidAuthorityKeyIdentifier, Value: aki})
+	}
+
+	utc := make([]pkix.RevokedCertificate, len(revoked))
+	for i, rc := range revoked {
+		rc.RevocationTime = rc.RevocationTime.UTC()
+		utc[i] = rc
+	}
+
+	tbs, err := asn1.Marshal(tbsCertList{
+		Version:             1,
+		Signature:           algo,
+		Issuer:              asn1.RawValue{FullBytes: ca.RawSubject},
+		ThisUpdate:          now.UTC(),
+		NextUpdate:          next.UTC(),
+		RevokedCertificates: utc,
+		Extensions:          extensions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(tbs)
+	signature, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(certList{
+		TBSCertList:        asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: algo,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+}
+
+// ecdsaSignature picks a hash the way x509.CreateCertificate does.
+func ecdsaSignature(key *ecdsa.PrivateKey) (crypto.Hash, pkix.AlgorithmIdentifier, error) {
+	switch key.Curve {
+	case elliptic.P224(), elliptic.P256():
+		return crypto.SHA256, pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	case elliptic.P384():
+		return crypto.SHA384, pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384}, nil
+	case elliptic.P521():
+		return crypto.SHA512, pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA512}, nil
+	default:
+		return 0, pkix.AlgorithmIdentifier{}, errors.New("backend: unsupported curve")
+	}
+}
@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/internal/testca"
+)
+
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// testCA has emailAddress in its subject, which x509.CreateCRL drops.
+func testCA(t *testing.T, curve elliptic.Curve) (*x509.Certificate, *ecdsa.PrivateKey) {
+	ca := testca.NewFrom(t, curve, &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "Test CA",
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidEmailAddress, Value: "ca@example.com"}},
+		},
+		SubjectKeyId: []byte{1, 2, 3, 4},
+	})
+	return ca.Cert, ca.Key
+}
+
+func TestCreateCRL(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		ca, key := testCA(t, curve)
+
+		now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+		revoked := []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(10), RevocationTime: now.Add(-time.Hour)},
+			{SerialNumber: big.NewInt(11), RevocationTime: now.Add(-time.Minute)},
+		}
+		der, err := createCRL(ca, key, revoked, now, now.Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crl, err := x509.ParseCRL(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ca.CheckCRLSignature(crl); err != nil {
+			t.Errorf("%s: %v", curve.Params().Name, err)
+		}
+
+		var tbs tbsCertList
+		if _, err := asn1.Unmarshal(crl.TBSCertList.Raw, &tbs); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tbs.Issuer.FullBytes, ca.RawSubject) {
+			t.Error("issuer isn't the CA's subject as is")
+		}
+		if tbs.Version != 1 || !tbs.ThisUpdate.Equal(now) || !tbs.NextUpdate.Equal(now.Add(2*time.Hour)) {
+			t.Errorf("unexpected tbs %+v", tbs)
+		}
+
+		list := crl.TBSCertList.RevokedCertificates
+		if len(list) != 2 || list[0].SerialNumber.Int64() != 10 || list[1].SerialNumber.Int64() != 11 ||
+			!list[0].RevocationTime.Equal(now.Add(-time.Hour)) {
+			t.Errorf("unexpected revoked certificates %+v", list)
+		}
+
+		exts := make(map[string][]byte)
+		for _, ext := range crl.TBSCertList.Extensions {
+			exts[ext.Id.String()] = ext.Value
+		}
+		var number *big.Int
+		if _, err := asn1.Unmarshal(exts[oidCRLNumber.String()], &number); err != nil || number.Int64() != now.Unix() {
+			t.Errorf("unexpected CRL number %v", number)
+		}
+		var aki struct {
+			KeyIdentifier []byte `asn1:"optional,tag:0"`
+		}
+		if _, err := asn1.Unmarshal(exts[oidAuthorityKeyIdentifier.String()], &aki); err != nil ||
+			!bytes.Equal(aki.KeyIdentifier, ca.SubjectKeyId) {
+			t.Errorf("unexpected authority key identifier %x", aki.KeyIdentifier)
+		}
+	}
+}
+
+func TestCreateCRLWrongKey(t *testing.T) {
+	ca, _ := testCA(t, elliptic.P256())
+	_, other := testCA(t, elliptic.P256())
+
+	der, err := createCRL(ca, other, nil, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CheckCRLSignature(crl); err == nil {
+		t.Error("expected a CRL signed by another key to fail")
+	}
+}
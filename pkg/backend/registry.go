@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"errors"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/alvelcom/berny/internal/registry"
+)
+
+// Backend kinds, the first label of a backend block
+const (
+	KindX509   = "x509"
+	KindSSH    = "ssh"
+	KindSecret = "secret"
+)
+
+// Validator is implemented by backends that can check their configuration
+// before the first request comes in.
+type Validator interface {
+	Validate() error
+}
+
+var registries = map[string]*registry.Registry{
+	KindX509:   registry.New("backend x509"),
+	KindSSH:    registry.New("backend ssh"),
+	KindSecret: registry.New("backend secret"),
+}
+
+func init() {
+	RegisterX509("file", func() X509 { return new(x509File) })
+	RegisterSSH("file", func() SSH { return new(sshFile) })
+	RegisterSecret("file", func() Secret { return new(secretFile) })
+}
+
+// RegisterX509 makes an x509 backend type available to configs. new
+// returns an empty backend, the block body is decoded into it with gohcl,
+// so its hcl tags are the schema. Backends are used by concurrent
+// producers. It panics if the type is taken.
+func RegisterX509(type_ string, new func() X509) {
+	register(KindX509, type_, func() interface{} { return new() })
+}
+
+// RegisterSSH is RegisterX509 for ssh backends.
+func RegisterSSH(type_ string, new func() SSH) {
+	register(KindSSH, type_, func() interface{} { return new() })
+}
+
+// RegisterSecret is RegisterX509 for secret backends.
+func RegisterSecret(type_ string, new func() Secret) {
+	register(KindSecret, type_, func() interface{} { return new() })
+}
+
+func register(kind, type_ string, new func() interface{}) {
+	registries[kind].Register(type_, new)
+}
+
+func lookup(kind, type_ string) (func() interface{}, error) {
+	r, ok := registries[kind]
+	if !ok {
+		return nil, errors.New("backend: unknown kind " + kind)
+	}
+	new, ok := r.Lookup(type_)
+	if !ok {
+		return nil, errors.New("backend: no " + kind + " backend of type " + type_)
+	}
+	return new.(func() interface{}), nil
+}
+
+// Types lists registered types of a kind.
+func Types(kind string) []string {
+	r, ok := registries[kind]
+	if !ok {
+		return nil
+	}
+	return r.Types()
+}
+
+// Schema describes the body of a backend block, besides its type.
+func Schema(kind, type_ string) (*hcl.BodySchema, error) {
+	new, err := lookup(kind, type_)
+	if err != nil {
+		return nil, err
+	}
+	schema, _ := gohcl.ImpliedBodySchema(new())
+	return schema, nil
+}
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Secret derives secrets from a master key, the same info always gives
+// the same secret.
+type Secret interface {
+	Derive(info []byte) (io.Reader, error)
+}
+
+var (
+	SecretReflect = reflect.TypeOf((*Secret)(nil))
+	SecretType    = cty.Capsule("backend.Secret", SecretReflect)
+)
+
+// secretFile keeps a master key in a file, surrounding whitespace is
+// ignored.
+type secretFile struct {
+	Key string `hcl:"key"`
+}
+
+// Derive returns an HKDF-SHA256 stream, it's good for 255*32 bytes.
+func (s *secretFile) Derive(info []byte) (io.Reader, error) {
+	master, err := loadSecretFile(s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return hkdf.New(sha256.New, master, nil, info), nil
+}
+
+func (s *secretFile) Validate() error {
+	_, err := loadSecretFile(s.Key)
+	return err
+}
+
+func loadSecretFile(fn string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) < 16 {
+		return nil, errors.New("backend: secret: master key is shorter than 16 bytes")
+	}
+	return b, nil
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/crypto/ssh"
+)
+
+type SSH interface {
+	SignSSH(cert *ssh.Certificate) error
+}
+
+var (
+	SSHReflect = reflect.TypeOf((*SSH)(nil))
+	SSHType    = cty.Capsule("backend.SSH", SSHReflect)
+)
+
+// sshFile is an SSH certificate authority with its key in a file, in any
+// format ssh.ParsePrivateKey understands.
+type sshFile struct {
+	Key string `hcl:"key"`
+}
+
+func (s *sshFile) SignSSH(cert *ssh.Certificate) error {
+	signer, err := loadSSHKeyFile(s.Key)
+	if err != nil {
+		return err
+	}
+
+	return cert.SignCert(rand.Reader, signer)
+}
+
+func (s *sshFile) Validate() error {
+	_, err := loadSSHKeyFile(s.Key)
+	return err
+}
+
+func loadSSHKeyFile(fn string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(b)
+}
@@ -0,0 +1,282 @@
+// Package client runs harvests: it asks the server for products, solves
+// the tasks the server hands out and saves whatever is delivered. That's
+// all of berny, so agents can embed it.
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/logging"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// DefaultMaxRounds is well above what any policy needs, it only stops a
+// server that keeps asking for tasks.
+const DefaultMaxRounds = 16
+
+var (
+	ErrTooManyRounds = errors.New("client: too many harvest rounds")
+)
+
+// Sink stores products. Tasks read products of previous rounds from it,
+// e.g. a private key to put into a keystore.
+type Sink interface {
+	task.Env
+
+	// Save stores a product and tells whether it differs from the stored one
+	Save(p api.Product) (changed bool, err error)
+}
+
+// Hooks are called as a harvest goes, any of them may be nil.
+type Hooks struct {
+	// Round is called after every response of the server
+	Round func(n int, requestID string)
+	// Task is called before a task is solved
+	Task func(t api.Task)
+	// Product is called after a product is saved
+	Product func(p api.Product, changed bool)
+}
+
+type Options struct {
+	// MaxRounds limits harvest rounds, DefaultMaxRounds if zero
+	MaxRounds int
+	// Parallelism is how many tasks are solved at once, the number of
+	// CPUs if zero
+	Parallelism int
+	// Log is where progress goes, nothing is logged if nil
+	Log   *logging.Logger
+	Hooks Hooks
+}
+
+type Harvester struct {
+	client api.Client
+	sink   Sink
+	opts   Options
+}
+
+func New(c api.Client, sink Sink, opts Options) *Harvester {
+	if opts.MaxRounds <= 0 {
+		opts.MaxRounds = DefaultMaxRounds
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	if opts.Log == nil {
+		opts.Log, _ = logging.New(ioutil.Discard, "logfmt", logging.Error)
+	}
+	return &Harvester{client: c, sink: sink, opts: opts}
+}
+
+// Result describes a finished harvest.
+type Result struct {
+	Rounds     int
+	RequestIDs []string
+	Products   []Product
+}
+
+// Product is a saved product, its body is left out.
+type Product struct {
+	Name    []string
+	Mask    int
+	Changed bool
+}
+
+// Changed lists names of products that differ from the ones saved before.
+func (r *Result) Changed() [][]string {
+	var names [][]string
+	for _, p := range r.Products {
+		if p.Changed {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// DuplicateTaskError is returned when the server asks for a task that was
+// solved already, a buggy producer would otherwise keep the client
+// generating keys forever.
+type DuplicateTaskError struct {
+	Name []string
+}
+
+func (e *DuplicateTaskError) Error() string {
+	return "client: server asked for task " + strings.Join(e.Name, "/") + " again"
+}
+
+// TaskError is a task the client failed to solve.
+type TaskError struct {
+	Name []string
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return "client: task " + strings.Join(e.Name, "/") + ": " + e.Err.Error()
+}
+
+// TaskErrors are errors of every task of a round that failed.
+type TaskErrors []*TaskError
+
+func (e TaskErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ServerError holds errors the server responded with.
+type ServerError []api.Error
+
+func (e ServerError) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Type + ": " + e[i].Message
+	}
+	return "client: server error: " + strings.Join(msgs, "; ")
+}
+
+// requestIDer is implemented by clients that know how the server named the
+// last request, api.HTTPClient does.
+type requestIDer interface {
+	RequestID() string
+}
+
+// Harvest runs rounds until the server stops asking for tasks. Products
+// saved before a failure are in the result.
+func (h *Harvester) Harvest(ctx context.Context) (*Result, error) {
+	result := new(Result)
+	var taskResps []api.TaskResponse
+	solved := make(map[string]bool)
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if result.Rounds == h.opts.MaxRounds {
+			return result, ErrTooManyRounds
+		}
+
+		log := h.opts.Log
+		log.Debug("harvesting", "task_responses", len(taskResps))
+		prods, tasks, errs, err := h.client.Harvest(ctx, taskResps)
+		result.Rounds++
+
+		var requestID string
+		if c, ok := h.client.(requestIDer); ok {
+			requestID = c.RequestID()
+			result.RequestIDs = append(result.RequestIDs, requestID)
+			log = log.With("request_id", requestID)
+		}
+		if err != nil {
+			return result, err
+		}
+		if h.opts.Hooks.Round != nil {
+			h.opts.Hooks.Round(result.Rounds, requestID)
+		}
+		if len(errs) > 0 {
+			return result, ServerError(errs)
+		}
+
+		for i := range tasks {
+			key := strings.Join(tasks[i].Name, "\x00")
+			if solved[key] {
+				return result, &DuplicateTaskError{Name: tasks[i].Name}
+			}
+			solved[key] = true
+		}
+
+		solved, err := h.solve(ctx, log, tasks)
+		if err != nil {
+			return result, err
+		}
+		var taskProducts []api.Product
+		for _, s := range solved {
+			taskResps = append(taskResps, s.resp)
+			taskProducts = append(taskProducts, s.products...)
+		}
+
+		if err := h.save(log, result, taskProducts); err != nil {
+			return result, err
+		}
+		if err := h.save(log, result, prods); err != nil {
+			return result, err
+		}
+
+		if len(tasks) == 0 {
+			return result, nil
+		}
+	}
+}
+
+type solution struct {
+	products []api.Product
+	resp     api.TaskResponse
+}
+
+// solve solves tasks of a round, up to Parallelism at once. Solutions are
+// in the order of tasks, errors of every failed task are returned.
+func (h *Harvester) solve(ctx context.Context, log *logging.Logger, tasks []api.Task) ([]solution, error) {
+	solved := make([]solution, len(tasks))
+	errs := make([]error, len(tasks))
+	sem := make(chan struct{}, h.opts.Parallelism)
+
+	var wg sync.WaitGroup
+	for i := range tasks {
+		if h.opts.Hooks.Task != nil {
+			h.opts.Hooks.Task(tasks[i])
+		}
+		log.Info("solving task", "task", tasks[i])
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if errs[i] = ctx.Err(); errs[i] != nil {
+				return
+			}
+			solved[i].products, solved[i].resp, errs[i] = task.Solve(tasks[i], h.sink)
+		}(i)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var failed TaskErrors
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, &TaskError{Name: tasks[i].Name, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return nil, failed
+	}
+	return solved, nil
+}
+
+func (h *Harvester) save(log *logging.Logger, result *Result, ps []api.Product) error {
+	for _, p := range ps {
+		changed, err := h.sink.Save(p)
+		if err != nil {
+			return err
+		}
+		log.Info("saved product", "product", p, "changed", changed)
+
+		result.Products = append(result.Products, Product{
+			Name:    p.Name,
+			Mask:    p.Mask,
+			Changed: changed,
+		})
+		if h.opts.Hooks.Product != nil {
+			h.opts.Hooks.Product(p, changed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// harvestServer answers the n-th request, counting from 1, with respond.
+func harvestServer(t *testing.T, respond func(n int, req *api.Request) api.Response) *httptest.Server {
+	n := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		var req api.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad request: %v", err)
+		}
+		w.Header().Set(api.RequestIDHeader, fmt.Sprintf("id-%d", n))
+		json.NewEncoder(w).Encode(respond(n, &req))
+	}))
+}
+
+func newHarvester(t *testing.T, s *httptest.Server, dir string, opts Options) *Harvester {
+	c, err := api.NewHTTPClient(s.Client(), []string{s.URL}, api.MachineInfo{FQDN: "web-1.example.com"},
+		api.ClientOptions{Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(c, Dir(dir), opts)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "berny-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// keyTask asks for a key saved as name.
+func keyTask(name ...string) api.Task {
+	t := task.ECDSAKey{
+		Curve:    "P-256",
+		Template: api.Product{Name: name, Mask: 0600},
+	}
+	return t.ToAPI(name)
+}
+
+func TestHarvest(t *testing.T) {
+	s := harvestServer(t, func(n int, req *api.Request) api.Response {
+		if n == 1 {
+			return api.Response{Tasks: []api.Task{keyTask("web", "key.pem")}}
+		}
+		if len(req.TaskResponses) != 1 || req.TaskResponses[0].Type != "ecdsa-key" {
+			t.Errorf("unexpected task responses: %+v", req.TaskResponses)
+		}
+		return api.Response{Products: []api.Product{
+			{Name: []string{"web", "cert.pem"}, Mask: 0644, Body: []byte("cert")},
+		}}
+	})
+	defer s.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var rounds []string
+	var tasks, products [][]string
+	h := newHarvester(t, s, dir, Options{Hooks: Hooks{
+		Round:   func(n int, requestID string) { rounds = append(rounds, fmt.Sprintf("%d:%s", n, requestID)) },
+		Task:    func(t api.Task) { tasks = append(tasks, t.Name) },
+		Product: func(p api.Product, changed bool) { products = append(products, p.Name) },
+	}})
+
+	result, err := h.Harvest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rounds != 2 {
+		t.Errorf("expected 2 rounds, got %d", result.Rounds)
+	}
+	if !reflect.DeepEqual(result.RequestIDs, []string{"id-1", "id-2"}) {
+		t.Errorf("unexpected request IDs %v", result.RequestIDs)
+	}
+	if !reflect.DeepEqual(rounds, []string{"1:id-1", "2:id-2"}) {
+		t.Errorf("unexpected rounds %v", rounds)
+	}
+	if !reflect.DeepEqual(tasks, [][]string{{"web", "key.pem"}}) {
+		t.Errorf("unexpected tasks %v", tasks)
+	}
+	want := [][]string{{"web", "key.pem"}, {"web", "cert.pem"}}
+	if !reflect.DeepEqual(products, want) {
+		t.Errorf("unexpected products %v", products)
+	}
+	if !reflect.DeepEqual(result.Changed(), want) {
+		t.Errorf("unexpected changed products %v", result.Changed())
+	}
+
+	st, err := os.Stat(filepath.Join(dir, "web", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("key is saved with mode %v", st.Mode().Perm())
+	}
+}
+
+func TestHarvestChanged(t *testing.T) {
+	mask := 0644
+	body := "one"
+	s := harvestServer(t, func(n int, req *api.Request) api.Response {
+		return api.Response{Products: []api.Product{
+			{Name: []string{"same"}, Mask: 0644, Body: []byte("same")},
+			{Name: []string{"other"}, Mask: mask, Body: []byte(body)},
+		}}
+	})
+	defer s.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	h := newHarvester(t, s, dir, Options{})
+
+	tests := []struct {
+		mask    int
+		body    string
+		changed [][]string
+	}{
+		{0644, "one", [][]string{{"same"}, {"other"}}},
+		{0644, "one", nil},
+		{0644, "two", [][]string{{"other"}}},
+		{0600, "two", [][]string{{"other"}}},
+	}
+	for i, test := range tests {
+		mask, body = test.mask, test.body
+		result, err := h.Harvest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Products) != 2 {
+			t.Errorf("%d: expected 2 products, got %+v", i, result.Products)
+		}
+		if !reflect.DeepEqual(result.Changed(), test.changed) {
+			t.Errorf("%d: expected %v changed, got %v", i, test.changed, result.Changed())
+		}
+	}
+}
+
+func TestHarvestMaxRounds(t *testing.T) {
+	s := harvestServer(t, func(n int, req *api.Request) api.Response {
+		// A new task every round, the server never has enough
+		return api.Response{Tasks: []api.Task{keyTask(fmt.Sprintf("key-%d.pem", n))}}
+	})
+	defer s.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	h := newHarvester(t, s, dir, Options{MaxRounds: 3})
+
+	result, err := h.Harvest(context.Background())
+	if err != ErrTooManyRounds {
+		t.Fatalf("expected ErrTooManyRounds, got %v", err)
+	}
+	if result.Rounds != 3 {
+		t.Errorf("expected 3 rounds, got %d", result.Rounds)
+	}
+	if len(result.Products) != 3 {
+		t.Errorf("products of finished rounds are lost: %+v", result.Products)
+	}
+}
+
+func TestHarvestRepeatedTask(t *testing.T) {
+	s := harvestServer(t, func(n int, req *api.Request) api.Response {
+		return api.Response{Tasks: []api.Task{keyTask("key.pem")}}
+	})
+	defer s.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	h := newHarvester(t, s, dir, Options{})
+
+	result, err := h.Harvest(context.Background())
+	dup, ok := err.(*DuplicateTaskError)
+	if !ok {
+		t.Fatalf("expected DuplicateTaskError, got %v", err)
+	}
+	if !reflect.DeepEqual(dup.Name, []string{"key.pem"}) {
+		t.Errorf("unexpected task %v", dup.Name)
+	}
+	if result.Rounds != 2 {
+		t.Errorf("expected 2 rounds, got %d", result.Rounds)
+	}
+}
+
+func TestHarvestCancel(t *testing.T) {
+	s := harvestServer(t, func(n int, req *api.Request) api.Response {
+		return api.Response{Tasks: []api.Task{keyTask(fmt.Sprintf("key-%d.pem", n))}}
+	})
+	defer s.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHarvester(t, s, dir, Options{Hooks: Hooks{
+		Round: func(n int, requestID string) { cancel() },
+	}})
+
+	result, err := h.Harvest(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if result.Rounds != 1 || len(result.Products) != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "key-1.pem")); !os.IsNotExist(err) {
+		t.Errorf("task of a canceled harvest was solved: %v", err)
+	}
+}
+
+func TestDirSave(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := Dir(dir)
+
+	tests := []struct {
+		product api.Product
+		changed bool
+	}{
+		{api.Product{Name: []string{"a", "b.txt"}, Mask: 0640, Body: []byte("one")}, true},
+		{api.Product{Name: []string{"a", "b.txt"}, Mask: 0640, Body: []byte("one")}, false},
+		{api.Product{Name: []string{"a", "b.txt"}, Mask: 0600, Body: []byte("one")}, true},
+		{api.Product{Name: []string{"a", "b.txt"}, Mask: 0600, Body: []byte("two")}, true},
+	}
+	for i, test := range tests {
+		changed, err := d.Save(test.product)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if changed != test.changed {
+			t.Errorf("%d: expected changed %v, got %v", i, test.changed, changed)
+		}
+
+		fn := filepath.Join(dir, "a", "b.txt")
+		st, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != os.FileMode(test.product.Mask) {
+			t.Errorf("%d: expected mode %v, got %v", i, os.FileMode(test.product.Mask), st.Mode().Perm())
+		}
+		body, err := d.ReadProduct(test.product.Name)
+		if err != nil || string(body) != string(test.product.Body) {
+			t.Errorf("%d: read %q, %v", i, body, err)
+		}
+	}
+
+	// Temporary files are renamed over products, none are left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected only b.txt, got %d files", len(files))
+	}
+}
+
+func TestDirBadNames(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := Dir(filepath.Join(dir, "products"))
+
+	bad := [][]string{
+		nil,
+		{""},
+		{"."},
+		{".."},
+		{"..", "x"},
+		{"a", "..", "..", "x"},
+		{"/", ".."},
+	}
+	for _, name := range bad {
+		if _, err := d.Save(api.Product{Name: name, Mask: 0644, Body: []byte("x")}); err == nil {
+			t.Errorf("%q: saved outside the directory", name)
+		}
+		if _, err := d.ReadProduct(name); err == nil {
+			t.Errorf("%q: read outside the directory", name)
+		}
+	}
+
+	// Names are relative to the directory, even absolute ones
+	if _, err := d.Save(api.Product{Name: []string{"/a", "../b"}, Mask: 0644, Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "products", "b")); err != nil {
+		t.Error(err)
+	}
+}
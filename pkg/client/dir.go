@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+// Dir saves products as files under a directory, a product's name is its
+// path there.
+type Dir string
+
+// path refuses names that leave the directory, product names come from
+// the server's config and plugins.
+func (d Dir) path(name []string) (string, error) {
+	rel := strings.TrimPrefix(path.Join(name...), "/")
+	if rel == "" || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.New("client: bad product name " + strings.Join(name, "/"))
+	}
+	return path.Join(string(d), rel), nil
+}
+
+func (d Dir) ReadProduct(name []string) ([]byte, error) {
+	fn, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fn)
+}
+
+// Save writes a product unless the file holds it already, with the same
+// mode. It's written next to the file and renamed over it, so readers
+// never see a partial product.
+func (d Dir) Save(p api.Product) (bool, error) {
+	name, err := d.path(p.Name)
+	if err != nil {
+		return false, err
+	}
+	mode := os.FileMode(p.Mask)
+	if st, err := os.Stat(name); err == nil && st.Mode().Perm() == mode.Perm() {
+		old, err := ioutil.ReadFile(name)
+		if err == nil && bytes.Equal(old, p.Body) {
+			return false, nil
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(name), os.FileMode(0755)); err != nil {
+		return false, err
+	}
+
+	fd, err := ioutil.TempFile(path.Dir(name), "."+path.Base(name)+".")
+	if err != nil {
+		return false, err
+	}
+	tmp := fd.Name()
+
+	if err := fd.Chmod(mode); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return false, err
+	}
+	_, err = fd.Write(p.Body)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
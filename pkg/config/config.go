@@ -9,6 +9,10 @@ import (
 type Config struct {
 	Backends []Backend `hcl:"backend,block"`
 	Policies []Policy  `hcl:"policy,block"`
+
+	// EvalContext holds variables and locals, blocks' remaining bodies
+	// should be decoded with it.
+	EvalContext *hcl.EvalContext
 }
 
 type Backend struct {
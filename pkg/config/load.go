@@ -0,0 +1,346 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+
+	"github.com/alvelcom/berny/pkg/functions"
+)
+
+// VarEnvPrefix is a prefix of environment variables overriding variable
+// blocks, e.g. BERNY_VAR_cluster overrides variable "cluster".
+const VarEnvPrefix = "BERNY_VAR_"
+
+type Variable struct {
+	Name        string    `hcl:"name,label"`
+	Default     cty.Value `hcl:"default,optional"`
+	Description string    `hcl:"description,optional"`
+
+	// DefRange is where the variable is declared, for diagnostics
+	DefRange hcl.Range
+}
+
+type Locals struct {
+	Config hcl.Body `hcl:",remain"`
+}
+
+// header is everything that has to be known before backends and policies
+// can be decoded.
+type header struct {
+	Variables []Variable `hcl:"variable,block"`
+	Locals    []Locals   `hcl:"locals,block"`
+	Remain    hcl.Body   `hcl:",remain"`
+}
+
+var (
+	includeSchema = &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{{Name: "include"}},
+	}
+	variableSchema = &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+	}
+)
+
+// Load reads a config file or a directory of *.be and *.be.json files,
+// following include attributes. Files are merged together, variables are
+// taken from vars, then from the environment, then from their defaults.
+// file() in expressions reads paths relative to the config's directory.
+func Load(parser *hclparse.Parser, path string, vars map[string]string) (*Config, hcl.Diagnostics) {
+	bodies, diags := loadPath(parser, path, make(map[string]bool))
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	var h header
+	merged := hcl.MergeBodies(bodies)
+	diags = gohcl.DecodeBody(merged, nil, &h)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	// gohcl doesn't keep ranges, blocks come in the same order
+	content, _, _ := merged.PartialContent(variableSchema)
+	for i, block := range content.Blocks {
+		if i < len(h.Variables) && h.Variables[i].Name == block.Labels[0] {
+			h.Variables[i].DefRange = block.DefRange
+		}
+	}
+
+	varVal, diags := evalVariables(h.Variables, vars)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	baseDir := path
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		baseDir = filepath.Dir(path)
+	}
+
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var": varVal,
+		},
+		Functions: functions.Library(baseDir),
+	}
+
+	localVal, diags := evalLocals(h.Locals, ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	ctx.Variables["local"] = localVal
+
+	c := &Config{EvalContext: ctx}
+	diags = gohcl.DecodeBody(h.Remain, ctx, c)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return c, nil
+}
+
+func loadPath(parser *hclparse.Parser, path string, seen map[string]bool) ([]hcl.Body, hcl.Diagnostics) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Can't read config",
+			Detail:   err.Error(),
+		}}
+	}
+
+	files := []string{path}
+	if fi.IsDir() {
+		files, err = configFiles(path)
+		if err != nil {
+			return nil, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Can't read config directory",
+				Detail:   err.Error(),
+			}}
+		}
+	}
+
+	var bodies []hcl.Body
+	var diags hcl.Diagnostics
+	for _, fn := range files {
+		bs, moreDiags := loadFile(parser, fn, seen)
+		diags = append(diags, moreDiags...)
+		bodies = append(bodies, bs...)
+	}
+	return bodies, diags
+}
+
+func configFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.be", "*.be.json"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func loadFile(parser *hclparse.Parser, fn string, seen map[string]bool) ([]hcl.Body, hcl.Diagnostics) {
+	fn = filepath.Clean(fn)
+	if seen[fn] {
+		return nil, nil
+	}
+	seen[fn] = true
+
+	var file *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(fn, ".json") {
+		file, diags = parser.ParseJSONFile(fn)
+	} else {
+		file, diags = parser.ParseHCLFile(fn)
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	content, remain, diags := file.Body.PartialContent(includeSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	bodies := []hcl.Body{remain}
+	attr, ok := content.Attributes["include"]
+	if !ok {
+		return bodies, nil
+	}
+
+	var patterns []string
+	diags = gohcl.DecodeExpression(attr.Expr, nil, &patterns)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(fn), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			return nil, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Bad include",
+				Detail:   "No files match " + pattern,
+				Subject:  attr.Expr.Range().Ptr(),
+			}}
+		}
+
+		for _, match := range matches {
+			bs, moreDiags := loadPath(parser, match, seen)
+			diags = append(diags, moreDiags...)
+			bodies = append(bodies, bs...)
+		}
+	}
+	return bodies, diags
+}
+
+func evalVariables(vs []Variable, overrides map[string]string) (cty.Value, hcl.Diagnostics) {
+	vals := make(map[string]cty.Value)
+	declared := make(map[string]bool)
+	for _, v := range vs {
+		declared[v.Name] = true
+
+		source := "-var " + v.Name
+		raw, ok := overrides[v.Name]
+		if !ok {
+			source = VarEnvPrefix + v.Name
+			raw, ok = os.LookupEnv(source)
+		}
+		if !ok {
+			if v.Default.IsNull() {
+				return cty.NilVal, hcl.Diagnostics{{
+					Severity: hcl.DiagError,
+					Summary:  "Variable not set",
+					Detail:   "Variable " + v.Name + " has no default and isn't set with -var or " + VarEnvPrefix + v.Name,
+					Subject:  v.DefRange.Ptr(),
+				}}
+			}
+			vals[v.Name] = v.Default
+			continue
+		}
+
+		val := cty.StringVal(raw)
+		if !v.Default.IsNull() && v.Default.Type().IsPrimitiveType() {
+			var err error
+			val, err = convert.Convert(val, v.Default.Type())
+			if err != nil {
+				return cty.NilVal, hcl.Diagnostics{{
+					Severity: hcl.DiagError,
+					Summary:  "Bad variable value",
+					Detail:   "Variable " + v.Name + " from " + source + ": " + err.Error(),
+					Subject:  v.DefRange.Ptr(),
+				}}
+			}
+		}
+		vals[v.Name] = val
+	}
+
+	for name := range overrides {
+		if !declared[name] {
+			// Flags have no source to show, the range names the flag
+			return cty.NilVal, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Undeclared variable",
+				Detail:   "Variable " + name + " is set, but not declared",
+				Subject: &hcl.Range{
+					Filename: "-var " + name,
+					Start:    hcl.Pos{Line: 1, Column: 1},
+					End:      hcl.Pos{Line: 1, Column: 1},
+				},
+			}}
+		}
+	}
+
+	return cty.ObjectVal(vals), nil
+}
+
+// evalLocals evaluates locals in the order of their dependencies: every
+// pass evaluates the ones whose references are already known.
+func evalLocals(ls []Locals, ctx *hcl.EvalContext) (cty.Value, hcl.Diagnostics) {
+	pending := make(map[string]*hcl.Attribute)
+	for _, l := range ls {
+		attrs, diags := l.Config.JustAttributes()
+		if diags.HasErrors() {
+			return cty.NilVal, diags
+		}
+
+		for name, attr := range attrs {
+			if _, ok := pending[name]; ok {
+				return cty.NilVal, hcl.Diagnostics{{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate local",
+					Detail:   "Local " + name + " is defined more than once",
+					Subject:  attr.NameRange.Ptr(),
+				}}
+			}
+			pending[name] = attr
+		}
+	}
+
+	vals := make(map[string]cty.Value)
+	for len(pending) > 0 {
+		progress := false
+		for name, attr := range pending {
+			if !localsReady(attr.Expr, vals) {
+				continue
+			}
+
+			ctx.Variables["local"] = cty.ObjectVal(vals)
+			val, diags := attr.Expr.Value(ctx)
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+
+			vals[name] = val
+			delete(pending, name)
+			progress = true
+		}
+
+		if !progress {
+			var diags hcl.Diagnostics
+			for name, attr := range pending {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unresolvable local",
+					Detail:   "Local " + name + " refers to unknown or cyclic locals",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+			return cty.NilVal, diags
+		}
+	}
+
+	return cty.ObjectVal(vals), nil
+}
+
+func localsReady(expr hcl.Expression, vals map[string]cty.Value) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+
+		attr, ok := traversal[1].(hcl.TraverseAttr)
+		if !ok {
+			continue
+		}
+		if _, ok := vals[attr.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
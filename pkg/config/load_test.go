@@ -0,0 +1,273 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+)
+
+// configDir writes files, by path relative to a new directory.
+func configDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "berny-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func policyNames(c *Config) []string {
+	var names []string
+	for _, p := range c.Policies {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLoadDirectory(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"backends.be": `
+backend x509 "ca" {
+  type = "file"
+}
+`,
+		"web.be": `
+policy "web" {}
+`,
+		"db.be.json": `{"policy": {"db": {}}}`,
+		"notes.txt":  `policy "ignored" {}`,
+		"sub/nested.be": `
+policy "nested" {}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	c, diags := Load(hclparse.NewParser(), dir, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if len(c.Backends) != 1 || c.Backends[0].Name != "ca" {
+		t.Errorf("unexpected backends %+v", c.Backends)
+	}
+	// Subdirectories are only read when included
+	if got := policyNames(c); len(got) != 2 || got[0] != "db" || got[1] != "web" {
+		t.Errorf("unexpected policies %v", got)
+	}
+}
+
+func TestLoadInclude(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"main.be": `
+include = ["conf.d/*.be", "other.be"]
+policy "main" {}
+`,
+		"conf.d/a.be": `
+policy "a" {}
+`,
+		"conf.d/b.be": `
+include = ["../main.be"]
+policy "b" {}
+`,
+		"other.be": `
+policy "other" {}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	// Files included twice are read once, includes can go in circles
+	c, diags := Load(hclparse.NewParser(), filepath.Join(dir, "main.be"), nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	want := []string{"a", "b", "main", "other"}
+	got := policyNames(c)
+	if len(got) != len(want) {
+		t.Fatalf("expected policies %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected policies %v, got %v", want, got)
+			break
+		}
+	}
+
+	missing := configDir(t, map[string]string{
+		"main.be": `include = ["nothing/*.be"]`,
+	})
+	defer os.RemoveAll(missing)
+	_, diags = Load(hclparse.NewParser(), filepath.Join(missing, "main.be"), nil)
+	if !diags.HasErrors() || diags[0].Summary != "Bad include" || diags[0].Subject == nil {
+		t.Errorf("expected a bad include, got %v", diags)
+	}
+}
+
+func TestLoadVariables(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"vars.be": `
+variable "cluster" {
+  default = "default"
+}
+variable "replicas" {
+  default = 1
+}
+locals {
+  name = "${var.cluster}-${var.replicas}"
+}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	defer os.Unsetenv(VarEnvPrefix + "cluster")
+	for _, c := range []struct {
+		env  string
+		vars map[string]string
+		want string
+	}{
+		{"", nil, "default-1"},
+		{"env", nil, "env-1"},
+		{"env", map[string]string{"cluster": "flag"}, "flag-1"},
+		{"", map[string]string{"cluster": "flag", "replicas": "3"}, "flag-3"},
+	} {
+		os.Unsetenv(VarEnvPrefix + "cluster")
+		if len(c.env) > 0 {
+			os.Setenv(VarEnvPrefix+"cluster", c.env)
+		}
+
+		conf, diags := Load(hclparse.NewParser(), dir, c.vars)
+		if diags.HasErrors() {
+			t.Errorf("%s %v: %v", c.env, c.vars, diags)
+			continue
+		}
+		got := conf.EvalContext.Variables["local"].GetAttr("name").AsString()
+		if got != c.want {
+			t.Errorf("%s %v: expected %q, got %q", c.env, c.vars, c.want, got)
+		}
+	}
+}
+
+func TestLoadVariableErrors(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"vars.be": `
+variable "cluster" {}
+variable "replicas" {
+  default = 1
+}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		vars     map[string]string
+		summary  string
+		filename string
+		line     int
+	}{
+		{nil, "Variable not set", "vars.be", 2},
+		{map[string]string{"cluster": "a", "replicas": "many"}, "Bad variable value", "vars.be", 3},
+		{map[string]string{"cluster": "a", "zone": "b"}, "Undeclared variable", "-var zone", 1},
+	} {
+		_, diags := Load(hclparse.NewParser(), dir, c.vars)
+		if !diags.HasErrors() {
+			t.Errorf("%v: expected an error", c.vars)
+			continue
+		}
+		d := diags[0]
+		if d.Summary != c.summary {
+			t.Errorf("%v: expected %q, got %q", c.vars, c.summary, d.Summary)
+		}
+		// Diagnostics point at the variable block, or at the flag
+		if d.Subject == nil || filepath.Base(d.Subject.Filename) != c.filename || d.Subject.Start.Line != c.line {
+			t.Errorf("%v: %s points at %v", c.vars, d.Summary, d.Subject)
+		}
+	}
+}
+
+func TestLoadLocals(t *testing.T) {
+	dir := configDir(t, map[string]string{
+		"a.be": `
+locals {
+  fqdn = "${local.host}.${local.domain}"
+}
+`,
+		"b.be": `
+locals {
+  host   = "web-${local.id}"
+  id     = 1
+  domain = "example.com"
+}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	c, diags := Load(hclparse.NewParser(), dir, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if got := c.EvalContext.Variables["local"].GetAttr("fqdn").AsString(); got != "web-1.example.com" {
+		t.Errorf("unexpected fqdn %q", got)
+	}
+}
+
+func TestLoadLocalErrors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		src     string
+		summary string
+		n       int
+	}{
+		{"cycle", `
+locals {
+  a = local.b
+  b = "${local.c}!"
+  c = local.a
+  d = "fine"
+}
+`, "Unresolvable local", 3},
+		{"self", `
+locals {
+  a = local.a
+}
+`, "Unresolvable local", 1},
+		{"unknown", `
+locals {
+  a = local.nope
+}
+`, "Unresolvable local", 1},
+		{"duplicate", `
+locals {
+  a = 1
+}
+locals {
+  a = 2
+}
+`, "Duplicate local", 1},
+	} {
+		dir := configDir(t, map[string]string{"locals.be": c.src})
+		_, diags := Load(hclparse.NewParser(), dir, nil)
+		os.RemoveAll(dir)
+
+		if len(diags) != c.n {
+			t.Errorf("%s: expected %d diagnostic(s), got %v", c.name, c.n, diags)
+			continue
+		}
+		for _, d := range diags {
+			if d.Severity != hcl.DiagError || d.Summary != c.summary || d.Subject == nil {
+				t.Errorf("%s: unexpected diagnostic %s: %s", c.name, d.Summary, d.Detail)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package functions is the library of functions available in config
+// expressions: producers' and probes' attributes, and locals.
+package functions
+
+import (
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// Library returns all functions, relative paths given to file() are
+// resolved against baseDir.
+func Library(baseDir string) map[string]function.Function {
+	return map[string]function.Function{
+		// Strings
+		"chomp":        stdlib.ChompFunc,
+		"format":       stdlib.FormatFunc,
+		"formatlist":   stdlib.FormatListFunc,
+		"indent":       stdlib.IndentFunc,
+		"join":         stdlib.JoinFunc,
+		"lower":        stdlib.LowerFunc,
+		"regex":        stdlib.RegexFunc,
+		"regexall":     stdlib.RegexAllFunc,
+		"regexreplace": stdlib.RegexReplaceFunc,
+		"replace":      stdlib.ReplaceFunc,
+		"split":        stdlib.SplitFunc,
+		"strlen":       stdlib.StrlenFunc,
+		"substr":       stdlib.SubstrFunc,
+		"title":        stdlib.TitleFunc,
+		"trim":         stdlib.TrimFunc,
+		"trimprefix":   stdlib.TrimPrefixFunc,
+		"trimspace":    stdlib.TrimSpaceFunc,
+		"trimsuffix":   stdlib.TrimSuffixFunc,
+		"upper":        stdlib.UpperFunc,
+		"hostname":     HostnameFunc,
+		"domain":       DomainFunc,
+
+		// Collections
+		"coalesce":     stdlib.CoalesceFunc,
+		"coalescelist": stdlib.CoalesceListFunc,
+		"compact":      stdlib.CompactFunc,
+		"concat":       stdlib.ConcatFunc,
+		"contains":     stdlib.ContainsFunc,
+		"distinct":     stdlib.DistinctFunc,
+		"element":      stdlib.ElementFunc,
+		"flatten":      stdlib.FlattenFunc,
+		"keys":         stdlib.KeysFunc,
+		"length":       stdlib.LengthFunc,
+		"lookup":       stdlib.LookupFunc,
+		"merge":        stdlib.MergeFunc,
+		"range":        stdlib.RangeFunc,
+		"reverse":      stdlib.ReverseListFunc,
+		"slice":        stdlib.SliceFunc,
+		"sort":         stdlib.SortFunc,
+		"values":       stdlib.ValuesFunc,
+		"zipmap":       stdlib.ZipmapFunc,
+
+		// Numbers
+		"abs":      stdlib.AbsoluteFunc,
+		"ceil":     stdlib.CeilFunc,
+		"floor":    stdlib.FloorFunc,
+		"max":      stdlib.MaxFunc,
+		"min":      stdlib.MinFunc,
+		"parseint": stdlib.ParseIntFunc,
+
+		// Encoding
+		"csvdecode":  stdlib.CSVDecodeFunc,
+		"jsondecode": stdlib.JSONDecodeFunc,
+		"jsonencode": stdlib.JSONEncodeFunc,
+
+		// Network
+		"cidrcontains": CIDRContainsFunc,
+		"cidrhost":     CIDRHostFunc,
+		"cidrnetmask":  CIDRNetmaskFunc,
+
+		// Environment
+		"env":  EnvFunc,
+		"file": MakeFileFunc(baseDir),
+	}
+}
+
+// HostnameFunc returns the first label of a domain name.
+var HostnameFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "fqdn", Type: cty.String},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		labels := strings.SplitN(args[0].AsString(), ".", 2)
+		return cty.StringVal(labels[0]), nil
+	},
+})
+
+// DomainFunc returns everything but the first label of a domain name.
+var DomainFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "fqdn", Type: cty.String},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		labels := strings.SplitN(args[0].AsString(), ".", 2)
+		if len(labels) < 2 {
+			return cty.StringVal(""), nil
+		}
+		return cty.StringVal(labels[1]), nil
+	},
+})
+
+// CIDRContainsFunc tells whether an IP address belongs to a network.
+var CIDRContainsFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "prefix", Type: cty.String},
+		{Name: "ip", Type: cty.String},
+	},
+	Type: function.StaticReturnType(cty.Bool),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		_, network, err := net.ParseCIDR(args[0].AsString())
+		if err != nil {
+			return cty.UnknownVal(cty.Bool), function.NewArgError(0, err)
+		}
+
+		ip := net.ParseIP(args[1].AsString())
+		if ip == nil {
+			return cty.UnknownVal(cty.Bool), function.NewArgErrorf(1, "invalid IP address %q", args[1].AsString())
+		}
+		return cty.BoolVal(network.Contains(ip)), nil
+	},
+})
+
+// CIDRHostFunc returns the host with a given number within a network,
+// negative numbers count from the end.
+var CIDRHostFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "prefix", Type: cty.String},
+		{Name: "hostnum", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		_, network, err := net.ParseCIDR(args[0].AsString())
+		if err != nil {
+			return cty.UnknownVal(cty.String), function.NewArgError(0, err)
+		}
+
+		var hostNum int64
+		if err := gocty.FromCtyValue(args[1], &hostNum); err != nil {
+			return cty.UnknownVal(cty.String), function.NewArgError(1, err)
+		}
+
+		ones, bits := network.Mask.Size()
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		num := big.NewInt(hostNum)
+		if num.Sign() < 0 {
+			num.Add(num, size)
+		}
+		if num.Sign() < 0 || num.Cmp(size) >= 0 {
+			return cty.UnknownVal(cty.String), function.NewArgErrorf(1, "prefix %s has no host %d", network, hostNum)
+		}
+
+		ip := new(big.Int).SetBytes(network.IP)
+		ip.Add(ip, num)
+		return cty.StringVal(bigToIP(ip, len(network.IP)).String()), nil
+	},
+})
+
+// CIDRNetmaskFunc returns the dotted netmask of an IPv4 network.
+var CIDRNetmaskFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "prefix", Type: cty.String},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		_, network, err := net.ParseCIDR(args[0].AsString())
+		if err != nil {
+			return cty.UnknownVal(cty.String), function.NewArgError(0, err)
+		}
+		if len(network.Mask) != net.IPv4len {
+			return cty.UnknownVal(cty.String), function.NewArgErrorf(0, "%s is not an IPv4 network", network)
+		}
+		return cty.StringVal(net.IP(network.Mask).String()), nil
+	},
+})
+
+// EnvFunc returns a bernyd's environment variable, or an empty string if
+// it isn't set.
+var EnvFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "name", Type: cty.String},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.StringVal(os.Getenv(args[0].AsString())), nil
+	},
+})
+
+// MakeFileFunc returns a function that reads a file as a string.
+func MakeFileFunc(baseDir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			fn := args[0].AsString()
+			if !filepath.IsAbs(fn) {
+				fn = filepath.Join(baseDir, fn)
+			}
+
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return cty.UnknownVal(cty.String), function.NewArgError(0, err)
+			}
+			return cty.StringVal(string(b)), nil
+		},
+	})
+}
+
+func bigToIP(n *big.Int, size int) net.IP {
+	b := n.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	if size == net.IPv4len {
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+	}
+	return ip
+}
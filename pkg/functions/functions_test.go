@@ -0,0 +1,190 @@
+package functions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+	"github.com/hashicorp/hcl2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/config"
+	"github.com/alvelcom/berny/pkg/functions"
+)
+
+// evalExpr loads a config and evaluates expr the way bernyd evaluates
+// producer attributes: in a child of the config's context with req set.
+func evalExpr(t *testing.T, dir, expr string) (cty.Value, error) {
+	t.Helper()
+
+	fn := filepath.Join(dir, "policy.be")
+	if err := ioutil.WriteFile(fn, []byte("policy \"p\" {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, diags := config.Load(hclparse.NewParser(), fn, nil)
+	if diags.HasErrors() {
+		t.Fatalf("%s: %s", expr, diags)
+	}
+
+	ctx := c.EvalContext.NewChild()
+	ctx.Variables = map[string]cty.Value{
+		"req": cty.ObjectVal(map[string]cty.Value{
+			"fqdn":       cty.StringVal("Web-1.Prod.Example.com"),
+			"ips":        cty.ListVal([]cty.Value{cty.StringVal("10.1.2.3"), cty.StringVal("192.168.0.7")}),
+			"request_ip": cty.StringVal("10.1.2.3"),
+		}),
+	}
+
+	e, diags := hclsyntax.ParseExpression([]byte(expr), "expr", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatalf("%s: %s", expr, diags)
+	}
+	val, diags := e.Value(ctx)
+	if diags.HasErrors() {
+		return val, diags
+	}
+	return val, nil
+}
+
+func TestFunctionsInPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-functions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BERNY_TEST_REGION", "eu-west-1")
+	defer os.Unsetenv("BERNY_TEST_REGION")
+
+	for _, test := range functionTests {
+		got, err := evalExpr(t, dir, test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if !got.RawEquals(test.want) {
+			t.Errorf("%s = %#v, want %#v", test.expr, got, test.want)
+		}
+	}
+}
+
+// TestAllFunctionsTested makes sure functionTests call every function of
+// the library at least once.
+func TestAllFunctionsTested(t *testing.T) {
+	for name := range functions.Library("") {
+		call := regexp.MustCompile(`\b` + name + `\(`)
+		var tested bool
+		for _, test := range functionTests {
+			if call.MatchString(test.expr) {
+				tested = true
+				break
+			}
+		}
+		if !tested {
+			t.Errorf("function %s isn't tested", name)
+		}
+	}
+}
+
+var functionTests = []struct {
+	expr string
+	want cty.Value
+}{
+	// Strings
+	{`chomp("line\n")`, cty.StringVal("line")},
+	{`format("%s/%s", hostname(lower(req.fqdn)), "etcd")`, cty.StringVal("web-1/etcd")},
+	{`formatlist("%s:2379", req.ips)`, cty.ListVal([]cty.Value{cty.StringVal("10.1.2.3:2379"), cty.StringVal("192.168.0.7:2379")})},
+	{`indent(2, "a\nb")`, cty.StringVal("a\n  b")},
+	{`join(",", req.ips)`, cty.StringVal("10.1.2.3,192.168.0.7")},
+	{`lower(req.fqdn)`, cty.StringVal("web-1.prod.example.com")},
+	{`regex("^([a-z]+)-([0-9]+)", lower(req.fqdn))[1]`, cty.StringVal("1")},
+	{`length(regexall("[0-9]", "a1b2c3"))`, cty.NumberIntVal(3)},
+	{`regexreplace(lower(req.fqdn), "-[0-9]+", "")`, cty.StringVal("web.prod.example.com")},
+	{`replace("a-b-c", "-", "_")`, cty.StringVal("a_b_c")},
+	{`split(".", lower(req.fqdn))[1]`, cty.StringVal("prod")},
+	{`strlen("abc")`, cty.NumberIntVal(3)},
+	{`substr("example", 0, 3)`, cty.StringVal("exa")},
+	{`title("web server")`, cty.StringVal("Web Server")},
+	{`trim("--x--", "-")`, cty.StringVal("x")},
+	{`trimprefix("web-1", "web-")`, cty.StringVal("1")},
+	{`trimspace("  x  ")`, cty.StringVal("x")},
+	{`trimsuffix("node.example.com", ".com")`, cty.StringVal("node.example")},
+	{`upper("abc")`, cty.StringVal("ABC")},
+	{`hostname("node.example.com")`, cty.StringVal("node")},
+	{`domain("node.example.com")`, cty.StringVal("example.com")},
+	{`domain("localhost")`, cty.StringVal("")},
+
+	// Collections
+	{`coalesce(null, "b")`, cty.StringVal("b")},
+	{`coalescelist([], ["b"])`, cty.TupleVal([]cty.Value{cty.StringVal("b")})},
+	{`compact(["a", "", "b"])`, cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})},
+	{`concat(["a"], ["b"])`, cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})},
+	{`distinct(["a", "b", "a"])`, cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})},
+	{`element(req.ips, 3)`, cty.StringVal("192.168.0.7")},
+	{`flatten([["a"], ["b", "c"]])`, cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b"), cty.StringVal("c")})},
+	{`keys({b = 1, a = 2})`, cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})},
+	{`length(req.ips)`, cty.NumberIntVal(2)},
+	{`lookup({a = "x"}, "b", "y")`, cty.StringVal("y")},
+	{`merge({a = 1}, {b = 2})`, cty.ObjectVal(map[string]cty.Value{"a": cty.NumberIntVal(1), "b": cty.NumberIntVal(2)})},
+	{`range(3)`, cty.ListVal([]cty.Value{cty.NumberIntVal(0), cty.NumberIntVal(1), cty.NumberIntVal(2)})},
+	{`reverse(req.ips)`, cty.ListVal([]cty.Value{cty.StringVal("192.168.0.7"), cty.StringVal("10.1.2.3")})},
+	{`slice(["a", "b", "c"], 1, 2)`, cty.TupleVal([]cty.Value{cty.StringVal("b")})},
+	{`sort(["b", "a"])`, cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})},
+	{`values({b = 1, a = 2})`, cty.TupleVal([]cty.Value{cty.NumberIntVal(2), cty.NumberIntVal(1)})},
+	{`zipmap(["a"], [1])`, cty.ObjectVal(map[string]cty.Value{"a": cty.NumberIntVal(1)})},
+	{`contains(req.ips, "192.168.0.7")`, cty.True},
+
+	// Numbers
+	{`abs(-3)`, cty.NumberIntVal(3)},
+	{`ceil(1.2)`, cty.NumberIntVal(2)},
+	{`floor(1.8)`, cty.NumberIntVal(1)},
+	{`max(1, 3, 2)`, cty.NumberIntVal(3)},
+	{`min(1, 3, 2)`, cty.NumberIntVal(1)},
+	{`parseint("ff", 16)`, cty.NumberIntVal(255)},
+
+	// Encoding
+	{`csvdecode("a,b\n1,2\n")[0].b`, cty.StringVal("2")},
+	{`jsondecode("{\"a\": \"b\"}").a`, cty.StringVal("b")},
+	{`jsonencode({a = 1})`, cty.StringVal(`{"a":1}`)},
+
+	// Network
+	{`cidrcontains("10.0.0.0/8", req.request_ip)`, cty.True},
+	{`cidrcontains("10.0.0.0/8", req.ips[1])`, cty.False},
+	{`cidrcontains("fd00::/8", "fd00::1")`, cty.True},
+	{`cidrhost("10.1.0.0/16", 5)`, cty.StringVal("10.1.0.5")},
+	{`cidrhost("10.1.0.0/16", -2)`, cty.StringVal("10.1.255.254")},
+	{`cidrnetmask("10.1.0.0/16")`, cty.StringVal("255.255.0.0")},
+
+	// Environment
+	{`env("BERNY_TEST_REGION")`, cty.StringVal("eu-west-1")},
+	{`env("BERNY_TEST_UNSET")`, cty.StringVal("")},
+	{`chomp(file("token"))`, cty.StringVal("s3cret")},
+}
+
+func TestFunctionErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-functions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, expr := range []string{
+		`cidrcontains("10.0.0.0", "10.0.0.1")`,
+		`cidrcontains("10.0.0.0/8", "nope")`,
+		`cidrhost("10.0.0.0/30", 4)`,
+		`cidrnetmask("fd00::/8")`,
+		`file("missing")`,
+	} {
+		if _, err := evalExpr(t, dir, expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	certificatesFile = "certificates.jsonl"
+	harvestsFile     = "harvests.jsonl"
+	revocationsFile  = "revocations.jsonl"
+)
+
+// File keeps the inventory in a directory of append-only JSON lines
+// files. Any number of readers can share it with a single writer.
+type File struct {
+	dir string
+
+	mu           sync.Mutex
+	certificates *os.File
+	harvests     *os.File
+	revocations  *os.File
+}
+
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f := &File{dir: dir}
+
+	var err error
+	f.certificates, err = openLog(filepath.Join(dir, certificatesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	f.harvests, err = openLog(filepath.Join(dir, harvestsFile))
+	if err != nil {
+		f.certificates.Close()
+		return nil, err
+	}
+
+	f.revocations, err = openLog(filepath.Join(dir, revocationsFile))
+	if err != nil {
+		f.certificates.Close()
+		f.harvests.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func openLog(fn string) (*os.File, error) {
+	return os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+func (f *File) AddCertificate(c Certificate) error {
+	return f.append(f.certificates, c)
+}
+
+func (f *File) AddHarvest(h Harvest) error {
+	return f.append(f.harvests, h)
+}
+
+func (f *File) AddRevocation(r Revocation) error {
+	return f.append(f.revocations, r)
+}
+
+// append writes a record with a single write, so readers never see half
+// of it unless the disk is full.
+func (f *File) append(fd *os.File, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = fd.Write(line)
+	return err
+}
+
+func (f *File) Certificates(q Query) ([]Certificate, error) {
+	var certs []Certificate
+	err := readLog(filepath.Join(f.dir, certificatesFile), func(line []byte) error {
+		var c Certificate
+		if err := json.Unmarshal(line, &c); err != nil {
+			return err
+		}
+		if q.Match(c) {
+			certs = append(certs, c)
+		}
+		return nil
+	})
+	return certs, err
+}
+
+func (f *File) Machines() ([]Harvest, error) {
+	return lastHarvests(filepath.Join(f.dir, harvestsFile))
+}
+
+func (f *File) Revocations() ([]Revocation, error) {
+	var rs []Revocation
+	err := readLog(filepath.Join(f.dir, revocationsFile), func(line []byte) error {
+		var r Revocation
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		rs = append(rs, r)
+		return nil
+	})
+	return rs, err
+}
+
+func (f *File) Close() error {
+	err := f.certificates.Close()
+	for _, fd := range []*os.File{f.harvests, f.revocations} {
+		if err2 := fd.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Compact cuts torn records off the ends of logs and rewrites the harvest
+// log keeping the last harvest of every machine. Only the writer may call
+// it, before it adds anything.
+func (f *File) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, name := range []string{certificatesFile, revocationsFile} {
+		if err := truncateTail(filepath.Join(f.dir, name)); err != nil {
+			return err
+		}
+	}
+
+	fn := filepath.Join(f.dir, harvestsFile)
+	hs, err := lastHarvests(fn)
+	if err != nil {
+		return err
+	}
+
+	tmp := fn + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(fd)
+	for _, h := range hs {
+		if err = enc.Encode(h); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return err
+	}
+
+	// The old log is gone, append to the new one
+	fd, err = openLog(fn)
+	if err != nil {
+		return err
+	}
+	f.harvests.Close()
+	f.harvests = fd
+	return nil
+}
+
+func lastHarvests(fn string) ([]Harvest, error) {
+	var hs []Harvest
+	index := make(map[string]int)
+	err := readLog(fn, func(line []byte) error {
+		var h Harvest
+		if err := json.Unmarshal(line, &h); err != nil {
+			return err
+		}
+
+		key := machineKey(h.Machine)
+		if i, ok := index[key]; ok {
+			hs[i] = h
+			return nil
+		}
+		index[key] = len(hs)
+		hs = append(hs, h)
+		return nil
+	})
+	return hs, err
+}
+
+// readLog calls next for every record of the log. A missing log is an
+// empty one. Records torn by a crash are skipped: the last one has no line
+// end yet and ones in the middle don't decode.
+func readLog(fn string, next func(line []byte) error) error {
+	fd, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = next(line)
+		switch err.(type) {
+		case nil, *json.SyntaxError, *json.UnmarshalTypeError:
+		default:
+			return err
+		}
+	}
+}
+
+// truncateTail cuts a record a crash left incomplete off the end of a log,
+// so the next one starts on a line of its own.
+func truncateTail(fn string) error {
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	end := size
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := fd.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end += int64(i) + 1 - n
+			break
+		}
+		end -= n
+	}
+
+	if end == size {
+		return nil
+	}
+	return fd.Truncate(end)
+}
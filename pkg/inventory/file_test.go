@@ -0,0 +1,243 @@
+package inventory
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+func tempFile(t *testing.T) (*File, string) {
+	dir, err := ioutil.TempDir("", "berny-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return f, dir
+}
+
+func TestFileCertificates(t *testing.T) {
+	f, dir := tempFile(t)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+
+	// Round to what survives JSON
+	now := time.Now().UTC().Truncate(time.Second)
+	certs := []Certificate{
+		{Kind: "x509", Serial: "1a", Subject: "CN=web-1", NotAfter: now.Add(time.Hour), Policy: "web",
+			Machine: api.MachineInfo{FQDN: "web-1.example.com"}},
+		{Kind: "x509", Serial: "2b", Subject: "CN=db-1", NotAfter: now.Add(90 * 24 * time.Hour), Policy: "db",
+			Machine: api.MachineInfo{FQDN: "db-1.example.com"}},
+		{Kind: "ssh", Serial: "3c", Subject: "web-1", Policy: "web",
+			Machine: api.MachineInfo{FQDN: "web-1.example.com"}},
+	}
+	for _, c := range certs {
+		if err := f.AddCertificate(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := f.Certificates(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, certs) {
+		t.Errorf("certificates don't round trip: %+v", all)
+	}
+
+	web, err := f.Certificates(Query{Machine: "web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(web) != 2 || web[0].Serial != "1a" || web[1].Serial != "3c" {
+		t.Errorf("unexpected certificates of web-1: %+v", web)
+	}
+
+	expiring, err := f.Certificates(Query{ExpiresBefore: now.Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiring) != 1 || expiring[0].Serial != "1a" {
+		t.Errorf("unexpected expiring certificates: %+v", expiring)
+	}
+
+	bySerial, err := f.Certificates(Query{Serial: "2B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bySerial) != 1 || bySerial[0].Serial != "2b" {
+		t.Errorf("unexpected certificates by serial: %+v", bySerial)
+	}
+}
+
+func TestFileRevocations(t *testing.T) {
+	f, dir := tempFile(t)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+
+	if rs, err := f.Revocations(); err != nil || len(rs) != 0 {
+		t.Fatalf("expected no revocations, got %+v, %v", rs, err)
+	}
+
+	r := Revocation{Serial: "1a", Issuer: "CN=CA", RevokedAt: time.Now().UTC().Truncate(time.Second), Reason: 1}
+	if err := f.AddRevocation(r); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := f.Revocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rs, []Revocation{r}) {
+		t.Errorf("revocations don't round trip: %+v", rs)
+	}
+}
+
+func TestFileCompact(t *testing.T) {
+	f, dir := tempFile(t)
+	defer os.RemoveAll(dir)
+
+	at := time.Now().UTC().Truncate(time.Second)
+	harvests := []Harvest{
+		{At: at, Machine: api.MachineInfo{FQDN: "web-1.example.com"}, Products: 1},
+		{At: at, Machine: api.MachineInfo{FQDN: "db-1.example.com"}, Products: 2},
+		{At: at.Add(time.Minute), Machine: api.MachineInfo{FQDN: "web-1.example.com"}, Error: "boom"},
+		{At: at.Add(time.Minute), Machine: api.MachineInfo{Id: "i-123"}, Products: 3},
+	}
+	for _, h := range harvests {
+		if err := f.AddHarvest(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last harvest of every machine, in order machines first showed up
+	expected := []Harvest{harvests[2], harvests[1], harvests[3]}
+	ms, err := f.Machines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ms, expected) {
+		t.Errorf("unexpected machines: %+v", ms)
+	}
+	f.Close()
+
+	// A writer compacts when it starts, then appends to the new log
+	f, err = NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	later := Harvest{At: at.Add(time.Hour), Machine: api.MachineInfo{FQDN: "db-1.example.com"}}
+	if err := f.AddHarvest(later); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err = f.Machines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ms, []Harvest{harvests[2], later, harvests[3]}) {
+		t.Errorf("unexpected machines after compaction: %+v", ms)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, harvestsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 4 {
+		t.Errorf("expected 4 records after compaction, got %d", lines)
+	}
+}
+
+func TestFileTruncatedRecord(t *testing.T) {
+	f, dir := tempFile(t)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+
+	c := Certificate{Kind: "x509", Serial: "1a", Subject: "CN=web-1"}
+	if err := f.AddCertificate(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of a write
+	fd, err := os.OpenFile(filepath.Join(dir, certificatesFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte(`{"kind":"x509","serial":"2`))
+	fd.Close()
+
+	certs, err := f.Certificates(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Serial != "1a" {
+		t.Errorf("unexpected certificates: %+v", certs)
+	}
+}
+
+func TestFileTornRecordThenMore(t *testing.T) {
+	f, dir := tempFile(t)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, certificatesFile)
+	tear := func() {
+		fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.Write([]byte(`{"kind":"x509","serial":"2`))
+		fd.Close()
+	}
+	serials := func(f *File) []string {
+		certs, err := f.Certificates(Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ss []string
+		for _, c := range certs {
+			ss = append(ss, c.Serial)
+		}
+		return ss
+	}
+
+	// A server crashed mid-write and restarted without compacting, the
+	// record right after the torn one shares its line
+	f.AddCertificate(Certificate{Kind: "x509", Serial: "1"})
+	tear()
+	f.AddCertificate(Certificate{Kind: "x509", Serial: "3"})
+	if ss := serials(f); !reflect.DeepEqual(ss, []string{"1"}) {
+		t.Errorf("unexpected serials %v", ss)
+	}
+	f.AddCertificate(Certificate{Kind: "x509", Serial: "4"})
+	if ss := serials(f); !reflect.DeepEqual(ss, []string{"1", "4"}) {
+		t.Errorf("records after a torn one are lost: %v", ss)
+	}
+	f.Close()
+
+	// Compacting on start cuts the torn record off
+	tear()
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	f.AddCertificate(Certificate{Kind: "x509", Serial: "5"})
+	if ss := serials(f); !reflect.DeepEqual(ss, []string{"1", "4", "5"}) {
+		t.Errorf("unexpected serials after compacting %v", ss)
+	}
+}
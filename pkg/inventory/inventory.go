@@ -0,0 +1,133 @@
+// Package inventory keeps a record of what bernyd issued and to whom, for
+// audits and incident response. Producers stay stateless, the inventory is
+// only ever written to while harvesting.
+package inventory
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+var ErrBadStoreType = errors.New("inventory: bad store type")
+
+// Certificate is an issued x509 or SSH certificate.
+type Certificate struct {
+	Kind     string    `json:"kind"` // x509 or ssh
+	Serial   string    `json:"serial"`
+	Issuer   string    `json:"issuer,omitempty"`
+	Subject  string    `json:"subject"`
+	SANs     []string  `json:"sans,omitempty"`
+	NotAfter time.Time `json:"not_after"` // zero if it never expires
+	IssuedAt time.Time `json:"issued_at"`
+
+	Policy    string          `json:"policy"`
+	Producer  string          `json:"producer"`
+	RequestIP string          `json:"request_ip"`
+	Machine   api.MachineInfo `json:"machine"`
+}
+
+// Harvest is a single harvest request of a machine.
+type Harvest struct {
+	At        time.Time       `json:"at"`
+	RequestIP string          `json:"request_ip"`
+	Machine   api.MachineInfo `json:"machine"`
+	Policies  []string        `json:"policies,omitempty"`
+	Tasks     int             `json:"tasks,omitempty"`
+	Products  int             `json:"products,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Revocation of a certificate, Issuer tells CRLs of which backend list it.
+type Revocation struct {
+	Serial    string    `json:"serial"`
+	Issuer    string    `json:"issuer,omitempty"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason"` // RFC 5280 CRLReason
+}
+
+// Revocation reasons bernyd uses itself
+const (
+	ReasonUnspecified          = 0
+	ReasonCessationOfOperation = 5
+)
+
+// Query selects certificates, empty fields match anything. Strings other
+// than Serial match substrings.
+type Query struct {
+	Serial        string
+	Subject       string
+	Machine       string // FQDN
+	Policy        string
+	ExpiresBefore time.Time
+}
+
+type Store interface {
+	AddCertificate(c Certificate) error
+	AddHarvest(h Harvest) error
+	AddRevocation(r Revocation) error
+
+	Certificates(q Query) ([]Certificate, error)
+	// Machines returns the last harvest of every machine
+	Machines() ([]Harvest, error)
+	Revocations() ([]Revocation, error)
+
+	Close() error
+}
+
+// Compacter is implemented by stores that need housekeeping when a
+// server starts.
+type Compacter interface {
+	Compact() error
+}
+
+// New opens a store of the given type, path is type specific.
+func New(type_, path string) (Store, error) {
+	switch type_ {
+	case "file":
+		return NewFile(path)
+	default:
+		return nil, ErrBadStoreType
+	}
+}
+
+func (q Query) Match(c Certificate) bool {
+	if len(q.Serial) > 0 && !SameSerial(q.Serial, c.Serial) {
+		return false
+	}
+	if !contains(c.Subject, q.Subject) || !contains(c.Machine.FQDN, q.Machine) ||
+		!contains(c.Policy, q.Policy) {
+		return false
+	}
+	// A zero NotAfter never expires, like SSH certificates valid forever
+	if !q.ExpiresBefore.IsZero() && (c.NotAfter.IsZero() || !c.NotAfter.Before(q.ExpiresBefore)) {
+		return false
+	}
+	return true
+}
+
+// normalizeSerial accepts serials the way openssl prints them: upper
+// case, zero padded, colon separated.
+func normalizeSerial(s string) string {
+	s = strings.ToLower(strings.Replace(s, ":", "", -1))
+	return strings.TrimLeft(s, "0")
+}
+
+// SameSerial compares serials regardless of how they are written.
+func SameSerial(a, b string) bool {
+	return normalizeSerial(a) == normalizeSerial(b)
+}
+
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// machineKey tells machines apart in Machines.
+func machineKey(mi api.MachineInfo) string {
+	if len(mi.FQDN) > 0 {
+		return mi.FQDN
+	}
+	return mi.Id
+}
@@ -0,0 +1,72 @@
+package inventory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+func TestSameSerial(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		same bool
+	}{
+		{"1a2b", "1a2b", true},
+		{"1a2b", "1A2B", true},
+		{"1a2b", "1A:2B", true},
+		{"01:a2:b3", "1a2b3", true},
+		{"00:00:ff", "ff", true},
+		{"1a2b", "1a2c", false},
+		{"1a2b", "1a2b0", false},
+		{"10", "1", false},
+	} {
+		if SameSerial(c.a, c.b) != c.same || SameSerial(c.b, c.a) != c.same {
+			t.Errorf("SameSerial(%q, %q) != %v", c.a, c.b, c.same)
+		}
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	now := time.Now()
+	c := Certificate{
+		Kind:     "x509",
+		Serial:   "1a2b",
+		Subject:  "CN=web-1.example.com",
+		NotAfter: now.Add(24 * time.Hour),
+		Policy:   "web",
+		Machine:  api.MachineInfo{FQDN: "web-1.example.com"},
+	}
+
+	for _, m := range []struct {
+		q     Query
+		match bool
+	}{
+		{Query{}, true},
+		{Query{Serial: "1A:2B"}, true},
+		{Query{Serial: "1a"}, false},
+		{Query{Subject: "WEB-1"}, true},
+		{Query{Subject: "db-1"}, false},
+		{Query{Machine: "example.com"}, true},
+		{Query{Machine: "example.org"}, false},
+		{Query{Policy: "we"}, true},
+		{Query{Policy: "db"}, false},
+		{Query{ExpiresBefore: now.Add(48 * time.Hour)}, true},
+		{Query{ExpiresBefore: now.Add(time.Hour)}, false},
+		{Query{Policy: "web", ExpiresBefore: now.Add(time.Hour)}, false},
+	} {
+		if m.q.Match(c) != m.match {
+			t.Errorf("%+v: expected match to be %v", m.q, m.match)
+		}
+	}
+
+	// Certificates that never expire don't expire soon
+	forever := c
+	forever.NotAfter = time.Time{}
+	if (Query{ExpiresBefore: now.Add(48 * time.Hour)}).Match(forever) {
+		t.Error("a certificate valid forever is expiring")
+	}
+	if !(Query{}).Match(forever) {
+		t.Error("a certificate valid forever doesn't match an empty query")
+	}
+}
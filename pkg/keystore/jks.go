@@ -0,0 +1,194 @@
+// Package keystore writes Java KeyStore (JKS) files, for JVMs that can't
+// read PKCS#12 ones.
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	jksMagic   = 0xfeedfeed
+	jksVersion = 2
+
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+)
+
+// Sun's proprietary key protection algorithm, the only one JKS supports
+var jksKeyProtectorOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+var ErrBadAlias = errors.New("keystore: alias is empty or too long")
+
+type jksEntry struct {
+	tag   uint32
+	alias string
+	cert  []byte
+
+	protectedKey []byte
+	chain        [][]byte
+}
+
+// JKS is a keystore being built, entries are written in the order they
+// were added.
+type JKS struct {
+	entries []jksEntry
+}
+
+// AddTrustedCert adds a DER encoded certificate as a trusted entry.
+func (k *JKS) AddTrustedCert(alias string, der []byte) error {
+	if len(alias) == 0 || len(alias) > 0xffff {
+		return ErrBadAlias
+	}
+
+	k.entries = append(k.entries, jksEntry{
+		tag:   jksTrustedCertTag,
+		alias: alias,
+		cert:  der,
+	})
+	return nil
+}
+
+// AddPrivateKey adds a key with its DER encoded chain, leaf first. The key
+// is protected with password, JVMs expect it to match the store's one.
+func (k *JKS) AddPrivateKey(alias string, key interface{}, chain [][]byte, password string) error {
+	if len(alias) == 0 || len(alias) > 0xffff {
+		return ErrBadAlias
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	protected, err := protectKey(rand.Reader, pkcs8, password)
+	if err != nil {
+		return err
+	}
+
+	k.entries = append(k.entries, jksEntry{
+		tag:          jksPrivateKeyTag,
+		alias:        alias,
+		protectedKey: protected,
+		chain:        chain,
+	})
+	return nil
+}
+
+// Marshal encodes the keystore, password protects its integrity only.
+func (k *JKS) Marshal(password string) ([]byte, error) {
+	var b bytes.Buffer
+	writeUint32(&b, jksMagic)
+	writeUint32(&b, jksVersion)
+	writeUint32(&b, uint32(len(k.entries)))
+
+	now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for _, e := range k.entries {
+		writeUint32(&b, e.tag)
+		writeUTF(&b, e.alias)
+		binary.Write(&b, binary.BigEndian, now)
+
+		switch e.tag {
+		case jksPrivateKeyTag:
+			writeUint32(&b, uint32(len(e.protectedKey)))
+			b.Write(e.protectedKey)
+			writeUint32(&b, uint32(len(e.chain)))
+			for _, der := range e.chain {
+				writeCert(&b, der)
+			}
+		case jksTrustedCertTag:
+			writeCert(&b, e.cert)
+		}
+	}
+
+	h := sha1.New()
+	h.Write(passwordBytes(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(b.Bytes())
+	b.Write(h.Sum(nil))
+
+	return b.Bytes(), nil
+}
+
+// protectKey implements sun.security.provider.KeyProtector: the key is
+// XORed with a SHA-1 based keystream and followed by a SHA-1 checksum,
+// all wrapped into EncryptedPrivateKeyInfo. The salt is read from rand.
+func protectKey(rand io.Reader, plain []byte, password string) ([]byte, error) {
+	passwd := passwordBytes(password)
+
+	salt := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(plain))
+	digest := salt
+	for i := 0; i < len(plain); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+
+		for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+			encrypted[i+j] = plain[i+j] ^ digest[j]
+		}
+	}
+
+	h := sha1.New()
+	h.Write(passwd)
+	h.Write(plain)
+	checksum := h.Sum(nil)
+
+	var data []byte
+	data = append(data, salt...)
+	data = append(data, encrypted...)
+	data = append(data, checksum...)
+
+	return asn1.Marshal(struct {
+		Algo pkix.AlgorithmIdentifier
+		Data []byte
+	}{
+		Algo: pkix.AlgorithmIdentifier{
+			Algorithm:  jksKeyProtectorOID,
+			Parameters: asn1.NullRawValue,
+		},
+		Data: data,
+	})
+}
+
+func writeCert(b *bytes.Buffer, der []byte) {
+	writeUTF(b, "X.509")
+	writeUint32(b, uint32(len(der)))
+	b.Write(der)
+}
+
+func writeUint32(b *bytes.Buffer, v uint32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+// writeUTF writes Java's DataOutput.writeUTF, which matches plain UTF-8
+// for everything but NUL and supplementary characters, none of which
+// belong in aliases.
+func writeUTF(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// passwordBytes is how JKS turns a password into bytes: UTF-16, big
+// endian.
+func passwordBytes(password string) []byte {
+	var b bytes.Buffer
+	for _, c := range utf16.Encode([]rune(password)) {
+		binary.Write(&b, binary.BigEndian, c)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,352 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alvelcom/berny/internal/testca"
+)
+
+// testCert makes a self-signed certificate named cn.
+func testCert(t *testing.T, cn string) (*ecdsa.PrivateKey, []byte) {
+	ca := testca.New(t, cn)
+	return ca.Key, ca.Cert.Raw
+}
+
+// readJKS is the reverse of Marshal, it checks the keyed MAC with password.
+func readJKS(data []byte, password string) ([]jksEntry, error) {
+	if len(data) < sha1.Size {
+		return nil, errors.New("too short")
+	}
+	body, mac := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+
+	h := sha1.New()
+	h.Write(passwordBytes(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), mac) {
+		return nil, errors.New("keyed MAC mismatch")
+	}
+
+	r := bytes.NewReader(body)
+	var header struct{ Magic, Version, Count uint32 }
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != jksMagic || header.Version != jksVersion {
+		return nil, errors.New("bad header")
+	}
+
+	readUTF := func() string {
+		var n uint16
+		binary.Read(r, binary.BigEndian, &n)
+		s := make([]byte, n)
+		r.Read(s)
+		return string(s)
+	}
+	readBytes := func() []byte {
+		var n uint32
+		binary.Read(r, binary.BigEndian, &n)
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	readCert := func() []byte {
+		if typ := readUTF(); typ != "X.509" {
+			return nil
+		}
+		return readBytes()
+	}
+
+	var entries []jksEntry
+	for i := uint32(0); i < header.Count; i++ {
+		var e jksEntry
+		var date uint64
+		binary.Read(r, binary.BigEndian, &e.tag)
+		e.alias = readUTF()
+		binary.Read(r, binary.BigEndian, &date)
+
+		switch e.tag {
+		case jksPrivateKeyTag:
+			e.protectedKey = readBytes()
+			var n uint32
+			binary.Read(r, binary.BigEndian, &n)
+			for j := uint32(0); j < n; j++ {
+				e.chain = append(e.chain, readCert())
+			}
+		case jksTrustedCertTag:
+			e.cert = readCert()
+		default:
+			return nil, errors.New("unknown tag")
+		}
+		entries = append(entries, e)
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("trailing data")
+	}
+	return entries, nil
+}
+
+// recoverKey is sun.security.provider.KeyProtector.recover.
+func recoverKey(protected []byte, password string) ([]byte, error) {
+	var info struct {
+		Algo pkix.AlgorithmIdentifier
+		Data []byte
+	}
+	if _, err := asn1.Unmarshal(protected, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(jksKeyProtectorOID) {
+		return nil, errors.New("unknown algorithm")
+	}
+	if len(info.Data) < 2*sha1.Size {
+		return nil, errors.New("too short")
+	}
+
+	passwd := passwordBytes(password)
+	salt := info.Data[:sha1.Size]
+	encrypted := info.Data[sha1.Size : len(info.Data)-sha1.Size]
+	checksum := info.Data[len(info.Data)-sha1.Size:]
+
+	plain := make([]byte, len(encrypted))
+	digest := salt
+	for i := 0; i < len(plain); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+			plain[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+
+	h := sha1.New()
+	h.Write(passwd)
+	h.Write(plain)
+	if !bytes.Equal(h.Sum(nil), checksum) {
+		return nil, errors.New("wrong password")
+	}
+	return plain, nil
+}
+
+// Computed apart from this package by following KeyProtector.protect:
+// salt 00..13, password "changeit"
+func TestProtectKeyKnownAnswer(t *testing.T) {
+	salt := make([]byte, sha1.Size)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+
+	protected, err := protectKey(bytes.NewReader(salt), []byte("not a real PKCS#8 key, 40 bytes long.."), "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "3060300e060a2b060104012a021101010500044e" +
+		"000102030405060708090a0b0c0d0e0f10111213" +
+		"6ed531c00d50d5a0f2d0845acd843fb4675dc9f762505b595d5e8a4aa4318e12e8b0ad2d0f96" +
+		"fe28af93bb193c12b0bea772d6bcd27456be98b3"
+	if hex.EncodeToString(protected) != expected {
+		t.Errorf("unexpected protected key %x", protected)
+	}
+}
+
+func TestJKSPrivateKey(t *testing.T) {
+	key, leaf := testCert(t, "web-1.example.com")
+	_, ca := testCert(t, "CA")
+
+	var store JKS
+	if err := store.AddPrivateKey("web", key, [][]byte{leaf, ca}, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Marshal("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readJKS(data, "wrong"); err == nil {
+		t.Error("expected the keyed MAC to fail with a wrong password")
+	}
+	entries, err := readJKS(data, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].tag != jksPrivateKeyTag || entries[0].alias != "web" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if !reflect.DeepEqual(entries[0].chain, [][]byte{leaf, ca}) {
+		t.Error("chain doesn't round trip")
+	}
+
+	if _, err := recoverKey(entries[0].protectedKey, "wrong"); err == nil {
+		t.Error("expected the key not to recover with a wrong password")
+	}
+	pkcs8, err := recoverKey(entries[0].protectedKey, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := recovered.(*ecdsa.PrivateKey); !ok || ecKey.D.Cmp(key.D) != 0 {
+		t.Error("recovered key doesn't match")
+	}
+}
+
+func TestJKSTrustedCert(t *testing.T) {
+	_, root := testCert(t, "Root")
+	_, intermediate := testCert(t, "Intermediate")
+
+	var store JKS
+	if err := store.AddTrustedCert("0-Root", root); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddTrustedCert("1-Intermediate", intermediate); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Marshal("changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readJKS(data, "wrong"); err == nil {
+		t.Error("expected the keyed MAC to fail with a wrong password")
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := readJKS(tampered, "changeit"); err == nil {
+		t.Error("expected the keyed MAC to fail on a modified store")
+	}
+
+	entries, err := readJKS(data, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []jksEntry{
+		{tag: jksTrustedCertTag, alias: "0-Root", cert: root},
+		{tag: jksTrustedCertTag, alias: "1-Intermediate", cert: intermediate},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestJKSBadAlias(t *testing.T) {
+	key, der := testCert(t, "web-1.example.com")
+
+	var store JKS
+	if err := store.AddPrivateKey("", key, [][]byte{der}, "s3cret"); err != ErrBadAlias {
+		t.Errorf("expected ErrBadAlias, got %v", err)
+	}
+	if err := store.AddTrustedCert(strings.Repeat("x", 0x10000), der); err != ErrBadAlias {
+		t.Errorf("expected ErrBadAlias, got %v", err)
+	}
+}
+
+// keytool runs Java's keytool in dir.
+func keytool(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("keytool", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("keytool %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func TestKeytoolReadsJKS(t *testing.T) {
+	if _, err := exec.LookPath("keytool"); err != nil {
+		t.Skip("keytool is not installed")
+	}
+	dir, err := ioutil.TempDir("", "berny-jks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, leaf := testCert(t, "web-1.example.com")
+	_, ca := testCert(t, "CA")
+
+	var store JKS
+	if err := store.AddPrivateKey("web", key, [][]byte{leaf}, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddTrustedCert("ca", ca); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Marshal("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "berny.jks"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := keytool(t, dir, "-list", "-storetype", "JKS", "-keystore", "berny.jks", "-storepass", "s3cret")
+	if !strings.Contains(out, "PrivateKeyEntry") || !strings.Contains(out, "trustedCertEntry") {
+		t.Errorf("unexpected keytool -list output:\n%s", out)
+	}
+
+	// Reading the key back makes keytool check its password
+	keytool(t, dir, "-importkeystore", "-noprompt",
+		"-srcstoretype", "JKS", "-srckeystore", "berny.jks", "-srcstorepass", "s3cret", "-srcalias", "web",
+		"-deststoretype", "JKS", "-destkeystore", "copy.jks", "-deststorepass", "s3cret")
+}
+
+func TestReadKeytoolJKS(t *testing.T) {
+	if _, err := exec.LookPath("keytool"); err != nil {
+		t.Skip("keytool is not installed")
+	}
+	dir, err := ioutil.TempDir("", "berny-jks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keytool(t, dir, "-genkeypair", "-storetype", "JKS", "-keystore", "keytool.jks",
+		"-storepass", "s3cret", "-keypass", "s3cret", "-alias", "web",
+		"-keyalg", "EC", "-dname", "CN=web-1.example.com")
+	data, err := ioutil.ReadFile(filepath.Join(dir, "keytool.jks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readJKS(data, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].tag != jksPrivateKeyTag || len(entries[0].chain) != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	pkcs8, err := recoverKey(entries[0].protectedKey, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(entries[0].chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.X.Cmp(key.(*ecdsa.PrivateKey).X) != 0 || pub.Y.Cmp(key.(*ecdsa.PrivateKey).Y) != 0 {
+		t.Error("key doesn't match the certificate keytool made")
+	}
+}
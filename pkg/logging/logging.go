@@ -0,0 +1,179 @@
+// Package logging is a leveled, structured logger writing logfmt or JSON
+// lines. Every value goes through Redact, so secrets can't be logged by
+// accident: a value of a type Redact doesn't know is never printed.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, errors.New("logging: unknown level " + s)
+}
+
+type Logger struct {
+	out   *output
+	level Level
+	json  bool
+
+	// Fields added by With, redacted already
+	fields []field
+}
+
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// New creates a logger writing entries of level and above, format is
+// either logfmt or json.
+func New(w io.Writer, format string, level Level) (*Logger, error) {
+	l := &Logger{out: &output{w: w}, level: level}
+	switch format {
+	case "", "logfmt":
+	case "json":
+		l.json = true
+	default:
+		return nil, errors.New("logging: unknown format " + format)
+	}
+	return l, nil
+}
+
+// Default logs info and above to stderr in logfmt.
+func Default() *Logger {
+	l, _ := New(os.Stderr, "logfmt", Info)
+	return l
+}
+
+// With returns a logger adding key-value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]field(nil), l.fields...), pairs(kv)...)
+	return &child
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(Info, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(Warn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+// Fatal logs an error and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(Error, msg, kv)
+	os.Exit(1)
+}
+
+// pairs turns key-value arguments into redacted fields, a missing value
+// is logged as such rather than shifting the rest.
+func pairs(kv []interface{}) []field {
+	var fs []field
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = "!badkey"
+		}
+
+		var value interface{} = "!missing"
+		if i+1 < len(kv) {
+			value = Redact(key, kv[i+1])
+		}
+		fs = append(fs, field{key, value})
+	}
+	return fs
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fs := []field{
+		{"time", time.Now().UTC().Format(time.RFC3339Nano)},
+		{"level", level.String()},
+		{"msg", msg},
+	}
+	fs = append(fs, l.fields...)
+	fs = append(fs, pairs(kv)...)
+
+	var b bytes.Buffer
+	if l.json {
+		writeJSON(&b, fs)
+	} else {
+		writeLogfmt(&b, fs)
+	}
+	b.WriteByte('\n')
+
+	l.out.mu.Lock()
+	l.out.w.Write(b.Bytes())
+	l.out.mu.Unlock()
+}
+
+func writeJSON(b *bytes.Buffer, fs []field) {
+	b.WriteByte('{')
+	for i, f := range fs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			value, _ = json.Marshal(err.Error())
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
+
+func writeLogfmt(b *bytes.Buffer, fs []field) {
+	for i, f := range fs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.key)
+		b.WriteByte('=')
+
+		s := fmt.Sprint(f.value)
+		if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+			s = fmt.Sprintf("%q", s)
+		}
+		b.WriteString(s)
+	}
+}
@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+const redacted = "[redacted]"
+
+// Keys that name secrets whatever their values look like
+var secretKeys = []string{"password", "secret", "token", "private", "body", "pem"}
+
+// Redact turns a value into something safe to log. Only types known to
+// carry no secrets are printed, products and tasks are reduced to their
+// names, anything else is replaced with its type.
+func Redact(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(lower, s) {
+			return redacted
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return redactString(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case error:
+		return redactString(v.Error())
+	case []string:
+		out := make([]string, len(v))
+		for i := range v {
+			out[i] = redactString(v[i])
+		}
+		return strings.Join(out, ",")
+	case []byte:
+		return fmt.Sprintf("[%d bytes]", len(v))
+	case json.RawMessage:
+		return fmt.Sprintf("[%d bytes]", len(v))
+	case api.Product:
+		return productString(v)
+	case []api.Product:
+		out := make([]string, len(v))
+		for i := range v {
+			out[i] = productString(v[i])
+		}
+		return strings.Join(out, ",")
+	case api.Task:
+		return v.Type + " " + nameString(v.Name)
+	case api.TaskResponse:
+		return v.Type + " " + nameString(v.Name)
+	case api.MachineInfo:
+		return v.FQDN
+	case *api.MachineInfo:
+		if v == nil {
+			return nil
+		}
+		return v.FQDN
+	default:
+		return fmt.Sprintf("[%T]", value)
+	}
+}
+
+// redactString hides PEM blocks, errors sometimes quote whole files.
+func redactString(s string) string {
+	if strings.Contains(s, "-----BEGIN") {
+		return redacted
+	}
+	return s
+}
+
+// nameString joins a task name, task names are padded with empty parts.
+func nameString(name []string) string {
+	var parts []string
+	for _, n := range name {
+		if len(n) > 0 {
+			parts = append(parts, n)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func productString(p api.Product) string {
+	return fmt.Sprintf("%s(%04o,%dB)", strings.Join(p.Name, "/"), p.Mask, len(p.Body))
+}
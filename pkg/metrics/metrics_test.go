@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_requests_total", "Requests by\npath.", "path", "code")
+	h := r.Histogram("test_duration_seconds", "Request duration.", []float64{.1, 1}, "path")
+	r.GaugeFunc("test_temperature", "Room temperature.", []string{"room"}, func(emit func(float64, ...string)) {
+		emit(21.5, "kitchen")
+		emit(math.Inf(-1), "freezer")
+	})
+	r.Counter("test_unused_total", "Never incremented.")
+
+	c.Inc("/b", "200")
+	c.Add(2, "/a", "200")
+	c.Inc(`say "hi"\n`+"\n\tü", "500")
+	h.Observe(.05, "/a")
+	h.Observe(.5, "/a")
+	h.Observe(5, "/a")
+
+	want := `# HELP test_requests_total Requests by path.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",code="200"} 2
+test_requests_total{path="/b",code="200"} 1
+test_requests_total{path="say \"hi\"\\n\n	ü",code="500"} 1
+# HELP test_duration_seconds Request duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/a",le="0.1"} 1
+test_duration_seconds_bucket{path="/a",le="1"} 2
+test_duration_seconds_bucket{path="/a",le="+Inf"} 3
+test_duration_seconds_sum{path="/a"} 5.55
+test_duration_seconds_count{path="/a"} 3
+# HELP test_temperature Room temperature.
+# TYPE test_temperature gauge
+test_temperature{room="freezer"} -Inf
+test_temperature{room="kitchen"} 21.5
+# HELP test_unused_total Never incremented.
+# TYPE test_unused_total counter
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWrongLabels(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic on a wrong number of label values")
+		}
+	}()
+	NewRegistry().Counter("test_total", "Test.", "a", "b").Inc("x")
+}
@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// A plugin runs in its own process group, so whatever it spawns is killed
+// with it.
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
+
+// setLimits applies resource limits to a started plugin. os/exec has no
+// hook between fork and exec, so the plugin runs unlimited for a moment.
+func setLimits(pid int, l Limits) error {
+	if l.MaxMemory > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, l.MaxMemory); err != nil {
+			return err
+		}
+	}
+	if l.MaxCPU > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_CPU, l.MaxCPU); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, value uint64) error {
+	limit := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
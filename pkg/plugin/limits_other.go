@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package plugin
+
+import "os/exec"
+
+// Resource limits and process groups are only implemented for Linux,
+// elsewhere plugins are bound by the timeout alone.
+func setProcessGroup(c *exec.Cmd) {}
+
+func killProcessGroup(c *exec.Cmd) {
+	c.Process.Kill()
+}
+
+func setLimits(pid int, l Limits) error {
+	return nil
+}
@@ -0,0 +1,305 @@
+// Package plugin is the protocol of external producers: programs bernyd
+// runs once per Prepare or Produce, sending a Request as JSON on stdin and
+// reading a Response as JSON from stdout.
+//
+// The contract is the one of Go producers. Prepare asks the client for
+// tasks, their responses come back on the next round; once Prepare asks
+// for nothing, Produce returns products. Plugins are stateless, every
+// request carries everything known so far.
+//
+// Names are relative to the policy: bernyd puts products, including ones
+// tasks save, under the policy's directory.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// Version of the protocol, plugins should refuse requests of other
+// versions.
+const Version = 1
+
+const (
+	PhasePrepare = "prepare"
+	PhaseProduce = "produce"
+)
+
+var (
+	ErrTimeout        = errors.New("plugin: timed out")
+	ErrOutputTooLarge = errors.New("plugin: output is too large")
+)
+
+type Request struct {
+	Version int    `json:"version"`
+	Phase   string `json:"phase"`
+	// Name of the produce block, names of tasks must start with it
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+
+	// Attributes of the produce block besides the ones of bernyd, evaluated
+	Attributes map[string]json.RawMessage `json:"attributes"`
+	Req        Req                        `json:"req"`
+
+	// TaskResponses are responses to tasks of this producer
+	TaskResponses []api.TaskResponse `json:"task_responses,omitempty"`
+}
+
+// Req is the req variable of configs.
+type Req struct {
+	api.MachineInfo
+	RequestIP string `json:"request_ip"`
+}
+
+type Response struct {
+	Tasks    []api.Task    `json:"tasks,omitempty"`
+	Products []api.Product `json:"products,omitempty"`
+
+	// Error fails the harvest, it's logged and shown to the client
+	Error string `json:"error,omitempty"`
+}
+
+// Validate checks a response follows the contract: tasks only from
+// Prepare, named after the producer and of known types; products only
+// from Produce, with names safe to save on the client.
+func (r *Response) Validate(req *Request) error {
+	switch req.Phase {
+	case PhasePrepare:
+		if len(r.Products) > 0 {
+			return errors.New("plugin: products returned by prepare")
+		}
+	case PhaseProduce:
+		if len(r.Tasks) > 0 {
+			return errors.New("plugin: tasks returned by produce")
+		}
+	}
+
+	for _, t := range r.Tasks {
+		if len(t.Name) == 0 || t.Name[0] != req.Name {
+			return fmt.Errorf("plugin: task %q isn't named after the producer", t.Name)
+		}
+		for _, part := range t.Name[1:] {
+			if len(part) == 0 || strings.Contains(part, "/") {
+				return fmt.Errorf("plugin: task %q: bad name", t.Name)
+			}
+		}
+		if _, err := task.FromAPI(t); err != nil {
+			return fmt.Errorf("plugin: task %q: %v", t.Name, err)
+		}
+	}
+
+	for _, p := range r.Products {
+		if err := validateName(p.Name); err != nil {
+			return err
+		}
+		if p.Mask < 0 || p.Mask > 0777 {
+			return fmt.Errorf("plugin: product %q: bad mask %o", p.Name, p.Mask)
+		}
+	}
+	return nil
+}
+
+// validateName makes sure a product stays in the client's directory.
+func validateName(name []string) error {
+	if len(name) == 0 {
+		return errors.New("plugin: product without a name")
+	}
+	for _, part := range name {
+		if len(part) == 0 || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+			return fmt.Errorf("plugin: product %q: bad name", name)
+		}
+	}
+	return nil
+}
+
+// Limits bound what a plugin run may take.
+type Limits struct {
+	Timeout time.Duration
+	// MaxOutput is the most stdout may hold, in bytes
+	MaxOutput int64
+	// MaxMemory is the address space limit, in bytes, 0 disables
+	MaxMemory uint64
+	// MaxCPU is the CPU time limit, in seconds, 0 disables
+	MaxCPU uint64
+}
+
+var DefaultLimits = Limits{
+	Timeout:   10 * time.Second,
+	MaxOutput: 4 << 20,
+	MaxMemory: 1 << 30,
+	MaxCPU:    10,
+}
+
+// Command is a plugin to run. The environment isn't inherited from
+// bernyd, it holds Env only.
+type Command struct {
+	Path   string
+	Args   []string
+	Env    []string
+	Limits Limits
+}
+
+// stderrLimit is how much of stderr is kept for error messages
+const stderrLimit = 4 << 10
+
+// Run runs the plugin once, with the current protocol version unless the
+// request says otherwise. The response is validated, a response with
+// Error set is returned as an error.
+func Run(ctx context.Context, cmd Command, req *Request) (*Response, error) {
+	if req.Version == 0 {
+		req.Version = Version
+	}
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := cmd.Limits
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultLimits.Timeout
+	}
+	if limits.MaxOutput <= 0 {
+		limits.MaxOutput = DefaultLimits.MaxOutput
+	}
+
+	c := exec.Command(cmd.Path, cmd.Args...)
+	c.Env = append([]string{}, cmd.Env...)
+	c.Stdin = bytes.NewReader(in)
+	stdout := &limitedBuffer{limit: limits.MaxOutput}
+	stderr := &limitedBuffer{limit: stderrLimit, truncate: true}
+	c.Stdout = stdout
+	c.Stderr = stderr
+	setProcessGroup(c)
+
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	if err := setLimits(c.Process.Pid, limits); err != nil {
+		killProcessGroup(c)
+		c.Wait()
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+
+	timer := time.NewTimer(limits.Timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		killProcessGroup(c)
+		<-done
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		killProcessGroup(c)
+		<-done
+		return nil, ctx.Err()
+	}
+
+	if stdout.exceeded {
+		return nil, ErrOutputTooLarge
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.buf.String())
+		if len(msg) > 0 {
+			return nil, fmt.Errorf("plugin: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("plugin: %v", err)
+	}
+
+	var resp Response
+	dec := json.NewDecoder(&stdout.buf)
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("plugin: bad response: %v", err)
+	}
+	if dec.More() {
+		return nil, errors.New("plugin: bad response: more than one value")
+	}
+	if len(resp.Error) > 0 {
+		return nil, errors.New("plugin: " + resp.Error)
+	}
+	if err := resp.Validate(req); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// limitedBuffer keeps up to limit bytes. Past that it either drops the
+// rest or fails the write, which stops the copy from the plugin. The
+// buffer isn't embedded, its ReadFrom would bypass the limit.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	truncate bool
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - int64(b.buf.Len())
+	if int64(len(p)) <= room {
+		return b.buf.Write(p)
+	}
+
+	b.exceeded = true
+	if room > 0 {
+		b.buf.Write(p[:room])
+	}
+	if b.truncate {
+		return len(p), nil
+	}
+	return 0, ErrOutputTooLarge
+}
+
+// Handler is a plugin written in Go, see Serve.
+type Handler interface {
+	Prepare(req *Request) ([]api.Task, error)
+	Produce(req *Request) ([]api.Product, error)
+}
+
+// Serve answers the request on stdin and exits, it's all main of a Go
+// plugin needs to call.
+func Serve(h Handler) {
+	resp := serve(h, os.Stdin)
+	if err := json.NewEncoder(os.Stdout).Encode(resp); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func serve(h Handler, r io.Reader) *Response {
+	var req Request
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return &Response{Error: "bad request: " + err.Error()}
+	}
+	if req.Version != Version {
+		return &Response{Error: fmt.Sprintf("unsupported protocol version %d", req.Version)}
+	}
+
+	var resp Response
+	var err error
+	switch req.Phase {
+	case PhasePrepare:
+		resp.Tasks, err = h.Prepare(&req)
+	case PhaseProduce:
+		resp.Products, err = h.Produce(&req)
+	default:
+		err = errors.New("unknown phase " + req.Phase)
+	}
+	if err != nil {
+		return &Response{Error: err.Error()}
+	}
+	return &resp
+}
@@ -0,0 +1,121 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/plugin"
+	"github.com/alvelcom/berny/pkg/plugin/plugintest"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// The test binary doubles as plugins, BERNY_PLUGIN_TEST picks which one
+const modeEnv = "BERNY_PLUGIN_TEST"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(modeEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "greeter":
+		plugin.Serve(greeter{})
+	case "sleeper":
+		time.Sleep(time.Minute)
+	case "flooder":
+		fmt.Print(strings.Repeat("x", 1<<20))
+	case "escaper":
+		json.NewEncoder(os.Stdout).Encode(plugin.Response{
+			Products: []api.Product{{Name: []string{"..", "etc", "passwd"}, Mask: 0644}},
+		})
+	}
+}
+
+// greeter asks for a key, then greets the machine
+type greeter struct{}
+
+func (greeter) Prepare(req *plugin.Request) ([]api.Task, error) {
+	for _, r := range req.TaskResponses {
+		if r.Type == "ecdsa-key" {
+			return nil, nil
+		}
+	}
+
+	t := task.ECDSAKey{
+		Curve:    "P-256",
+		Template: api.Product{Name: []string{req.Name, "key.pem"}, Mask: 0600},
+	}
+	return []api.Task{t.ToAPI([]string{req.Name})}, nil
+}
+
+func (greeter) Produce(req *plugin.Request) ([]api.Product, error) {
+	var greeting string
+	if err := json.Unmarshal(req.Attributes["greeting"], &greeting); err != nil {
+		return nil, errors.New("greeting: " + err.Error())
+	}
+	return []api.Product{{
+		Name: []string{req.Name, "greeting"},
+		Mask: 0644,
+		Body: []byte(greeting + ", " + req.Req.FQDN),
+	}}, nil
+}
+
+func command(mode string) plugin.Command {
+	return plugin.Command{
+		Path: os.Args[0],
+		Env:  []string{modeEnv + "=" + mode},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	products := plugintest.Conformance(t, command("greeter"), plugintest.Case{
+		Name:       "hello",
+		Attributes: map[string]interface{}{"greeting": "Hello"},
+		Req: plugin.Req{
+			MachineInfo: api.MachineInfo{FQDN: "web-1.example.com"},
+		},
+	})
+
+	if len(products) != 1 || string(products[0].Body) != "Hello, web-1.example.com" {
+		t.Errorf("unexpected products: %+v", products)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cmd := command("sleeper")
+	cmd.Limits.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := plugin.Run(context.Background(), cmd, &plugin.Request{Phase: plugin.PhasePrepare})
+	if err != plugin.ErrTimeout {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("plugin wasn't killed in time")
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	cmd := command("flooder")
+	cmd.Limits.MaxOutput = 64 << 10
+
+	_, err := plugin.Run(context.Background(), cmd, &plugin.Request{Phase: plugin.PhasePrepare})
+	if err != plugin.ErrOutputTooLarge {
+		t.Errorf("expected the output limit to hit, got %v", err)
+	}
+}
+
+func TestProductName(t *testing.T) {
+	_, err := plugin.Run(context.Background(), command("escaper"), &plugin.Request{
+		Phase: plugin.PhaseProduce,
+		Name:  "escaper",
+	})
+	if err == nil || !strings.Contains(err.Error(), "bad name") {
+		t.Errorf("expected a bad name error, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+// Package plugintest is a conformance kit for plugins. It runs a plugin
+// through a whole harvest, solving its tasks the way berny would, and
+// checks it handles requests it can't serve.
+//
+//	func TestConformance(t *testing.T) {
+//		plugintest.Conformance(t, plugin.Command{Path: "./berny-foo"}, plugintest.Case{
+//			Name:       "foo",
+//			Attributes: map[string]interface{}{"size": 32},
+//			Req:        plugin.Req{MachineInfo: api.MachineInfo{FQDN: "web-1.example.com"}},
+//		})
+//	}
+package plugintest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/client"
+	"github.com/alvelcom/berny/pkg/plugin"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// MaxRounds is how many Prepare rounds a plugin may take to stop asking
+// for tasks.
+const MaxRounds = 8
+
+// Case is a produce block and a machine to run the plugin for.
+type Case struct {
+	Name       string
+	Policy     string
+	Attributes map[string]interface{}
+	Req        plugin.Req
+}
+
+func (c Case) request(t *testing.T, phase string, resps []api.TaskResponse) *plugin.Request {
+	attrs := make(map[string]json.RawMessage)
+	for name, value := range c.Attributes {
+		b, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("attribute %s: %v", name, err)
+		}
+		attrs[name] = b
+	}
+
+	return &plugin.Request{
+		Phase:         phase,
+		Name:          c.Name,
+		Policy:        c.Policy,
+		Attributes:    attrs,
+		Req:           c.Req,
+		TaskResponses: resps,
+	}
+}
+
+// Conformance runs the checks as subtests and returns products of the
+// harvest, for the caller to look into.
+func Conformance(t *testing.T, cmd plugin.Command, c Case) []api.Product {
+	var products []api.Product
+	t.Run("harvest", func(t *testing.T) {
+		products = harvest(t, cmd, c)
+	})
+
+	t.Run("unknown phase", func(t *testing.T) {
+		req := c.request(t, "bogus", nil)
+		if _, err := plugin.Run(context.Background(), cmd, req); err == nil {
+			t.Error("plugin accepted an unknown phase")
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		req := c.request(t, plugin.PhasePrepare, nil)
+		req.Version = plugin.Version + 1000
+		if _, err := plugin.Run(context.Background(), cmd, req); err == nil {
+			t.Error("plugin accepted an unsupported protocol version")
+		}
+	})
+
+	t.Run("unknown task response", func(t *testing.T) {
+		// Responses to tasks that were never asked for must not break it
+		req := c.request(t, plugin.PhasePrepare, []api.TaskResponse{{
+			Name: []string{c.Name, "plugintest-unknown"},
+			Type: "plugintest-unknown",
+			Body: json.RawMessage(`{}`),
+		}})
+		plugin.Run(context.Background(), cmd, req)
+	})
+	return products
+}
+
+// harvest solves tasks until Prepare asks for nothing, then checks
+// Produce. Every Prepare is run twice: a plugin has no state, so the
+// same request must get the same tasks.
+func harvest(t *testing.T, cmd plugin.Command, c Case) []api.Product {
+	dir, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink := client.Dir(dir)
+
+	var resps []api.TaskResponse
+	for round := 0; ; round++ {
+		if round == MaxRounds {
+			t.Fatalf("plugin still asks for tasks after %d rounds", MaxRounds)
+		}
+
+		resp, err := plugin.Run(context.Background(), cmd, c.request(t, plugin.PhasePrepare, resps))
+		if err != nil {
+			t.Fatalf("prepare, round %d: %v", round, err)
+		}
+		again, err := plugin.Run(context.Background(), cmd, c.request(t, plugin.PhasePrepare, resps))
+		if err != nil {
+			t.Fatalf("prepare, round %d, again: %v", round, err)
+		}
+		if !reflect.DeepEqual(taskNames(resp.Tasks), taskNames(again.Tasks)) {
+			t.Errorf("prepare, round %d: asked for %v, then for %v", round,
+				taskNames(resp.Tasks), taskNames(again.Tasks))
+		}
+
+		if len(resp.Tasks) == 0 {
+			break
+		}
+		for _, tk := range resp.Tasks {
+			for _, r := range resps {
+				if reflect.DeepEqual(r.Name, tk.Name) {
+					t.Fatalf("prepare, round %d: task %q asked again after it was solved", round, tk.Name)
+				}
+			}
+
+			products, r, err := task.Solve(tk, sink)
+			if err != nil {
+				t.Fatalf("prepare, round %d: can't solve task %q: %v", round, tk.Name, err)
+			}
+			for _, p := range products {
+				if _, err := sink.Save(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resps = append(resps, r)
+		}
+	}
+
+	resp, err := plugin.Run(context.Background(), cmd, c.request(t, plugin.PhaseProduce, resps))
+	if err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	return resp.Products
+}
+
+// taskNames lists names of tasks in order, plugins may return them in
+// any.
+func taskNames(ts []api.Task) []string {
+	var names []string
+	for _, t := range ts {
+		names = append(names, strings.Join(t.Name, "/"))
+	}
+	sort.Strings(names)
+	return names
+}
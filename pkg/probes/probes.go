@@ -1,35 +1,147 @@
 package probes
 
 import (
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
+	"net/http"
 
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/alvelcom/berny/pkg/api"
 	"github.com/alvelcom/berny/pkg/config"
 )
 
 var (
 	ErrBadType = errors.New("probes: bad type")
+
+	ErrNoIdentity       = errors.New("probes: identity: no client certificate")
+	ErrIdentityMismatch = errors.New("probes: identity: certificate doesn't match machine")
+	ErrNotClientAuth    = errors.New("probes: identity: certificate isn't for client authentication")
 )
 
 type Probe interface {
 	Type() string
+	Verify(r *http.Request, mi *api.MachineInfo) error
 }
 
-func New(c config.Probe) (Probe, error) {
-	switch c.Type {
-	case "gcp":
-		return newGCP(c)
-	default:
-		return nil, ErrBadType
-	}
+// OfflineVerifier is implemented by probes that can tell whether a machine
+// passes without its request, like when explaining config. Others depend
+// on the request, its TLS state say.
+type OfflineVerifier interface {
+	VerifyOffline(mi *api.MachineInfo) error
 }
 
-type gcp struct {
+func New(c config.Probe, ctx *hcl.EvalContext) (Probe, error) {
+	new, err := lookup(c.Type)
+	if err != nil {
+		return nil, err
+	}
+	p := new()
+
+	diags := gohcl.DecodeBody(c.Config, ctx, p)
+	if len(diags) > 0 {
+		return nil, diags
+	}
+
+	if v, ok := p.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
-func newGCP(c config.Probe) (Probe, error) {
-	return &gcp{}, nil
+type gcp struct {
 }
 
 func (g *gcp) Type() string {
 	return "gcp"
 }
+
+func (g *gcp) Verify(r *http.Request, mi *api.MachineInfo) error {
+	return g.VerifyOffline(mi)
+}
+
+func (g *gcp) VerifyOffline(mi *api.MachineInfo) error {
+	return nil
+}
+
+// identity trusts a client certificate, issued by us on some previous
+// harvest, as a proof of the machine's FQDN.
+type identity struct {
+	// CA is a PEM bundle that client certificates must chain to. When it's
+	// empty we rely on chains verified by the TLS listener.
+	CA string `hcl:"ca,optional"`
+
+	roots *x509.CertPool
+}
+
+// Validate loads the CA bundle.
+func (i *identity) Validate() error {
+	if len(i.CA) > 0 {
+		b, err := ioutil.ReadFile(i.CA)
+		if err != nil {
+			return err
+		}
+
+		i.roots = x509.NewCertPool()
+		if !i.roots.AppendCertsFromPEM(b) {
+			return errors.New("probes: identity: no certificates in " + i.CA)
+		}
+	}
+	return nil
+}
+
+func (i *identity) Type() string {
+	return "identity"
+}
+
+func (i *identity) Verify(r *http.Request, mi *api.MachineInfo) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ErrNoIdentity
+	}
+	leaf := r.TLS.PeerCertificates[0]
+
+	if i.roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         i.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return err
+		}
+	} else if len(r.TLS.VerifiedChains) == 0 {
+		return ErrNoIdentity
+	}
+
+	// Certificates without extended key usages verify for any use,
+	// identities have to be issued for client authentication explicitly
+	if !hasClientAuth(leaf) {
+		return ErrNotClientAuth
+	}
+
+	if mi == nil || len(mi.FQDN) == 0 {
+		return ErrIdentityMismatch
+	}
+	if leaf.Subject.CommonName != mi.FQDN && leaf.VerifyHostname(mi.FQDN) != nil {
+		return ErrIdentityMismatch
+	}
+	return nil
+}
+
+func hasClientAuth(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageClientAuth {
+			return true
+		}
+	}
+	return false
+}
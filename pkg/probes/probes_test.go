@@ -0,0 +1,95 @@
+package probes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/config"
+)
+
+// issue makes a certificate for fqdn, good for usages.
+func issue(t *testing.T, ca *testca.CA, fqdn string, usages ...x509.ExtKeyUsage) *x509.Certificate {
+	cert, _ := ca.Issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: fqdn},
+		DNSNames:    []string{fqdn},
+		ExtKeyUsage: usages,
+	})
+	return cert
+}
+
+func TestIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-probes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := testca.New(t, "CA"), testca.New(t, "CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, testca.CertPEM(ca.Cert.Raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, diags := hclsyntax.ParseConfig([]byte(fmt.Sprintf("ca = %q\n", caFile)), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	p, err := New(config.Probe{Type: "identity", Config: f.Body}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCA := p.(*identity)
+
+	fqdn := "web-1.example.com"
+	for _, c := range []struct {
+		name string
+		cert *x509.Certificate
+		fqdn string
+		err  bool
+	}{
+		{"client auth", issue(t, ca, fqdn, x509.ExtKeyUsageClientAuth), fqdn, false},
+		{"client and server auth", issue(t, ca, fqdn, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth), fqdn, false},
+		{"server auth only", issue(t, ca, fqdn, x509.ExtKeyUsageServerAuth), fqdn, true},
+		{"no usages", issue(t, ca, fqdn), fqdn, true},
+		{"any usage", issue(t, ca, fqdn, x509.ExtKeyUsageAny), fqdn, true},
+		{"another machine", issue(t, ca, "web-2.example.com", x509.ExtKeyUsageClientAuth), fqdn, true},
+		{"no fqdn", issue(t, ca, fqdn, x509.ExtKeyUsageClientAuth), "", true},
+		{"another CA", issue(t, other, fqdn, x509.ExtKeyUsageClientAuth), fqdn, true},
+	} {
+		r := httptest.NewRequest("POST", "/v1/harvest", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert}}
+		err := withCA.Verify(r, &api.MachineInfo{FQDN: c.fqdn})
+		if (err != nil) != c.err {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+
+		// Without a CA the listener verified the chain
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{c.cert, ca.Cert}}
+		if c.name != "another CA" {
+			err := (&identity{}).Verify(r, &api.MachineInfo{FQDN: c.fqdn})
+			if (err != nil) != c.err {
+				t.Errorf("%s, verified by the listener: unexpected error %v", c.name, err)
+			}
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/v1/harvest", nil)
+	if err := withCA.Verify(r, &api.MachineInfo{FQDN: fqdn}); err != ErrNoIdentity {
+		t.Errorf("expected ErrNoIdentity without TLS, got %v", err)
+	}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{issue(t, ca, fqdn, x509.ExtKeyUsageClientAuth)}}
+	if err := (&identity{}).Verify(r, &api.MachineInfo{FQDN: fqdn}); err != ErrNoIdentity {
+		t.Errorf("expected ErrNoIdentity without a verified chain, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package probes
+
+import (
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/alvelcom/berny/internal/registry"
+)
+
+// Validator is implemented by probes that check, or finish loading, their
+// configuration once it's decoded.
+type Validator interface {
+	Validate() error
+}
+
+var types = registry.New("probes")
+
+func init() {
+	Register("gcp", func() Probe { return &gcp{} })
+	Register("identity", func() Probe { return &identity{} })
+}
+
+// Register makes a probe type available to configs. new returns an empty
+// probe, the block body is decoded into it with gohcl, so its hcl tags are
+// the schema. It panics if the type is taken.
+func Register(type_ string, new func() Probe) {
+	types.Register(type_, new)
+}
+
+func lookup(type_ string) (func() Probe, error) {
+	new, ok := types.Lookup(type_)
+	if !ok {
+		return nil, ErrBadType
+	}
+	return new.(func() Probe), nil
+}
+
+// Types lists registered probe types.
+func Types() []string {
+	return types.Types()
+}
+
+// Schema describes the body of a verify block of the type.
+func Schema(type_ string) (*hcl.BodySchema, error) {
+	new, err := lookup(type_)
+	if err != nil {
+		return nil, err
+	}
+	schema, _ := gohcl.ImpliedBodySchema(new())
+	return schema, nil
+}
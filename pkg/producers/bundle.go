@@ -0,0 +1,201 @@
+package producers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/keystore"
+)
+
+// Default trust store password is what JVMs use for their own cacerts
+var defaultPasswordExpr = mustParseExpression(`"changeit"`)
+
+// CABundle delivers a trust store: CA chains of x509 backends plus extra
+// PEM files. Besides ca.pem it can be written as truststore.jks and
+// truststore.p12.
+type CABundle struct {
+	Name string
+
+	Backends  hcl.Expression `hcl:"backends"`
+	RootsOnly bool           `hcl:"roots_only,optional"`
+	Files     []string       `hcl:"files,optional"`
+	Formats   []string       `hcl:"formats,optional"`
+	Password  hcl.Expression `hcl:"password,optional"`
+}
+
+// DryRun allows everything, CA certificates are public.
+func (b *CABundle) DryRun() (prepare, produce bool) {
+	return true, true
+}
+
+func (b *CABundle) Prepare(c *Context) (TaskRequests, error) {
+	return nil, nil
+}
+
+func (b *CABundle) Produce(c *Context) ([]api.Product, error) {
+	backends, err := evalX509Backends(b.Backends, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: backends: %w", err)
+	}
+
+	var certs []*x509.Certificate
+	seen := make(map[string]bool)
+	add := func(der []byte) error {
+		if seen[string(der)] {
+			return nil
+		}
+		seen[string(der)] = true
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		if b.RootsOnly && !isSelfSigned(cert) {
+			return nil
+		}
+		certs = append(certs, cert)
+		return nil
+	}
+
+	for _, backend := range backends {
+		chain, err := backend.CA()
+		if err != nil {
+			return nil, err
+		}
+		for _, der := range chain {
+			if err := add(der); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, fn := range b.Files {
+		rest, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if err := add(block.Bytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("producer: ca_bundle: no certificates")
+	}
+
+	formats := b.Formats
+	if len(formats) == 0 {
+		formats = []string{"pem"}
+	}
+
+	password, err := evalString(orDefault(b.Password, defaultPasswordExpr), c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: password: %w", err)
+	}
+
+	var ps []api.Product
+	for _, format := range formats {
+		p, err := encodeTrustStore(certs, format, password)
+		if err != nil {
+			return nil, err
+		}
+		p.Name = append([]string{b.Name}, p.Name...)
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func encodeTrustStore(certs []*x509.Certificate, format, password string) (api.Product, error) {
+	switch format {
+	case "pem":
+		var buf bytes.Buffer
+		for _, cert := range certs {
+			pem.Encode(&buf, &pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: cert.Raw,
+			})
+		}
+		return api.Product{Name: []string{"ca.pem"}, Body: buf.Bytes(), Mask: 0644}, nil
+
+	case "jks":
+		var ks keystore.JKS
+		for i, cert := range certs {
+			if err := ks.AddTrustedCert(certAlias(i, cert), cert.Raw); err != nil {
+				return api.Product{}, err
+			}
+		}
+		body, err := ks.Marshal(password)
+		if err != nil {
+			return api.Product{}, err
+		}
+		return api.Product{Name: []string{"truststore.jks"}, Body: body, Mask: 0644}, nil
+
+	case "p12":
+		body, err := pkcs12.EncodeTrustStore(rand.Reader, certs, password)
+		if err != nil {
+			return api.Product{}, err
+		}
+		return api.Product{Name: []string{"truststore.p12"}, Body: body, Mask: 0644}, nil
+
+	default:
+		return api.Product{}, errors.New("producer: unknown format " + format)
+	}
+}
+
+// certAlias makes unique, readable keystore aliases.
+func certAlias(i int, cert *x509.Certificate) string {
+	name := cert.Subject.CommonName
+	if len(name) == 0 {
+		name = "ca"
+	}
+	return fmt.Sprintf("%d-%s", i, name)
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignatureFrom(cert) == nil
+}
+
+// evalX509Backends unwraps a list of backend.x509.<name> references.
+func evalX509Backends(expr hcl.Expression, ctx *hcl.EvalContext) ([]backend.X509, error) {
+	val, diags := expr.Value(ctx)
+	if len(diags) > 0 {
+		return nil, evalError(diags)
+	}
+
+	if !val.CanIterateElements() || val.Type().IsMapType() || val.Type().IsObjectType() {
+		return nil, evalError(errors.New("expected a list of backends"))
+	}
+
+	var backends []backend.X509
+	for it := val.ElementIterator(); it.Next(); {
+		_, elem := it.Element()
+		b, err := evalX509Backend(hcl.StaticExpr(elem, expr.Range()), ctx)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
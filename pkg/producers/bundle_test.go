@@ -0,0 +1,119 @@
+package producers
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"testing"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/alvelcom/berny/internal/testca"
+)
+
+// jksMAC is the keyed digest JKS ends with.
+func jksMAC(body []byte, password string) []byte {
+	h := sha1.New()
+	for _, c := range utf16.Encode([]rune(password)) {
+		binary.Write(h, binary.BigEndian, c)
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func TestTrustStoreJKS(t *testing.T) {
+	certs := []*x509.Certificate{testca.New(t, "Root").Cert, testca.New(t, "").Cert}
+
+	p, err := encodeTrustStore(certs, "jks", "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Name) != 1 || p.Name[0] != "truststore.jks" || p.Mask != 0644 {
+		t.Errorf("unexpected product %+v", p)
+	}
+
+	body, mac := p.Body[:len(p.Body)-sha1.Size], p.Body[len(p.Body)-sha1.Size:]
+	if !bytes.Equal(jksMAC(body, "changeit"), mac) {
+		t.Error("keyed MAC doesn't match the store password")
+	}
+	if bytes.Equal(jksMAC(body, "wrong"), mac) {
+		t.Error("keyed MAC matches a wrong password")
+	}
+
+	var header struct{ Magic, Version, Count uint32 }
+	binary.Read(bytes.NewReader(body), binary.BigEndian, &header)
+	if header.Magic != 0xfeedfeed || header.Version != 2 || header.Count != 2 {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	// Trusted cert entries, in order: tag, alias, date, then the certificate
+	rest := body[12:]
+	for _, expected := range []struct {
+		alias string
+		cert  *x509.Certificate
+	}{{"0-Root", certs[0]}, {"1-ca", certs[1]}} {
+		if tag := binary.BigEndian.Uint32(rest); tag != 2 {
+			t.Fatalf("expected a trusted cert entry, got tag %d", tag)
+		}
+		n := int(binary.BigEndian.Uint16(rest[4:]))
+		if alias := string(rest[6 : 6+n]); alias != expected.alias {
+			t.Errorf("expected alias %q, got %q", expected.alias, alias)
+		}
+		rest = rest[6+n+8:]
+
+		n = int(binary.BigEndian.Uint16(rest))
+		if typ := string(rest[2 : 2+n]); typ != "X.509" {
+			t.Errorf("unexpected certificate type %q", typ)
+		}
+		rest = rest[2+n:]
+		n = int(binary.BigEndian.Uint32(rest))
+		if !bytes.Equal(rest[4:4+n], expected.cert.Raw) {
+			t.Errorf("certificate of %s doesn't round trip", expected.alias)
+		}
+		rest = rest[4+n:]
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d trailing bytes", len(rest))
+	}
+}
+
+func TestTrustStorePKCS12(t *testing.T) {
+	certs := []*x509.Certificate{testca.New(t, "Root").Cert, testca.New(t, "Other").Cert}
+
+	p, err := encodeTrustStore(certs, "p12", "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := pkcs12.DecodeTrustStore(p.Body, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || !decoded[0].Equal(certs[0]) || !decoded[1].Equal(certs[1]) {
+		t.Error("certificates don't round trip")
+	}
+}
+
+func TestTrustStorePEM(t *testing.T) {
+	certs := []*x509.Certificate{testca.New(t, "Root").Cert, testca.New(t, "Other").Cert}
+
+	p, err := encodeTrustStore(certs, "pem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := p.Body
+	for _, cert := range certs {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil || !bytes.Equal(block.Bytes, cert.Raw) {
+			t.Fatal("certificates don't round trip")
+		}
+	}
+
+	if _, err := encodeTrustStore(certs, "bks", ""); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,172 @@
+package producers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl2/hcl"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/plugin"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// External runs a plugin program for Prepare and Produce, see package
+// plugin for the protocol. Attributes other than the ones below are
+// evaluated and sent to the plugin, they can't hold backends.
+type External struct {
+	Name string
+
+	Command string            `hcl:"command"`
+	Args    []string          `hcl:"args,optional"`
+	Env     map[string]string `hcl:"env,optional"`
+
+	Timeout       string `hcl:"timeout,optional"`
+	MaxOutput     int64  `hcl:"max_output,optional"`
+	MaxMemoryMB   uint64 `hcl:"max_memory_mb,optional"`
+	MaxCPUSeconds uint64 `hcl:"max_cpu_seconds,optional"`
+
+	Attributes hcl.Body `hcl:",remain"`
+}
+
+// Validate checks the command can be run and limits make sense, plugins
+// only run when machines harvest.
+func (e *External) Validate() error {
+	if _, err := exec.LookPath(e.Command); err != nil {
+		return fmt.Errorf("producer: command: %w", err)
+	}
+	_, err := e.command()
+	return err
+}
+
+func (e *External) Prepare(c *Context) (TaskRequests, error) {
+	resp, err := e.run(c, plugin.PhasePrepare)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Tasks) == 0 {
+		return nil, nil
+	}
+	tasks := make(TaskRequests)
+	for _, t := range resp.Tasks {
+		// Plugins name tasks after the producer, policy is implied
+		id := c.TaskID(e.Name, strings.Join(t.Name[1:], "/"))
+		tasks[id], err = task.FromAPI(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tasks, nil
+}
+
+func (e *External) Produce(c *Context) ([]api.Product, error) {
+	resp, err := e.run(c, plugin.PhaseProduce)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Products, nil
+}
+
+func (e *External) run(c *Context, phase string) (*plugin.Response, error) {
+	cmd, err := e.command()
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := e.evalAttributes(c.EvalContext)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &plugin.Request{
+		Phase:      phase,
+		Name:       e.Name,
+		Policy:     c.Policy,
+		Attributes: attrs,
+		Req:        plugin.Req{RequestIP: c.RequestIP},
+	}
+	if c.Machine != nil {
+		req.Req.MachineInfo = *c.Machine
+	}
+
+	// Responses are sorted, so plugins see the same request every time
+	var ids []TaskID
+	for id := range c.TaskResponses {
+		if id.Policy == c.Policy && id.Producer == e.Name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Part < ids[j].Part })
+	for _, id := range ids {
+		req.TaskResponses = append(req.TaskResponses, c.TaskResponses[id].ToAPI(id.Name()[1:]))
+	}
+
+	resp, err := plugin.Run(c.ctx(), cmd, req)
+	if err != nil {
+		return nil, fmt.Errorf("producer: external %s: %w", e.Name, err)
+	}
+	return resp, nil
+}
+
+func (e *External) command() (plugin.Command, error) {
+	cmd := plugin.Command{
+		Path:   e.Command,
+		Args:   e.Args,
+		Limits: plugin.DefaultLimits,
+	}
+
+	var names []string
+	for name := range e.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+e.Env[name])
+	}
+
+	if len(e.Timeout) > 0 {
+		timeout, err := time.ParseDuration(e.Timeout)
+		if err != nil {
+			return cmd, fmt.Errorf("producer: timeout: %w", err)
+		}
+		cmd.Limits.Timeout = timeout
+	}
+	if e.MaxOutput > 0 {
+		cmd.Limits.MaxOutput = e.MaxOutput
+	}
+	if e.MaxMemoryMB > 0 {
+		cmd.Limits.MaxMemory = e.MaxMemoryMB << 20
+	}
+	if e.MaxCPUSeconds > 0 {
+		cmd.Limits.MaxCPU = e.MaxCPUSeconds
+	}
+	return cmd, nil
+}
+
+func (e *External) evalAttributes(ctx *hcl.EvalContext) (map[string]json.RawMessage, error) {
+	attrs, diags := e.Attributes.JustAttributes()
+	if len(diags) > 0 {
+		return nil, evalError(diags)
+	}
+
+	out := make(map[string]json.RawMessage, len(attrs))
+	for name, attr := range attrs {
+		val, diags := attr.Expr.Value(ctx)
+		if len(diags) > 0 {
+			return nil, evalError(diags)
+		}
+
+		b, err := ctyjson.Marshal(val, val.Type())
+		if err != nil {
+			return nil, evalError(fmt.Errorf("producer: %s: %w", name, err))
+		}
+		out[name] = b
+	}
+	return out, nil
+}
@@ -0,0 +1,77 @@
+package producers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+func writeScript(t *testing.T, dir, name, src string, mode os.FileMode) string {
+	fn := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fn, []byte("#!/bin/sh\n"+src), mode); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestExternalValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plugin := writeScript(t, dir, "plugin", "exit 0\n", 0755)
+	notExecutable := writeScript(t, dir, "not-executable", "exit 0\n", 0644)
+
+	for _, v := range []struct {
+		src string
+		ok  bool
+	}{
+		{`command = "` + plugin + `"`, true},
+		{"command = \"" + plugin + "\"\ntimeout = \"5s\"", true},
+		{`command = "sh"`, true},
+		{"command = \"" + plugin + "\"\ntimeout = \"5 seconds\"", false},
+		{`command = "` + filepath.Join(dir, "missing") + `"`, false},
+		{`command = "` + notExecutable + `"`, false},
+		{`command = "no-such-berny-plugin"`, false},
+	} {
+		e := &External{Name: "plugin"}
+		decode(t, v.src, e)
+		if err := e.Validate(); (err == nil) != v.ok {
+			t.Errorf("%s: unexpected error %v", v.src, err)
+		}
+	}
+}
+
+func TestExternalCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &External{Name: "plugin"}
+	decode(t, `command = "`+writeScript(t, dir, "plugin", "sleep 60\n", 0755)+`"`, e)
+
+	// The client went away, the plugin is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	c := &Context{EvalContext: &hcl.EvalContext{}, TaskResponses: make(TaskResponses), Ctx: ctx}
+
+	start := time.Now()
+	if _, err := e.Produce(c); err == nil {
+		t.Error("expected a canceled request to fail")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("plugin ran for %v after the request was canceled", d)
+	}
+}
@@ -0,0 +1,210 @@
+package producers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/config"
+)
+
+// referrer is implemented by producers that evaluate expressions the
+// block body doesn't hold, like templates read from files.
+type referrer interface {
+	references() ([]hcl.Traversal, hcl.Diagnostics)
+}
+
+// Dependencies finds the producers of a policy each one refers to through
+// the produce variable: deps[j] lists indexes of producers ps[j] needs to
+// run after. blocks are the blocks ps were decoded from. References to
+// producers the policy doesn't have and cycles are errors.
+func Dependencies(blocks []config.Producer, ps []Producer) ([][]int, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	deps := make([][]int, len(ps))
+	for j := range ps {
+		seen := make(map[int]bool)
+		ts, moreDiags := references(blocks[j], ps[j])
+		diags = append(diags, moreDiags...)
+		for _, t := range ts {
+			if t.RootName() != "produce" {
+				continue
+			}
+
+			ks, moreDiags := resolve(blocks, t)
+			diags = append(diags, moreDiags...)
+			for _, k := range ks {
+				if !seen[k] {
+					seen[k] = true
+					deps[j] = append(deps[j], k)
+				}
+			}
+		}
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	// Depth-first search, a producer seen again while its dependencies are
+	// walked is on a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(ps))
+	var path []int
+	var visit func(j int) hcl.Diagnostics
+	visit = func(j int) hcl.Diagnostics {
+		switch state[j] {
+		case visited:
+			return nil
+		case visiting:
+			var names []string
+			for i := len(path) - 1; i >= 0 && path[i] != j; i-- {
+				names = append([]string{blockName(blocks[path[i]])}, names...)
+			}
+			names = append(append([]string{blockName(blocks[j])}, names...), blockName(blocks[j]))
+			return hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Producer dependency cycle",
+				Detail:   strings.Join(names, " -> "),
+				Subject:  blocks[j].Config.MissingItemRange().Ptr(),
+			}}
+		}
+
+		state[j] = visiting
+		path = append(path, j)
+		for _, k := range deps[j] {
+			if diags := visit(k); diags.HasErrors() {
+				return diags
+			}
+		}
+		path = path[:len(path)-1]
+		state[j] = visited
+		return nil
+	}
+	for j := range ps {
+		if diags := visit(j); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	return deps, nil
+}
+
+// references lists traversals of every expression of a producer block.
+func references(block config.Producer, p Producer) ([]hcl.Traversal, hcl.Diagnostics) {
+	var attrs []*hcl.Attribute
+	schema, _ := gohcl.ImpliedBodySchema(p)
+	content, remain, _ := block.Config.PartialContent(schema)
+	for _, attr := range content.Attributes {
+		attrs = append(attrs, attr)
+	}
+	// Remaining attributes are evaluated by producers like external
+	if rest, diags := remain.JustAttributes(); !diags.HasErrors() {
+		for _, attr := range rest {
+			attrs = append(attrs, attr)
+		}
+	}
+
+	sort.Slice(attrs, func(a, b int) bool {
+		return attrs[a].Range.Start.Byte < attrs[b].Range.Start.Byte
+	})
+
+	var ts []hcl.Traversal
+	for _, attr := range attrs {
+		ts = append(ts, attr.Expr.Variables()...)
+	}
+	if r, ok := p.(referrer); ok {
+		more, diags := r.references()
+		for _, d := range diags {
+			if d.Subject == nil {
+				d.Subject = block.Config.MissingItemRange().Ptr()
+			}
+		}
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		ts = append(ts, more...)
+	}
+	return ts, nil
+}
+
+// resolve finds producers a traversal of produce refers to, all of them
+// for produce itself, all of a type for produce.<type>.
+func resolve(blocks []config.Producer, t hcl.Traversal) ([]int, hcl.Diagnostics) {
+	var names []string
+	for _, step := range t[1:] {
+		name, ok := stepName(step)
+		if !ok || len(names) == 2 {
+			break
+		}
+		names = append(names, name)
+	}
+
+	var ks []int
+	for k, b := range blocks {
+		if len(names) > 0 && b.Type != names[0] {
+			continue
+		}
+		if len(names) > 1 && b.Name != names[1] {
+			continue
+		}
+		ks = append(ks, k)
+	}
+
+	if len(ks) == 0 && len(names) == 2 {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Unknown producer",
+			Detail:   fmt.Sprintf("The policy has no produce %s %q.", names[0], names[1]),
+			Subject:  t.SourceRange().Ptr(),
+		}}
+	}
+	return ks, nil
+}
+
+// stepName is the name an attribute or a literal index step refers to.
+func stepName(step hcl.Traverser) (string, bool) {
+	switch s := step.(type) {
+	case hcl.TraverseAttr:
+		return s.Name, true
+	case hcl.TraverseIndex:
+		if s.Key.Type() == cty.String && s.Key.IsKnown() && !s.Key.IsNull() {
+			return s.Key.AsString(), true
+		}
+	}
+	return "", false
+}
+
+func blockName(b config.Producer) string {
+	return fmt.Sprintf("produce %s %q", b.Type, b.Name)
+}
+
+// references of a template read from a file are taken when config is
+// loaded, the file is read again on every Produce. A source that can't be
+// read or parsed is an error: its references would go unnoticed.
+func (t *Template) references() ([]hcl.Traversal, hcl.Diagnostics) {
+	if len(t.Source) == 0 {
+		return nil, nil
+	}
+
+	src, err := ioutil.ReadFile(t.Source)
+	if err != nil {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Can't read template source",
+			Detail:   err.Error(),
+		}}
+	}
+	expr, diags := hclsyntax.ParseTemplate(src, t.Source, hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return expr.Variables(), nil
+}
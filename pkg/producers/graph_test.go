@@ -0,0 +1,189 @@
+package producers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+
+	"github.com/alvelcom/berny/pkg/config"
+)
+
+// dependencies decodes produce blocks from src and finds their
+// dependencies.
+func dependencies(t *testing.T, src string) ([][]int, hcl.Diagnostics) {
+	f, diags := hclsyntax.ParseConfig([]byte(src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	var body struct {
+		Produce []config.Producer `hcl:"produce,block"`
+	}
+	if diags := gohcl.DecodeBody(f.Body, nil, &body); diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	var ps []Producer
+	for _, block := range body.Produce {
+		p, err := New(block, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+	return Dependencies(body.Produce, ps)
+}
+
+func TestDependencies(t *testing.T) {
+	deps, diags := dependencies(t, `
+produce x509 "ca" {
+  backend     = backend.x509.main
+  common_name = "ca"
+}
+produce file "chain" {
+  content = "${produce.x509.ca.cert}${produce.file["intro"].content}"
+}
+produce file "intro" {
+  content = "hi ${req.fqdn}"
+}
+produce x509 "web" {
+  backend     = backend.x509.main
+  common_name = req.fqdn
+  alt_dns     = [produce.x509.ca.cert, produce.x509["ca"].chain]
+}
+produce file "certs" {
+  content = join(",", keys(produce.x509))
+}
+produce file "readme" {
+  content = products[0].name
+}
+`)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	// Producers referred to, in the order they are first referred to,
+	// whatever their order in the policy
+	want := "[[] [0 2] [] [0] [0 3] []]"
+	if got := fmt.Sprint(deps); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestDependencyErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, src string
+		summary   string
+		detail    string
+	}{
+		{"unknown producer", `
+produce file "a" {
+  content = produce.file.b.content
+}
+`, "Unknown producer", `The policy has no produce file "b".`},
+		{"unknown type", `
+produce file "a" {
+  content = "x"
+}
+produce file "b" {
+  content = produce.x509["a"].cert
+}
+`, "Unknown producer", `The policy has no produce x509 "a".`},
+		{"cycle", `
+produce file "a" {
+  content = produce.file.b.content
+}
+produce file "b" {
+  content = produce.file.c.content
+}
+produce file "c" {
+  content = upper(produce.file.b.content)
+}
+`, "Producer dependency cycle", `produce file "b" -> produce file "c" -> produce file "b"`},
+		{"self", `
+produce file "a" {
+  content = produce.file.a.content
+}
+`, "Producer dependency cycle", `produce file "a" -> produce file "a"`},
+		// Every producer of a type includes this one
+		{"whole type", `
+produce file "a" {
+  content = "x"
+}
+produce file "b" {
+  content = join(",", keys(produce.file))
+}
+`, "Producer dependency cycle", `produce file "b" -> produce file "b"`},
+	} {
+		deps, diags := dependencies(t, c.src)
+		if !diags.HasErrors() {
+			t.Errorf("%s: expected an error, got %v", c.name, deps)
+			continue
+		}
+		d := diags[0]
+		if d.Summary != c.summary || d.Detail != c.detail || d.Subject == nil {
+			t.Errorf("%s: unexpected diagnostic %s: %s", c.name, d.Summary, d.Detail)
+		}
+		if !strings.HasPrefix(d.Subject.Filename, "test.hcl") {
+			t.Errorf("%s: diagnostic points at %v", c.name, d.Subject)
+		}
+	}
+}
+
+func TestTemplateSourceDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	good := write("good.tmpl", "${produce.file.b.content}")
+	bad := write("bad.tmpl", "${produce.file.b.content")
+
+	deps, diags := dependencies(t, fmt.Sprintf(`
+produce template "a" {
+  source = %q
+}
+produce file "b" {
+  content = "x"
+}
+`, good))
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if got := fmt.Sprint(deps); got != "[[1] []]" {
+		t.Errorf("expected references of the source file, got %s", got)
+	}
+
+	// Their references would go unnoticed, so sources that can't be read
+	// fail config loading
+	for _, source := range []string{bad, filepath.Join(dir, "missing.tmpl")} {
+		deps, diags := dependencies(t, fmt.Sprintf(`
+produce template "a" {
+  source = %q
+}
+produce file "b" {
+  content = "x"
+}
+`, source))
+		if !diags.HasErrors() {
+			t.Errorf("%s: expected an error, got %v", source, deps)
+			continue
+		}
+		if diags[0].Subject == nil {
+			t.Errorf("%s: diagnostic points nowhere: %s", source, diags[0].Summary)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package producers
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/inventory"
+)
+
+// Serial numbers are random, RFC 5280 allows up to 20 octets
+var serialLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// issueX509 signs a certificate with a fresh serial number and records it
+// in the inventory. A certificate that can't be recorded isn't given out.
+func (c *Context) issueX509(producer string, b backend.X509, template *x509.Certificate) ([]byte, [][]byte, error) {
+	if template.NotAfter.IsZero() {
+		return nil, nil, errors.New("producer: certificate has no validity window")
+	}
+
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+
+	der, chain, err := b.Sign(template)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.Inventory == nil {
+		return der, chain, nil
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sans := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	err = c.record(inventory.Certificate{
+		Kind:     "x509",
+		Serial:   fmt.Sprintf("%x", cert.SerialNumber),
+		Issuer:   cert.Issuer.String(),
+		Subject:  cert.Subject.String(),
+		SANs:     sans,
+		NotAfter: cert.NotAfter,
+	}, producer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, chain, nil
+}
+
+// issued checks that the inventory has cert recorded as issued by
+// producer for this policy. Without an inventory there's nothing to check.
+func (c *Context) issued(producer string, cert *x509.Certificate) error {
+	if c.Inventory == nil {
+		return nil
+	}
+
+	certs, err := c.Inventory.Certificates(inventory.Query{
+		Serial: fmt.Sprintf("%x", cert.SerialNumber),
+		Policy: c.Policy,
+	})
+	if err != nil {
+		return err
+	}
+	for _, issued := range certs {
+		if issued.Kind == "x509" && issued.Policy == c.Policy && issued.Producer == producer {
+			return nil
+		}
+	}
+	return errors.New("certificate wasn't issued by this producer")
+}
+
+// recordSSH records a signed SSH certificate in the inventory.
+func (c *Context) recordSSH(producer string, cert *ssh.Certificate) error {
+	if c.Inventory == nil {
+		return nil
+	}
+
+	var notAfter time.Time
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		notAfter = time.Unix(int64(cert.ValidBefore), 0)
+	}
+
+	return c.record(inventory.Certificate{
+		Kind:     "ssh",
+		Serial:   fmt.Sprintf("%x", cert.Serial),
+		Subject:  cert.KeyId,
+		SANs:     cert.ValidPrincipals,
+		NotAfter: notAfter,
+	}, producer)
+}
+
+func (c *Context) record(cert inventory.Certificate, producer string) error {
+	cert.IssuedAt = time.Now()
+	cert.Policy = c.Policy
+	cert.Producer = producer
+	cert.RequestIP = c.RequestIP
+	if c.Machine != nil {
+		cert.Machine = *c.Machine
+	}
+	return c.Inventory.AddCertificate(cert)
+}
@@ -0,0 +1,101 @@
+package producers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/inventory"
+)
+
+func TestSetValidity(t *testing.T) {
+	var tmpl x509.Certificate
+	if err := setValidity(&tmpl, ""); err != nil {
+		t.Fatal(err)
+	}
+	if d := tmpl.NotAfter.Sub(time.Now()); d < defaultX509Validity-time.Minute || d > defaultX509Validity {
+		t.Errorf("unexpected default validity %v", d)
+	}
+	if !tmpl.NotBefore.Before(time.Now()) {
+		t.Error("certificate isn't backdated")
+	}
+
+	if err := setValidity(&tmpl, "24h"); err != nil {
+		t.Fatal(err)
+	}
+	if d := tmpl.NotAfter.Sub(time.Now()); d < 23*time.Hour || d > 24*time.Hour {
+		t.Errorf("unexpected validity %v", d)
+	}
+
+	for _, bad := range []string{"a week", "-1h", "0s"} {
+		if err := setValidity(&tmpl, bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestIssueX509(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-producers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inv, err := inventory.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inv.Close()
+
+	c := &Context{
+		Inventory: inv,
+		Policy:    "web",
+		Machine:   &api.MachineInfo{FQDN: "web-1.example.com"},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBackend(t)
+
+	// Every certificate has a validity window
+	noValidity := &x509.Certificate{Subject: pkix.Name{CommonName: "web-1"}, PublicKey: &key.PublicKey}
+	if _, _, err := c.issueX509("tls", b, noValidity); err == nil {
+		t.Error("expected a certificate without validity to fail")
+	}
+
+	tmpl := &x509.Certificate{Subject: pkix.Name{CommonName: "web-1"}, PublicKey: &key.PublicKey}
+	if err := setValidity(tmpl, "48h"); err != nil {
+		t.Fatal(err)
+	}
+	der, _, err := c.issueX509("tls", b, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := inv.Certificates(inventory.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Policy != "web" || certs[0].Producer != "tls" ||
+		!certs[0].NotAfter.Equal(cert.NotAfter) {
+		t.Fatalf("unexpected records %+v", certs)
+	}
+
+	if expiring, _ := inv.Certificates(inventory.Query{ExpiresBefore: time.Now().Add(24 * time.Hour)}); len(expiring) != 0 {
+		t.Errorf("a certificate valid for two days expires within a day: %+v", expiring)
+	}
+	if expiring, _ := inv.Certificates(inventory.Query{ExpiresBefore: time.Now().Add(72 * time.Hour)}); len(expiring) != 1 {
+		t.Errorf("a certificate valid for two days doesn't expire within three: %+v", expiring)
+	}
+}
@@ -0,0 +1,175 @@
+package producers
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+var (
+	defaultKubeCommonName = mustParseExpression(
+		`"system:node:${lower(req.host != "" ? req.host : hostname(req.fqdn))}"`)
+	defaultKubeOrganization = mustParseExpression(`["system:nodes"]`)
+)
+
+// Kubeconfig issues a client certificate, like x509 does, and wraps it
+// into a kubeconfig together with the CA chain and the API server URL.
+// The private key never leaves the client, so the kubeconfig always refers
+// to it as key.pem next to itself; certificates are either embedded or
+// referred to the same way.
+type Kubeconfig struct {
+	Name string
+
+	Backend      hcl.Expression `hcl:"backend"`
+	Server       hcl.Expression `hcl:"server"`
+	CommonName   hcl.Expression `hcl:"common_name,optional"`
+	Organization hcl.Expression `hcl:"organization,optional"`
+	Cluster      string         `hcl:"cluster,optional"`
+	Embed        bool           `hcl:"embed,optional"`
+	Validity     string         `hcl:"validity,optional"`
+}
+
+// DryRun allows asking for the key, the client certificate is signed in
+// Produce.
+func (k *Kubeconfig) DryRun() (prepare, produce bool) {
+	return true, false
+}
+
+func (k *Kubeconfig) Prepare(c *Context) (TaskRequests, error) {
+	_, ok := c.TaskResponses[c.TaskID(k.Name, "")]
+	if ok {
+		return nil, nil
+	}
+
+	return TaskRequests{
+		c.TaskID(k.Name, ""): &task.ECDSAKey{
+			Curve: "P-521",
+			Template: api.Product{
+				Name: []string{k.Name, "key.pem"},
+				Mask: 0600,
+			},
+		},
+	}, nil
+}
+
+func (k *Kubeconfig) Produce(c *Context) ([]api.Product, error) {
+	ecdsaKeyResp, err := ecdsaKeyResponse(c, c.TaskID(k.Name, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := evalX509Backend(k.Backend, c.EvalContext)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := evalString(k.Server, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: server: %w", err)
+	}
+
+	commonName, err := evalString(orDefault(k.CommonName, defaultKubeCommonName), c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: common_name: %w", err)
+	}
+
+	organization, err := evalStringList(orDefault(k.Organization, defaultKubeOrganization), c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: organization: %w", err)
+	}
+
+	publicKey := ecdsaKeyResp.PublicKey()
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: organization,
+		},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		PublicKey:   &publicKey,
+	}
+	if err := setValidity(template, k.Validity); err != nil {
+		return nil, err
+	}
+	pemCert, pemChain, err := signPEM(c, k.Name, b, template)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := k.Cluster
+	if len(cluster) == 0 {
+		cluster = "default"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "apiVersion: v1\nkind: Config\n")
+	fmt.Fprintf(&buf, "clusters:\n- name: %s\n  cluster:\n    server: %s\n", yamlString(cluster), yamlString(server))
+	if k.Embed {
+		fmt.Fprintf(&buf, "    certificate-authority-data: %s\n", base64.StdEncoding.EncodeToString(pemChain))
+	} else {
+		fmt.Fprintf(&buf, "    certificate-authority: ca.pem\n")
+	}
+	fmt.Fprintf(&buf, "users:\n- name: %s\n  user:\n", yamlString(commonName))
+	if k.Embed {
+		fmt.Fprintf(&buf, "    client-certificate-data: %s\n", base64.StdEncoding.EncodeToString(pemCert))
+	} else {
+		fmt.Fprintf(&buf, "    client-certificate: cert.pem\n")
+	}
+	fmt.Fprintf(&buf, "    client-key: key.pem\n")
+	fmt.Fprintf(&buf, "contexts:\n- name: %s\n  context:\n    cluster: %s\n    user: %s\n",
+		yamlString(cluster), yamlString(cluster), yamlString(commonName))
+	fmt.Fprintf(&buf, "current-context: %s\n", yamlString(cluster))
+
+	ps := []api.Product{{
+		Name: []string{k.Name, "kubeconfig"},
+		Body: buf.Bytes(),
+		Mask: 0600,
+	}}
+	if !k.Embed {
+		ps = append(ps, api.Product{
+			Name: []string{k.Name, "cert.pem"},
+			Body: pemCert,
+			Mask: 0644,
+		}, api.Product{
+			Name: []string{k.Name, "ca.pem"},
+			Body: pemChain,
+			Mask: 0644,
+		})
+	}
+	return ps, nil
+}
+
+// yamlString quotes s, JSON strings are valid YAML scalars.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// orDefault returns def when an optional attribute isn't set.
+func orDefault(expr, def hcl.Expression) hcl.Expression {
+	if expr == nil {
+		return def
+	}
+
+	val, diags := expr.Value(nil)
+	if len(diags) == 0 && val.IsNull() {
+		return def
+	}
+	return expr
+}
+
+func mustParseExpression(src string) hcl.Expression {
+	expr, diags := hclsyntax.ParseExpression([]byte(src), "<default>", hcl.Pos{Line: 1, Column: 1})
+	if len(diags) > 0 {
+		panic(diags.Error())
+	}
+	return expr
+}
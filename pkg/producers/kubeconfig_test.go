@@ -0,0 +1,242 @@
+package producers
+
+import (
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v2"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/functions"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// testBackend signs with an in-memory CA, it's only good for Sign and CA.
+type testBackend struct {
+	backend.X509
+	ca *testca.CA
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	return &testBackend{ca: testca.New(t, "CA")}
+}
+
+func (b *testBackend) Sign(template *x509.Certificate) ([]byte, [][]byte, error) {
+	return b.ca.Sign(template)
+}
+
+func (b *testBackend) CA() ([][]byte, error) {
+	return [][]byte{b.ca.Cert.Raw}, nil
+}
+
+// kubeconfig is the part of a kubeconfig kubectl reads.
+type kubeconfig struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Clusters   []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server string `yaml:"server"`
+			CA     string `yaml:"certificate-authority"`
+			CAData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Cert     string `yaml:"client-certificate"`
+			CertData string `yaml:"client-certificate-data"`
+			Key      string `yaml:"client-key"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	CurrentContext string `yaml:"current-context"`
+}
+
+// kubeContext has backend.x509.ca and a response with the client's key
+// to the task of producer "kubelet".
+func kubeContext(t *testing.T, b backend.X509, host string) *Context {
+	ptr := &b
+	key := testca.NewKey(t, elliptic.P521())
+	c := &Context{
+		Policy:  "node",
+		Machine: &api.MachineInfo{FQDN: "Node-1.example.com"},
+		EvalContext: &hcl.EvalContext{
+			Variables: map[string]cty.Value{
+				"req": cty.ObjectVal(map[string]cty.Value{
+					"fqdn": cty.StringVal("Node-1.example.com"),
+					"host": cty.StringVal(host),
+				}),
+				"backend": cty.ObjectVal(map[string]cty.Value{
+					"x509": cty.ObjectVal(map[string]cty.Value{
+						"ca": cty.ObjectVal(map[string]cty.Value{
+							"_x509": cty.CapsuleVal(backend.X509Type, &ptr),
+						}),
+					}),
+				}),
+			},
+			Functions: functions.Library(""),
+		},
+		TaskResponses: make(TaskResponses),
+	}
+	c.TaskResponses[c.TaskID("kubelet", "")] = &task.ECDSAKeyResponse{
+		Curve: "P-521",
+		X:     key.X,
+		Y:     key.Y,
+	}
+	return c
+}
+
+func parsePEMCert(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no certificate in %q", data)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKubeconfig(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, c := range []struct {
+		name  string
+		src   string
+		host  string
+		embed bool
+
+		cluster string
+		cn      string
+		org     []string
+	}{
+		{
+			name:    "files",
+			cluster: "default",
+			cn:      "system:node:node-1",
+			org:     []string{"system:nodes"},
+		},
+		{
+			name:    "embedded",
+			src:     `embed = true`,
+			host:    "Kube-7",
+			embed:   true,
+			cluster: "default",
+			cn:      "system:node:kube-7",
+			org:     []string{"system:nodes"},
+		},
+		{
+			name: "admin",
+			src: `
+cluster      = "prod"
+common_name  = "admin"
+organization = ["system:masters"]
+`,
+			cluster: "prod",
+			cn:      "admin",
+			org:     []string{"system:masters"},
+		},
+	} {
+		p := &Kubeconfig{Name: "kubelet"}
+		decode(t, "backend = backend.x509.ca\nserver = \"https://kube.example.com:6443\"\n"+c.src, p)
+
+		ps, err := p.Produce(kubeContext(t, b, c.host))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		products := make(map[string]api.Product)
+		for _, p := range ps {
+			products[p.Name[len(p.Name)-1]] = p
+		}
+		want := []string{"kubeconfig", "cert.pem", "ca.pem"}
+		if c.embed {
+			want = want[:1]
+		}
+		if len(ps) != len(want) {
+			t.Errorf("%s: expected products %v, got %+v", c.name, want, ps)
+			continue
+		}
+		for _, name := range want {
+			if _, ok := products[name]; !ok {
+				t.Fatalf("%s: no %s among %+v", c.name, name, ps)
+			}
+		}
+		if products["kubeconfig"].Mask != 0600 {
+			t.Errorf("%s: kubeconfig is saved with mode %o", c.name, products["kubeconfig"].Mask)
+		}
+
+		var kc kubeconfig
+		if err := yaml.UnmarshalStrict(products["kubeconfig"].Body, &kc); err != nil {
+			t.Fatalf("%s: %v\n%s", c.name, err, products["kubeconfig"].Body)
+		}
+		if kc.APIVersion != "v1" || kc.Kind != "Config" {
+			t.Errorf("%s: unexpected header %s %s", c.name, kc.APIVersion, kc.Kind)
+		}
+		if len(kc.Clusters) != 1 || len(kc.Users) != 1 || len(kc.Contexts) != 1 {
+			t.Fatalf("%s: unexpected kubeconfig %+v", c.name, kc)
+		}
+		cluster, user, context := kc.Clusters[0], kc.Users[0], kc.Contexts[0]
+		if cluster.Name != c.cluster || cluster.Cluster.Server != "https://kube.example.com:6443" {
+			t.Errorf("%s: unexpected cluster %+v", c.name, cluster)
+		}
+		if user.Name != c.cn || user.User.Key != "key.pem" {
+			t.Errorf("%s: unexpected user %+v", c.name, user)
+		}
+		if context.Name != c.cluster || context.Context.Cluster != c.cluster || context.Context.User != c.cn ||
+			kc.CurrentContext != c.cluster {
+			t.Errorf("%s: unexpected context %+v, current %q", c.name, context, kc.CurrentContext)
+		}
+
+		// Certificates are either embedded or next to the kubeconfig
+		var certPEM, caPEM []byte
+		if c.embed {
+			if len(cluster.Cluster.CA) > 0 || len(user.User.Cert) > 0 {
+				t.Errorf("%s: embedded kubeconfig refers to files: %+v", c.name, kc)
+			}
+			if certPEM, err = base64.StdEncoding.DecodeString(user.User.CertData); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if caPEM, err = base64.StdEncoding.DecodeString(cluster.Cluster.CAData); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		} else {
+			if cluster.Cluster.CA != "ca.pem" || user.User.Cert != "cert.pem" ||
+				len(cluster.Cluster.CAData) > 0 || len(user.User.CertData) > 0 {
+				t.Errorf("%s: unexpected file references %+v", c.name, kc)
+			}
+			certPEM, caPEM = products["cert.pem"].Body, products["ca.pem"].Body
+		}
+
+		cert, ca := parsePEMCert(t, certPEM), parsePEMCert(t, caPEM)
+		if !ca.Equal(b.ca.Cert) {
+			t.Errorf("%s: kubeconfig has another CA", c.name)
+		}
+		if cert.Subject.CommonName != c.cn || !reflect.DeepEqual(cert.Subject.Organization, c.org) {
+			t.Errorf("%s: unexpected subject %v", c.name, cert.Subject)
+		}
+
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+			t.Errorf("%s: unexpected key usages %v", c.name, cert.ExtKeyUsage)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package producers
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"path"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// Outputter is implemented by producers that tell other producers of the
+// policy about what they make, as produce.<type>.<name>.<output>. Paths
+// are absolute if the client told where it saves products, like berny
+// does, and relative to that directory otherwise. products is nil until
+// Produce ran, outputs that come from products are unknown then.
+type Outputter interface {
+	Outputs(c *Context, products []api.Product) map[string]cty.Value
+}
+
+// Outputs are the outputs of p as an object. Producers that don't
+// implement Outputter have paths: a map of product names to paths.
+func Outputs(p Producer, c *Context, products []api.Product) cty.Value {
+	if o, ok := p.(Outputter); ok {
+		return cty.ObjectVal(o.Outputs(c, products))
+	}
+
+	if products == nil {
+		return cty.ObjectVal(map[string]cty.Value{"paths": cty.UnknownVal(cty.Map(cty.String))})
+	}
+	paths := make(map[string]cty.Value)
+	for _, product := range products {
+		name := path.Join(product.Name...)
+		paths[name] = c.productPath(name)
+	}
+	if len(paths) == 0 {
+		return cty.ObjectVal(map[string]cty.Value{"paths": cty.MapValEmpty(cty.String)})
+	}
+	return cty.ObjectVal(map[string]cty.Value{"paths": cty.MapVal(paths)})
+}
+
+// productPath is where the client saves a product of the current policy.
+func (c *Context) productPath(name ...string) cty.Value {
+	return cty.StringVal(path.Join(c.Dir, c.Policy, path.Join(name...)))
+}
+
+// productBody is the body of a product, unknown until it's produced.
+func productBody(products []api.Product, name ...string) cty.Value {
+	if products == nil {
+		return cty.UnknownVal(cty.String)
+	}
+	for _, p := range products {
+		if strings.Join(p.Name, "/") == strings.Join(name, "/") {
+			return cty.StringVal(string(p.Body))
+		}
+	}
+	return cty.NullVal(cty.String)
+}
+
+// ecdsaPublicKey is the PEM encoded key of an ECDSAKey task, unknown until
+// the client responds.
+func ecdsaPublicKey(c *Context, id TaskID) cty.Value {
+	resp, err := ecdsaKeyResponse(c, id)
+	if err != nil {
+		return cty.UnknownVal(cty.String)
+	}
+
+	pub := resp.PublicKey()
+	der, err := x509.MarshalPKIXPublicKey(&pub)
+	if err != nil {
+		return cty.UnknownVal(cty.String)
+	}
+	return cty.StringVal(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+}
+
+func (p *PKI) Outputs(c *Context, products []api.Product) map[string]cty.Value {
+	out := map[string]cty.Value{
+		"key_path":       c.productPath(p.Name, "key.pem"),
+		"cert_path":      c.productPath(p.Name, "cert.pem"),
+		"chain_path":     c.productPath(p.Name, "chain.pem"),
+		"fullchain_path": c.productPath(p.Name, "fullchain.pem"),
+		"public_key":     ecdsaPublicKey(c, c.TaskID(p.Name, "")),
+		"cert":           productBody(products, p.Name, "cert.pem"),
+		"chain":          productBody(products, p.Name, "chain.pem"),
+	}
+	for _, format := range p.OutputFormats {
+		out["keystore_"+format+"_path"] = c.productPath(p.Name, "keystore."+format)
+	}
+	return out
+}
+
+func (s *SSHCert) Outputs(c *Context, products []api.Product) map[string]cty.Value {
+	publicKey := cty.UnknownVal(cty.String)
+	if resp, ok := c.TaskResponses[c.TaskID(s.Name, "")].(*task.SSHPublicKeyResponse); ok {
+		publicKey = cty.StringVal(resp.AuthorizedKey)
+	}
+
+	out := map[string]cty.Value{
+		"cert_path":  c.productPath(s.Name, "cert.pub"),
+		"cert":       productBody(products, s.Name, "cert.pub"),
+		"public_key": publicKey,
+	}
+	if len(s.PublicKey) == 0 {
+		// The key is generated by the client, not its own
+		out["key_path"] = c.productPath(s.Name, "key")
+	}
+	return out
+}
+
+func (k *Kubeconfig) Outputs(c *Context, products []api.Product) map[string]cty.Value {
+	out := map[string]cty.Value{
+		"kubeconfig_path": c.productPath(k.Name, "kubeconfig"),
+		"key_path":        c.productPath(k.Name, "key.pem"),
+	}
+	if !k.Embed {
+		out["cert_path"] = c.productPath(k.Name, "cert.pem")
+		out["ca_path"] = c.productPath(k.Name, "ca.pem")
+	}
+	return out
+}
+
+func (f *File) Outputs(c *Context, products []api.Product) map[string]cty.Value {
+	return map[string]cty.Value{
+		"path":    c.productPath(f.Name),
+		"content": productBody(products, f.Name),
+	}
+}
+
+func (t *Template) Outputs(c *Context, products []api.Product) map[string]cty.Value {
+	return map[string]cty.Value{
+		"path":    c.productPath(t.Name),
+		"content": productBody(products, t.Name),
+	}
+}
+
+// Outputs of a derived secret leave the secret out, the backend derives
+// it for whoever needs it.
+func (d *DerivedSecret) Outputs(c *Context, products []api.Product) map[string]cty.Value {
+	return map[string]cty.Value{
+		"path": c.productPath(d.Name),
+	}
+}
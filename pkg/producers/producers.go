@@ -2,55 +2,131 @@ package producers
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"math/big"
 	"net"
+	"time"
 
 	"github.com/hashicorp/hcl2/gohcl"
 	"github.com/hashicorp/hcl2/hcl"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/gocty"
 
 	"github.com/alvelcom/berny/pkg/api"
 	"github.com/alvelcom/berny/pkg/backend"
 	"github.com/alvelcom/berny/pkg/config"
+	"github.com/alvelcom/berny/pkg/inventory"
 	"github.com/alvelcom/berny/pkg/task"
 )
 
 var ErrBadProducerType = errors.New("producers: bad type")
 
+// EvalError is an attribute that doesn't evaluate for a request, or
+// evaluates to the wrong type. Asking again fails the same way, unlike
+// backends and plugins failing.
+type EvalError struct {
+	Err error
+}
+
+func (e *EvalError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+func evalError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &EvalError{Err: err}
+}
+
 type Context struct {
 	Backends      *backend.Map
 	TaskResponses TaskResponses
 	EvalContext   *hcl.EvalContext
+
+	// Products are the ones already produced by the current policy, they
+	// are available to templates as the products variable.
+	Products []api.Product
+
+	// Inventory, when set, records every certificate issued to Machine
+	Inventory inventory.Store
+	Policy    string
+	Machine   *api.MachineInfo
+	RequestIP string
+
+	// Ctx is the harvest request's, producers that wait on something give
+	// up once it's done. Nil means context.Background().
+	Ctx context.Context
+
+	// Dir is where the client saves products, if it told
+	Dir string
 }
 
-type TaskRequests map[[4]string]task.Task
-type TaskResponses map[[4]string]task.Response
+func (c *Context) ctx() context.Context {
+	if c.Ctx == nil {
+		return context.Background()
+	}
+	return c.Ctx
+}
+
+type TaskRequests map[TaskID]task.Task
+type TaskResponses map[TaskID]task.Response
 
 type Producer interface {
 	Prepare(c *Context) (TaskRequests, error)
 	Produce(c *Context) ([]api.Product, error)
 }
 
-func New(c config.Producer) (Producer, error) {
-	var p Producer
-	switch c.Type {
-	case "x509":
-		p = &PKI{Name: c.Name}
-	case "file":
-		p = &File{Name: c.Name}
-	default:
-		return nil, ErrBadProducerType
+// Validator is implemented by producers that check their configuration
+// once it's decoded, so mistakes show up when config is loaded rather
+// than on every harvest.
+type Validator interface {
+	Validate() error
+}
+
+// ProductReader is implemented by producers that read Context.Products,
+// their Produce waits for the producers before them in the policy. Others
+// run concurrently and get no products.
+type ProductReader interface {
+	ReadsProducts() bool
+}
+
+// DryRunner is implemented by producers that can run without side
+// effects: no signing, deriving secrets or running programs. Dry runs,
+// like bernyd explain, only call the phases it allows, producers that
+// don't implement it aren't run at all.
+type DryRunner interface {
+	DryRun() (prepare, produce bool)
+}
+
+func New(c config.Producer, ctx *hcl.EvalContext) (Producer, error) {
+	new, err := lookup(c.Type)
+	if err != nil {
+		return nil, err
 	}
 
-	diags := gohcl.DecodeBody(c.Config, nil, p)
+	p := new(c.Name)
+	diags := gohcl.DecodeBody(c.Config, ctx, p)
 	if len(diags) > 0 {
 		return nil, diags
 	}
+
+	if v, ok := p.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
 	return p, nil
 }
 
@@ -62,19 +138,71 @@ type PKI struct {
 	CommonName hcl.Expression `hcl:"common_name"`
 	AltDNS     hcl.Expression `hcl:"alt_dns,optional"`
 	AltIPs     hcl.Expression `hcl:"alt_ips,optional"`
+	Validity   string         `hcl:"validity,optional"`
+
+	// ExtKeyUsage lists server_auth, client_auth and friends, the
+	// certificate is good for any use if it's empty
+	ExtKeyUsage []string `hcl:"ext_key_usage,optional"`
+
+	// OutputFormats are keystores (p12, jks) assembled on the client, as
+	// the private key never leaves it. KeystorePassword is either a string
+	// or a derived secret: {backend = backend.secret.x, context = "..."}.
+	OutputFormats    []string       `hcl:"output_formats,optional"`
+	KeystorePassword hcl.Expression `hcl:"keystore_password,optional"`
+}
+
+func (p *PKI) Validate() error {
+	for _, format := range p.OutputFormats {
+		if format != "p12" && format != "jks" {
+			return errors.New("producer: output_formats: unknown format " + format)
+		}
+	}
+	return nil
+}
+
+// DryRun allows asking for the key, certificates are signed in Produce.
+func (p *PKI) DryRun() (prepare, produce bool) {
+	return true, false
 }
 
 func (p *PKI) Prepare(c *Context) (TaskRequests, error) {
-	_, ok := c.TaskResponses[[4]string{p.Name}]
-	if ok {
+	_, ok := c.TaskResponses[c.TaskID(p.Name, "")]
+	if !ok {
+		return TaskRequests{
+			c.TaskID(p.Name, ""): &task.ECDSAKey{
+				Curve: "P-521",
+				Template: api.Product{
+					Name: []string{p.Name, "key.pem"},
+					Mask: 0600,
+				},
+			},
+		}, nil
+	}
+
+	_, ok = c.TaskResponses[c.TaskID(p.Name, "keystore")]
+	if len(p.OutputFormats) == 0 || ok {
 		return nil, nil
 	}
 
+	password, err := evalKeystorePassword(p.KeystorePassword, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: keystore_password: %w", err)
+	}
+
+	cert, chain, err := p.sign(c)
+	if err != nil {
+		return nil, err
+	}
+
 	return TaskRequests{
-		[4]string{p.Name}: &task.ECDSAKey{
-			Curve: "P-521",
+		c.TaskID(p.Name, "keystore"): &task.Keystore{
+			Key:      []string{p.Name, "key.pem"},
+			Chain:    append([][]byte{cert}, chain...),
+			Formats:  p.OutputFormats,
+			Alias:    p.Name,
+			Password: password,
 			Template: api.Product{
-				Name: []string{p.Name, "key.pem"},
+				Name: []string{p.Name, "keystore"},
 				Mask: 0600,
 			},
 		},
@@ -82,69 +210,348 @@ func (p *PKI) Prepare(c *Context) (TaskRequests, error) {
 }
 
 func (p *PKI) Produce(c *Context) ([]api.Product, error) {
-	resp, ok := c.TaskResponses[[4]string{p.Name}]
-	if !ok {
-		return nil, errors.New("producer: no task response")
+	var cert []byte
+	var chain [][]byte
+	var err error
+	if len(p.OutputFormats) > 0 {
+		// The certificate is already in the keystore, deliver the same one
+		cert, chain, err = p.keystoreChain(c)
+	} else {
+		cert, chain, err = p.sign(c)
 	}
-
-	ecdsaKeyResp, ok := resp.(*task.ECDSAKeyResponse)
-	if !ok {
-		return nil, errors.New("producer: can't cast a task response")
+	if err != nil {
+		return nil, err
 	}
 
-	val, diags := p.Backend.Value(c.EvalContext)
-	if len(diags) > 0 {
-		return nil, diags
+	pemCert, pemChain := encodePEM(cert, chain)
+	ps := []api.Product{
+		{
+			Name: []string{p.Name, "cert.pem"},
+			Body: pemCert,
+			Mask: 0644,
+		},
+		{
+			Name: []string{p.Name, "chain.pem"},
+			Body: pemChain,
+			Mask: 0644,
+		},
+		{
+			Name: []string{p.Name, "fullchain.pem"},
+			Body: append(pemCert, pemChain...),
+			Mask: 0644,
+		},
 	}
+	return ps, nil
+}
 
-	if !val.Type().IsObjectType() || !val.Type().HasAttribute("_x509") {
-		return nil, errors.New("producer: backend is not valid")
+// sign issues a certificate for the client's key.
+func (p *PKI) sign(c *Context) ([]byte, [][]byte, error) {
+	b, err := evalX509Backend(p.Backend, c.EvalContext)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	val = val.GetAttr("_x509")
-	if !val.Type().Equals(backend.X509Type) {
-		return nil, errors.New("producer: backend is not valid")
+	template, err := p.template(c)
+	if err != nil {
+		return nil, nil, err
 	}
+	return c.issueX509(p.Name, b, template)
+}
 
-	b := **(val.EncapsulatedValue().(**backend.X509))
-
-	commonName, diags := p.CommonName.Value(c.EvalContext)
-	if len(diags) > 0 {
-		return nil, diags
+// template is the certificate the config asks for the client's key.
+func (p *PKI) template(c *Context) (*x509.Certificate, error) {
+	ecdsaKeyResp, err := ecdsaKeyResponse(c, c.TaskID(p.Name, ""))
+	if err != nil {
+		return nil, err
 	}
 
-	if !commonName.Type().Equals(cty.String) {
-		return nil, errors.New("producer: common name is not a string")
+	commonName, err := evalString(p.CommonName, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: common_name: %w", err)
 	}
 
 	altDNS, err := evalStringList(p.AltDNS, c.EvalContext)
 	if err != nil {
-		return nil, errors.New("producer: alt_dns: " + err.Error())
+		return nil, fmt.Errorf("producer: alt_dns: %w", err)
 	}
 
 	altIPsStrings, err := evalStringList(p.AltIPs, c.EvalContext)
 	if err != nil {
-		return nil, errors.New("producer: alt_ips: " + err.Error())
+		return nil, fmt.Errorf("producer: alt_ips: %w", err)
 	}
 	var altIPs []net.IP
 	for _, ipString := range altIPsStrings {
 		altIPs = append(altIPs, net.ParseIP(ipString))
 	}
 
+	extKeyUsage, err := parseExtKeyUsage(p.ExtKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+
 	publicKey := ecdsaKeyResp.PublicKey()
-	cert, chain, err := b.Sign(&x509.Certificate{
+	template := &x509.Certificate{
 		Subject: pkix.Name{
-			CommonName: commonName.AsString(),
+			CommonName: commonName,
 		},
-		DNSNames:     altDNS,
-		IPAddresses:  altIPs,
-		SerialNumber: big.NewInt(1),
-		PublicKey:    &publicKey,
-	})
-	if err != nil {
+		DNSNames:    altDNS,
+		IPAddresses: altIPs,
+		ExtKeyUsage: extKeyUsage,
+		PublicKey:   &publicKey,
+	}
+	if err := setValidity(template, p.Validity); err != nil {
 		return nil, err
 	}
+	return template, nil
+}
+
+// keystoreChain takes the certificate a client put into its keystore.
+// The server keeps no state between rounds, so the certificate must be
+// signed by the backend for what the config asks now and, with an
+// inventory, be recorded as issued by this producer. The chain is the
+// backend's, not the client's.
+func (p *PKI) keystoreChain(c *Context) ([]byte, [][]byte, error) {
+	resp, ok := c.TaskResponses[c.TaskID(p.Name, "keystore")]
+	if !ok {
+		return nil, nil, errors.New("producer: no task response")
+	}
+
+	keystoreResp, ok := resp.(*task.KeystoreResponse)
+	if !ok {
+		return nil, nil, errors.New("producer: can't cast a task response")
+	}
+	if len(keystoreResp.Chain) == 0 {
+		return nil, nil, errors.New("producer: keystore: empty chain")
+	}
+
+	b, err := evalX509Backend(p.Backend, c.EvalContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := p.template(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(keystoreResp.Chain[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := matchTemplate(leaf, template); err != nil {
+		return nil, nil, fmt.Errorf("producer: keystore: %w", err)
+	}
+
+	ca, err := b.CA()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(ca) == 0 {
+		return nil, nil, errors.New("producer: backend has no CA certificate")
+	}
+
+	issuer, err := x509.ParseCertificate(ca[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := leaf.CheckSignatureFrom(issuer); err != nil {
+		return nil, nil, fmt.Errorf("producer: keystore: %w", err)
+	}
+
+	if err := c.issued(p.Name, leaf); err != nil {
+		return nil, nil, fmt.Errorf("producer: keystore: %w", err)
+	}
+
+	return leaf.Raw, ca, nil
+}
+
+// matchTemplate checks that cert is what template would be signed as: for
+// the same key, names and usages, and not valid for longer.
+func matchTemplate(cert, template *x509.Certificate) error {
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	expected := template.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.X.Cmp(expected.X) != 0 || pub.Y.Cmp(expected.Y) != 0 {
+		return errors.New("certificate doesn't match the key")
+	}
+
+	if cert.Subject.CommonName != template.Subject.CommonName ||
+		!sameStrings(cert.DNSNames, template.DNSNames) ||
+		!sameStrings(ipStrings(cert.IPAddresses), ipStrings(template.IPAddresses)) ||
+		len(cert.ExtKeyUsage) != len(template.ExtKeyUsage) {
+		return errors.New("certificate doesn't match the config")
+	}
+	for i := range cert.ExtKeyUsage {
+		if cert.ExtKeyUsage[i] != template.ExtKeyUsage[i] {
+			return errors.New("certificate doesn't match the config")
+		}
+	}
+
+	if !time.Now().Before(cert.NotAfter) || cert.NotAfter.After(template.NotAfter) {
+		return errors.New("certificate validity doesn't match the config")
+	}
+	return nil
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ipStrings(ips []net.IP) []string {
+	var ss []string
+	for _, ip := range ips {
+		ss = append(ss, ip.String())
+	}
+	return ss
+}
+
+// evalKeystorePassword gives a password string as is and derives one from
+// a {backend, context, encoding, length} object like derived_secret does.
+func evalKeystorePassword(expr hcl.Expression, ctx *hcl.EvalContext) (string, error) {
+	val, diags := orDefault(expr, defaultPasswordExpr).Value(ctx)
+	if len(diags) > 0 {
+		return "", evalError(diags)
+	}
+	if err := known(val); err != nil {
+		return "", err
+	}
+
+	if val.Type().Equals(cty.String) && !val.IsNull() {
+		return val.AsString(), nil
+	}
+
+	if !val.Type().IsObjectType() || !val.Type().HasAttribute("backend") ||
+		!val.Type().HasAttribute("context") {
+		return "", evalError(errors.New("expected a string or an object with backend and context"))
+	}
+
+	attr := func(name string) hcl.Expression {
+		if !val.Type().HasAttribute(name) {
+			return nil
+		}
+		return hcl.StaticExpr(val.GetAttr(name), expr.Range())
+	}
+
+	b, err := evalSecretBackend(attr("backend"), ctx)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := evalString(attr("context"), ctx)
+	if err != nil {
+		return "", fmt.Errorf("context: %w", err)
+	}
+
+	encoding := "alphanumeric"
+	if e := attr("encoding"); e != nil {
+		if encoding, err = evalString(e, ctx); err != nil {
+			return "", fmt.Errorf("encoding: %w", err)
+		}
+	}
+
+	length := 32
+	if val.Type().HasAttribute("length") {
+		err := gocty.FromCtyValue(val.GetAttr("length"), &length)
+		if err != nil {
+			return "", evalError(fmt.Errorf("length: %w", err))
+		}
+	}
+	if length < 1 || length > 1024 {
+		return "", evalError(errors.New("length: must be between 1 and 1024"))
+	}
+
+	r, err := b.Derive([]byte(info))
+	if err != nil {
+		return "", err
+	}
+
+	password, err := encodeSecret(r, encoding, length)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// ecdsaKeyResponse finds a response to an ECDSAKey task.
+func ecdsaKeyResponse(c *Context, id TaskID) (*task.ECDSAKeyResponse, error) {
+	resp, ok := c.TaskResponses[id]
+	if !ok {
+		return nil, errors.New("producer: no task response")
+	}
+
+	ecdsaKeyResp, ok := resp.(*task.ECDSAKeyResponse)
+	if !ok {
+		return nil, errors.New("producer: can't cast a task response")
+	}
+	return ecdsaKeyResp, nil
+}
+
+// evalX509Backend unwraps backend.x509.<name> references.
+func evalX509Backend(expr hcl.Expression, ctx *hcl.EvalContext) (backend.X509, error) {
+	val, diags := expr.Value(ctx)
+	if len(diags) > 0 {
+		return nil, evalError(diags)
+	}
+
+	if !val.Type().IsObjectType() || !val.Type().HasAttribute("_x509") {
+		return nil, evalError(errors.New("producer: backend is not valid"))
+	}
+
+	val = val.GetAttr("_x509")
+	if !val.Type().Equals(backend.X509Type) {
+		return nil, evalError(errors.New("producer: backend is not valid"))
+	}
+
+	return **(val.EncapsulatedValue().(**backend.X509)), nil
+}
+
+const defaultX509Validity = 90 * 24 * time.Hour
+
+// setValidity makes template valid for validity, a duration,
+// defaultX509Validity if empty. It's backdated a bit for clients with
+// clocks behind.
+func setValidity(template *x509.Certificate, validity string) error {
+	d := defaultX509Validity
+	if len(validity) > 0 {
+		var err error
+		d, err = time.ParseDuration(validity)
+		if err != nil {
+			return fmt.Errorf("producer: validity: %w", err)
+		}
+		if d <= 0 {
+			return errors.New("producer: validity: must be positive")
+		}
+	}
 
+	now := time.Now()
+	template.NotBefore = now.Add(-5 * time.Minute)
+	template.NotAfter = now.Add(d)
+	return nil
+}
+
+// signPEM signs a certificate and returns it with its chain, PEM encoded.
+func signPEM(c *Context, producer string, b backend.X509, template *x509.Certificate) ([]byte, []byte, error) {
+	cert, chain, err := c.issueX509(producer, b, template)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pemCert, pemChain := encodePEM(cert, chain)
+	return pemCert, pemChain, nil
+}
+
+// encodePEM encodes a certificate and its chain.
+func encodePEM(cert []byte, chain [][]byte) ([]byte, []byte) {
 	pemCert := pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: cert,
@@ -157,32 +564,43 @@ func (p *PKI) Produce(c *Context) ([]api.Product, error) {
 			Bytes: chain[i],
 		})
 	}
+	return pemCert, pemChain.Bytes()
+}
 
-	ps := []api.Product{
-		{
-			Name: []string{p.Name, "cert.pem"},
-			Body: pemCert,
-			Mask: 0644,
-		},
-		{
-			Name: []string{p.Name, "chain.pem"},
-			Body: pemChain.Bytes(),
-			Mask: 0644,
-		},
-		{
-			Name: []string{p.Name, "fullchain.pem"},
-			Body: append(pemCert, pemChain.Bytes()...),
-			Mask: 0644,
-		},
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+func parseExtKeyUsage(names []string) ([]x509.ExtKeyUsage, error) {
+	var usages []x509.ExtKeyUsage
+	for _, name := range names {
+		usage, ok := extKeyUsages[name]
+		if !ok {
+			return nil, errors.New("producer: ext_key_usage: unknown usage " + name)
+		}
+		usages = append(usages, usage)
 	}
-	return ps, nil
+	return usages, nil
 }
 
 type File struct {
 	Name string
 
-	Content string `hcl:"content,optional"`
-	From    string `hcl:"from,optional"`
+	Content hcl.Expression `hcl:"content,optional"`
+	From    string         `hcl:"from,optional"`
+}
+
+func (f *File) Validate() error {
+	return oneSource("from", isSet(f.Content), len(f.From) > 0)
+}
+
+func (f *File) DryRun() (prepare, produce bool) {
+	return true, true
 }
 
 func (f *File) Prepare(c *Context) (TaskRequests, error) {
@@ -190,9 +608,19 @@ func (f *File) Prepare(c *Context) (TaskRequests, error) {
 }
 
 func (f *File) Produce(c *Context) ([]api.Product, error) {
-	content, err := ioutil.ReadFile(f.From)
-	if err != nil {
-		return nil, err
+	var content []byte
+	if len(f.From) > 0 {
+		var err error
+		content, err = ioutil.ReadFile(f.From)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s, err := evalString(f.Content, c.EvalContext)
+		if err != nil {
+			return nil, fmt.Errorf("producer: content: %w", err)
+		}
+		content = []byte(s)
 	}
 
 	ps := []api.Product{{
@@ -204,6 +632,64 @@ func (f *File) Produce(c *Context) ([]api.Product, error) {
 	return ps, nil
 }
 
+// oneSource checks that a block has either content or the file attribute
+// source, but not both.
+func oneSource(source string, content, file bool) error {
+	switch {
+	case content && file:
+		return errors.New("producer: content and " + source + " are mutually exclusive")
+	case !content && !file:
+		return errors.New("producer: either content or " + source + " is required")
+	}
+	return nil
+}
+
+// isSet tells whether an optional expression is given, gohcl decodes
+// missing ones to a static null.
+func isSet(expr hcl.Expression) bool {
+	if expr == nil {
+		return false
+	}
+	if len(expr.Variables()) > 0 {
+		return true
+	}
+	val, diags := expr.Value(nil)
+	return diags.HasErrors() || !val.IsNull()
+}
+
+func evalString(expr hcl.Expression, ctx *hcl.EvalContext) (string, error) {
+	if expr == nil {
+		return "", evalError(errors.New("expected a string"))
+	}
+
+	val, diags := expr.Value(ctx)
+	if len(diags) > 0 {
+		return "", evalError(diags)
+	}
+
+	if err := known(val); err != nil {
+		return "", err
+	}
+
+	val, err := convert.Convert(val, cty.String)
+	if err != nil {
+		return "", evalError(err)
+	}
+	if val.IsNull() {
+		return "", evalError(errors.New("expected a string"))
+	}
+	return val.AsString(), nil
+}
+
+// known makes sure val can be read. Values that depend on something
+// that isn't known yet, like outputs of producers that haven't run, can't.
+func known(val cty.Value) error {
+	if !val.IsWhollyKnown() {
+		return evalError(errors.New("refers to values that aren't known yet"))
+	}
+	return nil
+}
+
 func evalStringList(expr hcl.Expression, ctx *hcl.EvalContext) ([]string, error) {
 	if expr == nil {
 		return nil, nil
@@ -211,9 +697,12 @@ func evalStringList(expr hcl.Expression, ctx *hcl.EvalContext) ([]string, error)
 
 	evaluated, diags := expr.Value(ctx)
 	if len(diags) > 0 {
-		return nil, diags
+		return nil, evalError(diags)
 	}
 
+	if err := known(evaluated); err != nil {
+		return nil, err
+	}
 	if evaluated.IsNull() {
 		return nil, nil
 	}
@@ -222,16 +711,19 @@ func evalStringList(expr hcl.Expression, ctx *hcl.EvalContext) ([]string, error)
 		var err error
 		evaluated, err = convertTupleToList(cty.String, evaluated)
 		if err != nil {
-			return nil, err
+			return nil, evalError(err)
 		}
 	}
 
 	if !evaluated.Type().Equals(cty.List(cty.String)) {
-		return nil, errors.New("expected a list of strings, got " + evaluated.Type().GoString())
+		return nil, evalError(errors.New("expected a list of strings, got " + evaluated.Type().GoString()))
 	}
 
 	var list []string
 	for _, value := range evaluated.AsValueSlice() {
+		if value.IsNull() {
+			return nil, evalError(errors.New("expected a list of strings, got a null"))
+		}
 		list = append(list, value.AsString())
 	}
 
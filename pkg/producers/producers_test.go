@@ -0,0 +1,188 @@
+package producers
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/inventory"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+const keystoreConfig = `
+backend        = backend.x509.ca
+common_name    = req.fqdn
+output_formats = ["p12"]
+`
+
+func TestPKIOutputFormats(t *testing.T) {
+	for _, v := range []struct {
+		formats string
+		ok      bool
+	}{
+		{`[]`, true},
+		{`["p12", "jks"]`, true},
+		{`["pem"]`, false},
+	} {
+		p := &PKI{Name: "kubelet"}
+		decode(t, "backend = backend.x509.ca\ncommon_name = req.fqdn\noutput_formats = "+v.formats, p)
+		if err := p.Validate(); (err == nil) != v.ok {
+			t.Errorf("%s: unexpected error %v", v.formats, err)
+		}
+	}
+}
+
+// keystoreRound asks p to prepare the keystore and returns the chain the
+// server wants in it.
+func keystoreRound(t *testing.T, p *PKI, c *Context) [][]byte {
+	reqs, err := p.Prepare(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, ok := reqs[c.TaskID(p.Name, "keystore")].(*task.Keystore)
+	if !ok {
+		t.Fatalf("expected a keystore task, got %+v", reqs)
+	}
+	return ks.Chain
+}
+
+func TestPKIKeystore(t *testing.T) {
+	b := newTestBackend(t)
+	c := kubeContext(t, b, "https://k8s.example.com")
+	p := &PKI{Name: "kubelet"}
+	decode(t, keystoreConfig, p)
+
+	chain := keystoreRound(t, p, c)
+	other := testca.New(t, "Other CA")
+	// Clients can't slip their own certificates into the chain
+	c.TaskResponses[c.TaskID(p.Name, "keystore")] = &task.KeystoreResponse{
+		Chain: [][]byte{chain[0], other.Cert.Raw},
+	}
+	ps, err := p.Produce(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert := parsePEMCert(t, ps[0].Body); !cert.Equal(mustParse(t, chain[0])) {
+		t.Error("delivered certificate isn't the one in the keystore")
+	}
+	if ca := parsePEMCert(t, ps[1].Body); !ca.Equal(b.ca.Cert) {
+		t.Errorf("chain isn't the backend's: %s", ca.Subject)
+	}
+}
+
+func TestPKIKeystoreForged(t *testing.T) {
+	b := newTestBackend(t)
+	c := kubeContext(t, b, "https://k8s.example.com")
+	p := &PKI{Name: "kubelet"}
+	decode(t, keystoreConfig, p)
+
+	resp, err := ecdsaKeyResponse(c, c.TaskID(p.Name, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := resp.PublicKey()
+
+	sign := func(ca *testca.CA, cn string, notAfter time.Time) []byte {
+		der, _, err := ca.Sign(&x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     notAfter,
+			PublicKey:    &pub,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	day := time.Now().Add(24 * time.Hour)
+	for _, v := range []struct {
+		name string
+		cert []byte
+	}{
+		{"another CA", sign(testca.New(t, "CA"), "Node-1.example.com", day)},
+		{"another name", sign(b.ca, "admin", day)},
+		{"longer validity", sign(b.ca, "Node-1.example.com", time.Now().Add(10*defaultX509Validity))},
+		{"expired", sign(b.ca, "Node-1.example.com", time.Now().Add(-time.Minute))},
+	} {
+		c.TaskResponses[c.TaskID(p.Name, "keystore")] = &task.KeystoreResponse{
+			Chain: [][]byte{v.cert},
+		}
+		if _, err := p.Produce(c); err == nil {
+			t.Errorf("%s: expected an error", v.name)
+		}
+	}
+
+	// Right CA, name and validity, but never given out
+	dir, err := ioutil.TempDir("", "berny-producers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c.Inventory, err = inventory.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Inventory.Close()
+
+	c.TaskResponses[c.TaskID(p.Name, "keystore")] = &task.KeystoreResponse{
+		Chain: [][]byte{sign(b.ca, "Node-1.example.com", day)},
+	}
+	if _, err := p.Produce(c); err == nil {
+		t.Error("expected a certificate missing from the inventory to fail")
+	}
+
+	delete(c.TaskResponses, c.TaskID(p.Name, "keystore"))
+	c.TaskResponses[c.TaskID(p.Name, "keystore")] = &task.KeystoreResponse{
+		Chain: keystoreRound(t, p, c),
+	}
+	if _, err := p.Produce(c); err != nil {
+		t.Errorf("issued certificate: %v", err)
+	}
+}
+
+func TestPKIUnknown(t *testing.T) {
+	b := newTestBackend(t)
+	c := kubeContext(t, b, "https://k8s.example.com")
+	// Outputs of producers that haven't run
+	c.EvalContext.Variables["later"] = cty.UnknownVal(cty.String)
+
+	for _, src := range []string{
+		"common_name = later",
+		"common_name = req.fqdn\nalt_dns = [later]",
+		"common_name = req.fqdn\nalt_ips = [\"10.0.0.1\", later]",
+		"common_name = req.fqdn\noutput_formats = [\"p12\"]\nkeystore_password = later",
+	} {
+		p := &PKI{Name: "kubelet"}
+		decode(t, "backend = backend.x509.ca\n"+src, p)
+		if _, err := ecdsaKeyResponse(c, c.TaskID(p.Name, "")); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := p.Prepare(c)
+		if err == nil {
+			_, err = p.Produce(c)
+		}
+		var eval *EvalError
+		if !errors.As(err, &eval) {
+			t.Errorf("%q: expected an evaluation error, got %v", src, err)
+		}
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
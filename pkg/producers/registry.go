@@ -0,0 +1,59 @@
+package producers
+
+import (
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alvelcom/berny/internal/registry"
+)
+
+var types = registry.New("producers")
+
+func init() {
+	Register("x509", func(name string) Producer { return &PKI{Name: name} })
+	Register("file", func(name string) Producer { return &File{Name: name} })
+	Register("template", func(name string) Producer { return &Template{Name: name} })
+	Register("kubeconfig", func(name string) Producer { return &Kubeconfig{Name: name} })
+	Register("ssh_host_cert", func(name string) Producer {
+		return &SSHCert{Name: name, CertType: ssh.HostCert}
+	})
+	Register("ssh_user_cert", func(name string) Producer {
+		return &SSHCert{Name: name, CertType: ssh.UserCert}
+	})
+	Register("derived_secret", func(name string) Producer { return &DerivedSecret{Name: name} })
+	Register("ca_bundle", func(name string) Producer { return &CABundle{Name: name} })
+	Register("external", func(name string) Producer { return &External{Name: name} })
+}
+
+// Register makes a producer type available to configs. new returns an
+// empty producer named after the block, the block body is decoded into it
+// with gohcl, so its hcl tags are the schema. Producers of a harvest run
+// concurrently, each with a Context of its own. It panics if the type is
+// taken.
+func Register(type_ string, new func(name string) Producer) {
+	types.Register(type_, new)
+}
+
+func lookup(type_ string) (func(name string) Producer, error) {
+	new, ok := types.Lookup(type_)
+	if !ok {
+		return nil, ErrBadProducerType
+	}
+	return new.(func(name string) Producer), nil
+}
+
+// Types lists registered producer types.
+func Types() []string {
+	return types.Types()
+}
+
+// Schema describes the body of a produce block of the type.
+func Schema(type_ string) (*hcl.BodySchema, error) {
+	new, err := lookup(type_)
+	if err != nil {
+		return nil, err
+	}
+	schema, _ := gohcl.ImpliedBodySchema(new(""))
+	return schema, nil
+}
@@ -0,0 +1,151 @@
+package producers
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/backend"
+)
+
+const alphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// DerivedSecret derives a secret from a secret backend's master key and
+// a context string, e.g. "${req.cluster}/etcd-token". Nothing is stored on
+// the server: the same context always gives the same secret.
+//
+// Length is in bytes of entropy for hex, base64, base64url and raw
+// encodings and in characters for alphanumeric.
+type DerivedSecret struct {
+	Name string
+
+	Backend  hcl.Expression `hcl:"backend"`
+	Context  hcl.Expression `hcl:"context"`
+	Encoding string         `hcl:"encoding,optional"`
+	Length   int            `hcl:"length,optional"`
+	Mode     string         `hcl:"mode,optional"`
+}
+
+func (d *DerivedSecret) Validate() error {
+	if d.Length < 0 || d.Length > 1024 {
+		return errors.New("producer: length: must be between 1 and 1024")
+	}
+	switch d.Encoding {
+	case "", "hex", "base64", "base64url", "raw", "alphanumeric":
+	default:
+		return errors.New("producer: encoding: unknown encoding " + d.Encoding)
+	}
+	_, err := parseMode(d.Mode, 0600)
+	return err
+}
+
+// DryRun doesn't allow deriving, secrets aren't for showing.
+func (d *DerivedSecret) DryRun() (prepare, produce bool) {
+	return true, false
+}
+
+func (d *DerivedSecret) Prepare(c *Context) (TaskRequests, error) {
+	return nil, nil
+}
+
+func (d *DerivedSecret) Produce(c *Context) ([]api.Product, error) {
+	b, err := evalSecretBackend(d.Backend, c.EvalContext)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := evalString(d.Context, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: context: %w", err)
+	}
+
+	length := d.Length
+	if length == 0 {
+		length = 32
+	}
+	if length < 0 || length > 1024 {
+		return nil, errors.New("producer: length: must be between 1 and 1024")
+	}
+
+	r, err := b.Derive([]byte(info))
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := encodeSecret(r, d.Encoding, length)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := parseMode(d.Mode, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := []api.Product{{
+		Name: []string{d.Name},
+		Body: secret,
+		Mask: mode,
+	}}
+	return ps, nil
+}
+
+func encodeSecret(r io.Reader, encoding string, length int) ([]byte, error) {
+	if encoding == "alphanumeric" {
+		// Rejection sampling keeps characters uniformly distributed
+		limit := byte(256 - 256%len(alphanumeric))
+		secret := make([]byte, 0, length)
+		buf := make([]byte, 1)
+		for len(secret) < length {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			if buf[0] < limit {
+				secret = append(secret, alphanumeric[int(buf[0])%len(alphanumeric)])
+			}
+		}
+		return secret, nil
+	}
+
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+
+	switch encoding {
+	case "", "hex":
+		return []byte(hex.EncodeToString(raw)), nil
+	case "base64":
+		return []byte(base64.StdEncoding.EncodeToString(raw)), nil
+	case "base64url":
+		return []byte(base64.RawURLEncoding.EncodeToString(raw)), nil
+	case "raw":
+		return raw, nil
+	default:
+		return nil, errors.New("producer: encoding: unknown encoding " + encoding)
+	}
+}
+
+// evalSecretBackend unwraps backend.secret.<name> references.
+func evalSecretBackend(expr hcl.Expression, ctx *hcl.EvalContext) (backend.Secret, error) {
+	val, diags := expr.Value(ctx)
+	if len(diags) > 0 {
+		return nil, evalError(diags)
+	}
+
+	if !val.Type().IsObjectType() || !val.Type().HasAttribute("_secret") {
+		return nil, evalError(errors.New("producer: backend is not valid"))
+	}
+
+	val = val.GetAttr("_secret")
+	if !val.Type().Equals(backend.SecretType) {
+		return nil, evalError(errors.New("producer: backend is not valid"))
+	}
+
+	return **(val.EncapsulatedValue().(**backend.Secret)), nil
+}
@@ -0,0 +1,115 @@
+package producers
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/backend"
+)
+
+// zeroSecret derives zeros, whatever the info
+type zeroSecret struct{}
+
+func (zeroSecret) Derive(info []byte) (io.Reader, error) {
+	return bytes.NewReader(make([]byte, 1024)), nil
+}
+
+func secretContext() *Context {
+	var s backend.Secret = zeroSecret{}
+	ptr := &s
+	return &Context{EvalContext: &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"backend": cty.ObjectVal(map[string]cty.Value{
+				"secret": cty.ObjectVal(map[string]cty.Value{
+					"main": cty.ObjectVal(map[string]cty.Value{
+						"_secret": cty.CapsuleVal(backend.SecretType, &ptr),
+					}),
+				}),
+			}),
+		},
+	}}
+}
+
+func TestDerivedSecretMode(t *testing.T) {
+	for _, m := range []struct {
+		src  string
+		mask int
+		ok   bool
+	}{
+		{``, 0600, true},
+		{`mode = "0640"`, 0640, true},
+		{`mode = 0440`, 0440, true},
+		{`mode = 400`, 0400, true},
+		{`mode = 1204`, 0, false},
+		{`mode = "0888"`, 0, false},
+		{`mode = "-600"`, 0, false},
+	} {
+		d := &DerivedSecret{Name: "token"}
+		decode(t, "backend = backend.secret.main\ncontext = \"etcd\"\nencoding = \"hex\"\nlength = 4\n"+m.src, d)
+
+		// Bad modes fail config loading, not harvests
+		err := d.Validate()
+		if !m.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", m.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", m.src, err)
+			continue
+		}
+
+		ps, err := d.Produce(secretContext())
+		if err != nil {
+			t.Errorf("%s: %v", m.src, err)
+			continue
+		}
+		if len(ps) != 1 || ps[0].Mask != m.mask || string(ps[0].Body) != "00000000" {
+			t.Errorf("%s: unexpected products %+v", m.src, ps)
+		}
+	}
+}
+
+func TestDerivedSecretLength(t *testing.T) {
+	for _, l := range []struct {
+		length int
+		ok     bool
+	}{
+		{0, true},
+		{1, true},
+		{1024, true},
+		{-1, false},
+		{1025, false},
+	} {
+		d := &DerivedSecret{Name: "token", Length: l.length}
+		if err := d.Validate(); (err == nil) != l.ok {
+			t.Errorf("length %d: unexpected error %v", l.length, err)
+		}
+	}
+}
+
+func TestDerivedSecretEncoding(t *testing.T) {
+	for _, e := range []struct {
+		encoding string
+		ok       bool
+	}{
+		{"", true},
+		{"hex", true},
+		{"base64", true},
+		{"base64url", true},
+		{"raw", true},
+		{"alphanumeric", true},
+		{"base32", false},
+		{"HEX", false},
+	} {
+		d := &DerivedSecret{Name: "token", Encoding: e.encoding}
+		if err := d.Validate(); (err == nil) != e.ok {
+			t.Errorf("encoding %q: unexpected error %v", e.encoding, err)
+		}
+	}
+}
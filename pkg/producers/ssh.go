@@ -0,0 +1,236 @@
+package producers
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+var (
+	defaultSSHKeyID      = mustParseExpression(`req.fqdn`)
+	defaultSSHPrincipals = mustParseExpression(`[req.fqdn]`)
+
+	// Same as ssh-keygen gives to user certificates
+	defaultSSHUserExtensions = map[string]string{
+		"permit-X11-forwarding":   "",
+		"permit-agent-forwarding": "",
+		"permit-port-forwarding":  "",
+		"permit-pty":              "",
+		"permit-user-rc":          "",
+	}
+)
+
+const defaultSSHValidity = 30 * 24 * time.Hour
+
+// SSHCert signs a client's SSH public key, ssh_host_cert and ssh_user_cert
+// differ only in certificate type and defaults. The public key is read
+// from public_key on the client, or a new key pair is generated there.
+type SSHCert struct {
+	Name     string
+	CertType uint32
+
+	Backend         hcl.Expression `hcl:"backend"`
+	PublicKey       string         `hcl:"public_key,optional"`
+	KeyID           hcl.Expression `hcl:"key_id,optional"`
+	Principals      hcl.Expression `hcl:"principals,optional"`
+	Validity        string         `hcl:"validity,optional"`
+	CriticalOptions hcl.Expression `hcl:"critical_options,optional"`
+	Extensions      hcl.Expression `hcl:"extensions,optional"`
+}
+
+func (s *SSHCert) Validate() error {
+	_, err := sshValidity(s.Validity)
+	return err
+}
+
+// DryRun allows asking for the public key, certificates are signed in
+// Produce.
+func (s *SSHCert) DryRun() (prepare, produce bool) {
+	return true, false
+}
+
+func (s *SSHCert) Prepare(c *Context) (TaskRequests, error) {
+	_, ok := c.TaskResponses[c.TaskID(s.Name, "")]
+	if ok {
+		return nil, nil
+	}
+
+	return TaskRequests{
+		c.TaskID(s.Name, ""): &task.SSHPublicKey{
+			Path: s.PublicKey,
+			Template: api.Product{
+				Name: []string{s.Name, "key"},
+				Mask: 0600,
+			},
+		},
+	}, nil
+}
+
+func (s *SSHCert) Produce(c *Context) ([]api.Product, error) {
+	resp, ok := c.TaskResponses[c.TaskID(s.Name, "")]
+	if !ok {
+		return nil, errors.New("producer: no task response")
+	}
+
+	sshKeyResp, ok := resp.(*task.SSHPublicKeyResponse)
+	if !ok {
+		return nil, errors.New("producer: can't cast a task response")
+	}
+
+	pub, err := sshKeyResp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := evalSSHBackend(s.Backend, c.EvalContext)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, err := evalString(orDefault(s.KeyID, defaultSSHKeyID), c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: key_id: %w", err)
+	}
+
+	principalsExpr := s.Principals
+	if s.CertType == ssh.HostCert {
+		principalsExpr = orDefault(s.Principals, defaultSSHPrincipals)
+	}
+	principals, err := evalStringList(principalsExpr, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: principals: %w", err)
+	}
+	if len(principals) == 0 {
+		// An empty list means "any principal" for sshd
+		return nil, errors.New("producer: principals: at least one is required")
+	}
+
+	validity, err := sshValidity(s.Validity)
+	if err != nil {
+		return nil, err
+	}
+
+	criticalOptions, err := evalStringMap(s.CriticalOptions, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: critical_options: %w", err)
+	}
+
+	extensions, err := evalStringMap(s.Extensions, c.EvalContext)
+	if err != nil {
+		return nil, fmt.Errorf("producer: extensions: %w", err)
+	}
+	if extensions == nil && s.CertType == ssh.UserCert {
+		extensions = defaultSSHUserExtensions
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        s.CertType,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
+		},
+	}
+	if err := b.SignSSH(cert); err != nil {
+		return nil, err
+	}
+	if err := c.recordSSH(s.Name, cert); err != nil {
+		return nil, err
+	}
+
+	ps := []api.Product{{
+		Name: []string{s.Name, "cert.pub"},
+		Body: ssh.MarshalAuthorizedKey(cert),
+		Mask: 0644,
+	}}
+	return ps, nil
+}
+
+// sshValidity reads validity, a duration, defaultSSHValidity if empty. A
+// certificate that expires before it's valid is no use to anybody.
+func sshValidity(validity string) (time.Duration, error) {
+	if len(validity) == 0 {
+		return defaultSSHValidity, nil
+	}
+
+	d, err := time.ParseDuration(validity)
+	if err != nil {
+		return 0, fmt.Errorf("producer: validity: %w", err)
+	}
+	if d <= 0 {
+		return 0, errors.New("producer: validity: must be positive")
+	}
+	return d, nil
+}
+
+// evalSSHBackend unwraps backend.ssh.<name> references.
+func evalSSHBackend(expr hcl.Expression, ctx *hcl.EvalContext) (backend.SSH, error) {
+	val, diags := expr.Value(ctx)
+	if len(diags) > 0 {
+		return nil, evalError(diags)
+	}
+
+	if !val.Type().IsObjectType() || !val.Type().HasAttribute("_ssh") {
+		return nil, evalError(errors.New("producer: backend is not valid"))
+	}
+
+	val = val.GetAttr("_ssh")
+	if !val.Type().Equals(backend.SSHType) {
+		return nil, evalError(errors.New("producer: backend is not valid"))
+	}
+
+	return **(val.EncapsulatedValue().(**backend.SSH)), nil
+}
+
+func evalStringMap(expr hcl.Expression, ctx *hcl.EvalContext) (map[string]string, error) {
+	if expr == nil {
+		return nil, nil
+	}
+
+	evaluated, diags := expr.Value(ctx)
+	if len(diags) > 0 {
+		return nil, evalError(diags)
+	}
+
+	if err := known(evaluated); err != nil {
+		return nil, err
+	}
+	if evaluated.IsNull() {
+		return nil, nil
+	}
+
+	if !evaluated.Type().IsObjectType() && !evaluated.Type().IsMapType() {
+		return nil, evalError(errors.New("expected a map of strings, got " + evaluated.Type().GoString()))
+	}
+
+	m := make(map[string]string)
+	for it := evaluated.ElementIterator(); it.Next(); {
+		key, value := it.Element()
+		if !value.Type().Equals(cty.String) || value.IsNull() {
+			return nil, evalError(errors.New("expected a map of strings, got " + evaluated.Type().GoString()))
+		}
+		m[key.AsString()] = value.AsString()
+	}
+	return m, nil
+}
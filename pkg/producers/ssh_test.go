@@ -0,0 +1,239 @@
+package producers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// signerSSH is an SSH CA with its key in memory.
+type signerSSH struct {
+	signer ssh.Signer
+}
+
+func (s signerSSH) SignSSH(cert *ssh.Certificate) error {
+	return cert.SignCert(rand.Reader, s.signer)
+}
+
+func newSSHKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub, signer
+}
+
+// sshContext has backend.ssh.main and a response with the client's key
+// to the task of producer "ssh".
+func sshContext(t *testing.T, ca ssh.Signer, key ssh.PublicKey) *Context {
+	var b backend.SSH = signerSSH{ca}
+	ptr := &b
+	c := &Context{
+		Policy: "web",
+		EvalContext: &hcl.EvalContext{Variables: map[string]cty.Value{
+			"req": cty.ObjectVal(map[string]cty.Value{
+				"fqdn": cty.StringVal("web-1.example.com"),
+			}),
+			"backend": cty.ObjectVal(map[string]cty.Value{
+				"ssh": cty.ObjectVal(map[string]cty.Value{
+					"main": cty.ObjectVal(map[string]cty.Value{
+						"_ssh": cty.CapsuleVal(backend.SSHType, &ptr),
+					}),
+				}),
+			}),
+		}},
+		TaskResponses: make(TaskResponses),
+	}
+	c.TaskResponses[c.TaskID("ssh", "")] = &task.SSHPublicKeyResponse{
+		AuthorizedKey: string(ssh.MarshalAuthorizedKey(key)),
+	}
+	return c
+}
+
+func TestSSHCert(t *testing.T) {
+	caPub, ca := newSSHKey(t)
+	key, _ := newSSHKey(t)
+
+	for _, c := range []struct {
+		name     string
+		certType uint32
+		src      string
+
+		keyID      string
+		principals []string
+		options    map[string]string
+		extensions map[string]string
+		validity   time.Duration
+	}{
+		{
+			name:       "host defaults",
+			certType:   ssh.HostCert,
+			keyID:      "web-1.example.com",
+			principals: []string{"web-1.example.com"},
+			validity:   defaultSSHValidity,
+		},
+		{
+			name:     "host",
+			certType: ssh.HostCert,
+			src: `
+key_id     = "host ${req.fqdn}"
+principals = [req.fqdn, "web-1"]
+validity   = "1h"
+`,
+			keyID:      "host web-1.example.com",
+			principals: []string{"web-1.example.com", "web-1"},
+			validity:   time.Hour,
+		},
+		{
+			name:       "user defaults",
+			certType:   ssh.UserCert,
+			src:        `principals = ["deploy"]`,
+			keyID:      "web-1.example.com",
+			principals: []string{"deploy"},
+			extensions: defaultSSHUserExtensions,
+			validity:   defaultSSHValidity,
+		},
+		{
+			name:     "user",
+			certType: ssh.UserCert,
+			src: `
+principals       = ["deploy"]
+critical_options = { force-command = "/usr/bin/rsync", source-address = "10.0.0.0/8" }
+extensions       = { permit-pty = "" }
+`,
+			keyID:      "web-1.example.com",
+			principals: []string{"deploy"},
+			options: map[string]string{
+				"force-command":  "/usr/bin/rsync",
+				"source-address": "10.0.0.0/8",
+			},
+			extensions: map[string]string{"permit-pty": ""},
+			validity:   defaultSSHValidity,
+		},
+	} {
+		p := &SSHCert{Name: "ssh", CertType: c.certType}
+		decode(t, "backend = backend.ssh.main\n"+c.src, p)
+		if err := p.Validate(); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		start := time.Now()
+		ps, err := p.Produce(sshContext(t, ca, key))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(ps) != 1 || !reflect.DeepEqual(ps[0].Name, []string{"ssh", "cert.pub"}) {
+			t.Errorf("%s: unexpected products %+v", c.name, ps)
+			continue
+		}
+
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey(ps[0].Body)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		cert, ok := parsed.(*ssh.Certificate)
+		if !ok {
+			t.Fatalf("%s: expected a certificate, got %T", c.name, parsed)
+		}
+
+		if cert.CertType != c.certType {
+			t.Errorf("%s: expected cert type %d, got %d", c.name, c.certType, cert.CertType)
+		}
+		if string(cert.Key.Marshal()) != string(key.Marshal()) {
+			t.Errorf("%s: certificate is for another key", c.name)
+		}
+		if string(cert.SignatureKey.Marshal()) != string(caPub.Marshal()) {
+			t.Errorf("%s: certificate is signed by another CA", c.name)
+		}
+		if cert.KeyId != c.keyID {
+			t.Errorf("%s: expected key ID %q, got %q", c.name, c.keyID, cert.KeyId)
+		}
+		if !reflect.DeepEqual(cert.ValidPrincipals, c.principals) {
+			t.Errorf("%s: expected principals %v, got %v", c.name, c.principals, cert.ValidPrincipals)
+		}
+		if len(cert.CriticalOptions) > 0 || len(c.options) > 0 {
+			if !reflect.DeepEqual(cert.CriticalOptions, c.options) {
+				t.Errorf("%s: expected critical options %v, got %v", c.name, c.options, cert.CriticalOptions)
+			}
+		}
+		if len(cert.Extensions) > 0 || len(c.extensions) > 0 {
+			if !reflect.DeepEqual(cert.Extensions, c.extensions) {
+				t.Errorf("%s: expected extensions %v, got %v", c.name, c.extensions, cert.Extensions)
+			}
+		}
+
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if validBefore.Before(start.Add(c.validity).Add(-time.Minute)) || validBefore.After(time.Now().Add(c.validity)) {
+			t.Errorf("%s: expected validity %v, valid before %v", c.name, c.validity, validBefore)
+		}
+		if cert.ValidAfter >= cert.ValidBefore {
+			t.Errorf("%s: certificate is valid after %d, before %d", c.name, cert.ValidAfter, cert.ValidBefore)
+		}
+
+		// The certificate is good for what it's for
+		checker := &ssh.CertChecker{
+			SupportedCriticalOptions: []string{"force-command", "source-address"},
+			IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				return string(auth.Marshal()) == string(caPub.Marshal())
+			},
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) == string(caPub.Marshal())
+			},
+		}
+		if err := checker.CheckCert(c.principals[0], cert); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestSSHCertPrincipalsRequired(t *testing.T) {
+	_, ca := newSSHKey(t)
+	key, _ := newSSHKey(t)
+
+	// An empty list means any principal to sshd
+	for _, src := range []string{``, `principals = []`} {
+		p := &SSHCert{Name: "ssh", CertType: ssh.UserCert}
+		decode(t, "backend = backend.ssh.main\n"+src, p)
+		if _, err := p.Produce(sshContext(t, ca, key)); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestSSHCertValidity(t *testing.T) {
+	for _, v := range []struct {
+		src string
+		ok  bool
+	}{
+		{``, true},
+		{`validity = "24h"`, true},
+		{`validity = "0s"`, false},
+		{`validity = "-1h"`, false},
+		{`validity = "a week"`, false},
+	} {
+		p := &SSHCert{Name: "ssh", CertType: ssh.HostCert}
+		decode(t, "backend = backend.ssh.main\n"+v.src, p)
+		if err := p.Validate(); (err == nil) != v.ok {
+			t.Errorf("%q: unexpected error %v", v.src, err)
+		}
+	}
+}
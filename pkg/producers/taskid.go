@@ -0,0 +1,53 @@
+package producers
+
+import (
+	"errors"
+	"strings"
+)
+
+// TaskID names a task. Tasks are namespaced by policy and producer, so
+// producers of the same name in different policies don't share them.
+type TaskID struct {
+	Policy   string
+	Producer string
+	// Part tells tasks of one producer apart, it's empty for the first
+	// one. Slashes separate parts of its name on the wire.
+	Part string
+}
+
+// TaskID names a task of the producer in the current policy.
+func (c *Context) TaskID(producer, part string) TaskID {
+	return TaskID{Policy: c.Policy, Producer: producer, Part: part}
+}
+
+// Name is how the task is named on the wire: policy, producer, then parts.
+func (id TaskID) Name() []string {
+	name := []string{id.Policy, id.Producer}
+	if len(id.Part) > 0 {
+		name = append(name, strings.Split(id.Part, "/")...)
+	}
+	return name
+}
+
+func (id TaskID) String() string {
+	return strings.Join(id.Name(), "/")
+}
+
+// ParseTaskID reads a task name off the wire, names that don't round trip
+// through Name are rejected.
+func ParseTaskID(name []string) (TaskID, error) {
+	if len(name) < 2 {
+		return TaskID{}, errors.New("producers: task name is too short")
+	}
+	for _, part := range name[2:] {
+		if len(part) == 0 || strings.Contains(part, "/") {
+			return TaskID{}, errors.New("producers: bad task name " + strings.Join(name, "/"))
+		}
+	}
+
+	return TaskID{
+		Policy:   name[0],
+		Producer: name[1],
+		Part:     strings.Join(name[2:], "/"),
+	}, nil
+}
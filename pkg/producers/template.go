@@ -0,0 +1,124 @@
+package producers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+// Template renders an HCL template, either inline content or a source
+// file, with req, backends, outputs of other producers and the products
+// of previous producers of the same policy in scope. Products of a policy
+// are saved under its name:
+//
+//	policy "frontend" {
+//	  ...
+//	  produce template "nginx/ssl.conf" {
+//	    content = <<EOT
+//	ssl_certificate     ${var.dir}/${products["web/fullchain.pem"].path};
+//	ssl_certificate_key ${var.dir}/${produce.x509.web.key_path};
+//	EOT
+//	  }
+//	}
+type Template struct {
+	Name string
+
+	Content hcl.Expression `hcl:"content,optional"`
+	Source  string         `hcl:"source,optional"`
+	Mode    string         `hcl:"mode,optional"`
+}
+
+func (t *Template) Validate() error {
+	if err := oneSource("source", isSet(t.Content), len(t.Source) > 0); err != nil {
+		return err
+	}
+	_, err := parseMode(t.Mode, 0644)
+	return err
+}
+
+func (t *Template) ReadsProducts() bool {
+	return true
+}
+
+func (t *Template) DryRun() (prepare, produce bool) {
+	return true, true
+}
+
+func (t *Template) Prepare(c *Context) (TaskRequests, error) {
+	return nil, nil
+}
+
+func (t *Template) Produce(c *Context) ([]api.Product, error) {
+	expr := t.Content
+	if len(t.Source) > 0 {
+		src, err := ioutil.ReadFile(t.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		var diags hcl.Diagnostics
+		expr, diags = hclsyntax.ParseTemplate(src, t.Source, hcl.Pos{Line: 1, Column: 1})
+		if len(diags) > 0 {
+			return nil, evalError(diags)
+		}
+	}
+
+	ctx := c.EvalContext.NewChild()
+	ctx.Variables = map[string]cty.Value{
+		"products": c.productsVar(),
+	}
+
+	content, err := evalString(expr, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("producer: template: %w", err)
+	}
+
+	mode, err := parseMode(t.Mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := []api.Product{{
+		Name: []string{t.Name},
+		Body: []byte(content),
+		Mask: mode,
+	}}
+	return ps, nil
+}
+
+// parseMode reads a file mode in octal, def if it's empty. HCL has no
+// octal numbers, so mode = 0640 comes as "640", which reads the same.
+func parseMode(mode string, def int) (int, error) {
+	if len(mode) == 0 {
+		return def, nil
+	}
+
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.New("producer: mode: expected permissions in octal, like \"0640\"")
+	}
+	return int(m), nil
+}
+
+// productsVar maps product names to objects with path, relative to
+// client's directory, and body attributes. Products of tasks, like private
+// keys, aren't there: server never sees them.
+func (c *Context) productsVar() cty.Value {
+	products := make(map[string]cty.Value)
+	for _, p := range c.Products {
+		name := path.Join(p.Name...)
+		products[name] = cty.ObjectVal(map[string]cty.Value{
+			"path": cty.StringVal(path.Join(c.Policy, name)),
+			"body": cty.StringVal(string(p.Body)),
+		})
+	}
+	return cty.ObjectVal(products)
+}
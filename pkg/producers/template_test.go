@@ -0,0 +1,152 @@
+package producers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcl/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+// decode decodes an HCL body into p the way config does.
+func decode(t *testing.T, src string, p interface{}) {
+	f, diags := hclsyntax.ParseConfig([]byte(src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if diags := gohcl.DecodeBody(f.Body, nil, p); diags.HasErrors() {
+		t.Fatal(diags)
+	}
+}
+
+func TestTemplateMode(t *testing.T) {
+	for _, m := range []struct {
+		src  string
+		mask int
+		ok   bool
+	}{
+		{``, 0644, true},
+		{`mode = "0640"`, 0640, true},
+		{`mode = "600"`, 0600, true},
+		// Numbers mean the same as in chmod, not decimal
+		{`mode = 0640`, 0640, true},
+		{`mode = 755`, 0755, true},
+		{`mode = 0`, 0, true},
+		{`mode = 1204`, 0, false},
+		{`mode = "1777"`, 0, false},
+		{`mode = "0o644"`, 0, false},
+		{`mode = "rw-r--r--"`, 0, false},
+		{`mode = 64.4`, 0, false},
+		{`mode = -1`, 0, false},
+	} {
+		tmpl := &Template{Name: "greeting"}
+		decode(t, "content = \"hi\"\n"+m.src, tmpl)
+
+		// Bad modes fail config loading, not harvests
+		err := tmpl.Validate()
+		if !m.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", m.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", m.src, err)
+			continue
+		}
+
+		ps, err := tmpl.Produce(&Context{EvalContext: &hcl.EvalContext{}})
+		if err != nil {
+			t.Errorf("%s: %v", m.src, err)
+			continue
+		}
+		if len(ps) != 1 || ps[0].Mask != m.mask || string(ps[0].Body) != "hi" {
+			t.Errorf("%s: unexpected products %+v", m.src, ps)
+		}
+	}
+}
+
+func TestTemplateRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berny-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "hosts.tmpl")
+	err = ioutil.WriteFile(source, []byte("${req.fqdn} ${products[\"motd\"].body}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Context{
+		Policy: "web",
+		EvalContext: &hcl.EvalContext{Variables: map[string]cty.Value{
+			"req": cty.ObjectVal(map[string]cty.Value{
+				"fqdn": cty.StringVal("web-1.example.com"),
+			}),
+			"produce": cty.ObjectVal(map[string]cty.Value{
+				"x509": cty.ObjectVal(map[string]cty.Value{
+					"web": cty.ObjectVal(map[string]cty.Value{
+						"key_path": cty.StringVal("web/web/key.pem"),
+					}),
+				}),
+			}),
+		}},
+		Products: []api.Product{{Name: []string{"motd"}, Body: []byte("hello")}},
+	}
+
+	for _, test := range []struct {
+		src  string
+		want string
+	}{
+		{`content = "${req.fqdn}: ${products["motd"].path}"`, "web-1.example.com: web/motd"},
+		{`content = "${products["motd"].body}!"`, "hello!"},
+		{`content = "key ${produce.x509.web.key_path}"`, "key web/web/key.pem"},
+		{fmt.Sprintf("source = %q", source), "web-1.example.com hello"},
+	} {
+		tmpl := &Template{Name: "out"}
+		decode(t, test.src, tmpl)
+
+		ps, err := tmpl.Produce(c)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if len(ps) != 1 || string(ps[0].Body) != test.want {
+			t.Errorf("%s: expected %q, got %+v", test.src, test.want, ps)
+		}
+	}
+}
+
+func TestContentOrSource(t *testing.T) {
+	for _, v := range []struct {
+		file, template string
+		ok             bool
+	}{
+		{`content = "hi"`, `content = "hi"`, true},
+		{`content = req.fqdn`, `content = "${req.fqdn}"`, true},
+		{`from = "motd"`, `source = "motd.tmpl"`, true},
+		{``, ``, false},
+		{`content = null`, `content = null`, false},
+		{"content = \"hi\"\nfrom = \"motd\"", "content = \"hi\"\nsource = \"motd.tmpl\"", false},
+	} {
+		f := &File{Name: "motd"}
+		decode(t, v.file, f)
+		if err := f.Validate(); (err == nil) != v.ok {
+			t.Errorf("file %q: unexpected error %v", v.file, err)
+		}
+
+		tmpl := &Template{Name: "motd"}
+		decode(t, v.template, tmpl)
+		if err := tmpl.Validate(); (err == nil) != v.ok {
+			t.Errorf("template %q: unexpected error %v", v.template, err)
+		}
+	}
+}
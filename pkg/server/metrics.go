@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alvelcom/berny/pkg/audit"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/metrics"
+)
+
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	harvests   *metrics.Counter
+	probes     *metrics.Counter
+	taskRounds *metrics.Counter
+	tasks      *metrics.Counter
+	errors     *metrics.Counter
+	signing    *metrics.Histogram
+}
+
+func newServerMetrics(h *Handler) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		harvests: r.Counter("berny_harvests_total",
+			"Harvest requests by matched policy and outcome: tasks, products or error.",
+			"policy", "outcome"),
+		probes: r.Counter("berny_probes_total",
+			"Probe runs by probe type and result.",
+			"type", "result"),
+		taskRounds: r.Counter("berny_task_rounds_total",
+			"Harvest requests answered with tasks."),
+		tasks: r.Counter("berny_tasks_total",
+			"Tasks asked of clients by type.",
+			"type"),
+		errors: r.Counter("berny_errors_total",
+			"Failed harvest requests by error type.",
+			"type"),
+		signing: r.Histogram("berny_sign_duration_seconds",
+			"Time backends take to sign a certificate.",
+			metrics.DefaultBuckets, "backend", "kind"),
+	}
+
+	r.GaugeFunc("berny_ca_expiry_days",
+		"Days until the CA certificate of an x509 backend expires.",
+		[]string{"backend"}, func(emit func(float64, ...string)) {
+			for name, b := range h.Current().Backends.X509 {
+				issuer, err := backendIssuer(b)
+				if err != nil {
+					continue
+				}
+				emit(time.Until(issuer.NotAfter).Hours()/24, name)
+			}
+		})
+	return m
+}
+
+// observe accounts for a finished harvest request.
+func (m *serverMetrics) observe(r *audit.Record) {
+	outcome := "products"
+	switch {
+	case len(r.Error) > 0:
+		outcome = "error"
+	case len(r.Tasks) > 0:
+		outcome = "tasks"
+		m.taskRounds.Inc()
+	}
+
+	matched := false
+	for _, p := range r.Policies {
+		for _, probe := range p.Probes {
+			result := "pass"
+			if len(probe.Error) > 0 {
+				result = "fail"
+			}
+			m.probes.Inc(probe.Type, result)
+		}
+
+		if p.Verified {
+			matched = true
+			m.harvests.Inc(p.Name, outcome)
+		}
+	}
+	if !matched {
+		m.harvests.Inc("", outcome)
+	}
+
+	for _, t := range r.Tasks {
+		m.tasks.Inc(t.Type)
+	}
+}
+
+// instrument copies a fresh config with backends wrapped to measure
+// signing. The state given is left alone, it may be swapped in again or
+// used elsewhere.
+func (m *serverMetrics) instrument(s *State) *State {
+	backends := &backend.Map{
+		X509:   make(map[string]backend.X509, len(s.Backends.X509)),
+		SSH:    make(map[string]backend.SSH, len(s.Backends.SSH)),
+		Secret: s.Backends.Secret,
+	}
+	for name, b := range s.Backends.X509 {
+		backends.X509[name] = &timedX509{X509: b, name: name, m: m}
+	}
+	for name, b := range s.Backends.SSH {
+		backends.SSH[name] = &timedSSH{SSH: b, name: name, m: m}
+	}
+
+	instrumented := *s
+	instrumented.Backends = backends
+	return &instrumented
+}
+
+type timedX509 struct {
+	backend.X509
+	name string
+	m    *serverMetrics
+}
+
+func (t *timedX509) Sign(template *x509.Certificate) ([]byte, [][]byte, error) {
+	start := time.Now()
+	defer func() {
+		t.m.signing.Observe(time.Since(start).Seconds(), t.name, "x509")
+	}()
+	return t.X509.Sign(template)
+}
+
+type timedSSH struct {
+	backend.SSH
+	name string
+	m    *serverMetrics
+}
+
+func (t *timedSSH) SignSSH(cert *ssh.Certificate) error {
+	start := time.Now()
+	defer func() {
+		t.m.signing.Observe(time.Since(start).Seconds(), t.name, "ssh")
+	}()
+	return t.SSH.SignSSH(cert)
+}
+
+func ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// ServeReadyz checks every backend can sign a throwaway certificate, or
+// derive a secret. Nothing is recorded in the inventory.
+func (h *Handler) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	backends := h.Current().Backends
+
+	var failed []string
+	check := func(kind, name string, err error) {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s: %v", kind, name, err))
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for name, b := range backends.X509 {
+		now := time.Now()
+		_, _, err := b.Sign(&x509.Certificate{
+			Subject:      pkix.Name{CommonName: "berny readiness check"},
+			SerialNumber: big.NewInt(now.UnixNano()),
+			NotBefore:    now,
+			NotAfter:     now.Add(time.Minute),
+			PublicKey:    &key.PublicKey,
+		})
+		check("x509", name, err)
+	}
+
+	for name, b := range backends.SSH {
+		pub, err := ssh.NewPublicKey(&key.PublicKey)
+		if err == nil {
+			err = b.SignSSH(&ssh.Certificate{
+				Key:             pub,
+				CertType:        ssh.UserCert,
+				KeyId:           "berny readiness check",
+				ValidPrincipals: []string{"nobody"},
+				ValidBefore:     uint64(time.Now().Add(time.Minute).Unix()),
+			})
+		}
+		check("ssh", name, err)
+	}
+
+	for name, b := range backends.Secret {
+		rd, err := b.Derive([]byte("berny readiness check"))
+		if err == nil {
+			_, err = io.ReadFull(rd, make([]byte, 1))
+		}
+		check("secret", name, err)
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, f := range failed {
+			fmt.Fprintln(w, f)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
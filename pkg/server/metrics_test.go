@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/alvelcom/berny/pkg/backend"
+)
+
+// stubX509 signs nothing, it fails with err if set.
+type stubX509 struct {
+	err error
+}
+
+func (b stubX509) Sign(cert *x509.Certificate) ([]byte, [][]byte, error) { return nil, nil, b.err }
+func (b stubX509) CA() ([][]byte, error)                                 { return nil, errors.New("no ca") }
+func (b stubX509) OCSP(template ocsp.Response) ([]byte, error)           { return nil, b.err }
+func (b stubX509) CRL(revoked []pkix.RevokedCertificate, now, next time.Time) ([]byte, error) {
+	return nil, b.err
+}
+
+func stubState(backends map[string]backend.X509) *State {
+	m := backend.NewMap()
+	for name, b := range backends {
+		m.X509[name] = b
+	}
+	return &State{Backends: m}
+}
+
+func serve(h *Handler, path string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	h.Routes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestSwapKeepsState(t *testing.T) {
+	ok := stubX509{}
+	s := stubState(map[string]backend.X509{"ca": ok})
+	h := New(s, Options{})
+	h.Swap(s)
+
+	if s.Backends.X509["ca"] != backend.X509(ok) {
+		t.Errorf("Swap changed backends of the state it was given")
+	}
+
+	if _, _, err := h.Current().Backends.X509["ca"].Sign(&x509.Certificate{}); err != nil {
+		t.Fatal(err)
+	}
+	metrics := serve(h, "/metrics").Body.String()
+	want := `berny_sign_duration_seconds_count{backend="ca",kind="x509"} 1` + "\n"
+	if !strings.Contains(metrics, want) {
+		t.Errorf("expected a single signing observed, got:\n%s", metrics)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	h := New(stubState(nil), Options{})
+	w := serve(h, "/healthz")
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("unexpected healthz response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := New(stubState(map[string]backend.X509{"good": stubX509{}}), Options{})
+	w := serve(h, "/readyz")
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("unexpected readyz response %d %q", w.Code, w.Body.String())
+	}
+
+	h.Swap(stubState(map[string]backend.X509{
+		"good": stubX509{},
+		"bad":  stubX509{err: errors.New("hsm is gone")},
+	}))
+	w = serve(h, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with a failing backend, got %d", w.Code)
+	}
+	if w.Body.String() != "x509 bad: hsm is gone\n" {
+		t.Errorf("unexpected readyz response %q", w.Body.String())
+	}
+}
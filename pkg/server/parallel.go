@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alvelcom/berny/pkg/producers"
+)
+
+// DefaultParallelism is how many producers of a harvest run at once
+// unless told otherwise.
+const DefaultParallelism = 8
+
+// ProducerErrors are errors of every producer that failed, in config
+// order.
+type ProducerErrors []error
+
+func (e ProducerErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap lets errors.As look into every producer's error.
+func (e ProducerErrors) Unwrap() []error {
+	return e
+}
+
+// parallel calls fn for every producer of the policies, up to n at once.
+// A producer waits for the ones it needs, and is skipped if any of those
+// failed.
+func parallel(policies []Policy, n int, fn func(i, j int) error) error {
+	sem := make(chan struct{}, n)
+	errs := make([][]error, len(policies))
+	// failed or skipped, producers that need them are skipped too
+	broken := make([][]bool, len(policies))
+
+	var wg sync.WaitGroup
+	for i := range policies {
+		errs[i] = make([]error, len(policies[i].Produce))
+		broken[i] = make([]bool, len(policies[i].Produce))
+		done := make([]chan struct{}, len(policies[i].Produce))
+		for j := range done {
+			done[j] = make(chan struct{})
+		}
+		for j := range policies[i].Produce {
+			wg.Add(1)
+			go func(i, j int, done []chan struct{}) {
+				defer wg.Done()
+				defer close(done[j])
+
+				// Config makes sure there are no cycles
+				for _, k := range policies[i].needs(j) {
+					<-done[k]
+					if broken[i][k] {
+						broken[i][j] = true
+						return
+					}
+				}
+
+				sem <- struct{}{}
+				errs[i][j] = recovered(fn, i, j)
+				broken[i][j] = errs[i][j] != nil
+				<-sem
+			}(i, j, done)
+		}
+	}
+	wg.Wait()
+
+	var failed ProducerErrors
+	for i := range errs {
+		for j, err := range errs[i] {
+			if err != nil {
+				failed = append(failed, producerError(&policies[i], j, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// recovered calls fn, a producer that panics fails on its own rather than
+// taking the server down.
+func recovered(fn func(i, j int) error, i, j int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(i, j)
+}
+
+func readsProducts(p producers.Producer) bool {
+	r, ok := p.(producers.ProductReader)
+	return ok && r.ReadsProducts()
+}
+
+// producerError tells which producer failed, policies built in code have
+// no config to name them by.
+func producerError(p *Policy, j int, err error) error {
+	prefix := "policy " + p.Name + ": "
+	if j < len(p.Config.Produce) {
+		h := p.Config.Produce[j]
+		prefix += "produce " + h.Type + " " + h.Name + ": "
+	}
+	return fmt.Errorf("%s%w", prefix, err)
+}
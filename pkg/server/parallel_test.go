@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/config"
+	"github.com/alvelcom/berny/pkg/producers"
+)
+
+// nopProducer is only run through parallel, which calls its own fn.
+type nopProducer struct {
+	readsProducts bool
+}
+
+func (nopProducer) Prepare(c *producers.Context) (producers.TaskRequests, error) { return nil, nil }
+func (nopProducer) Produce(c *producers.Context) ([]api.Product, error)          { return nil, nil }
+func (p nopProducer) ReadsProducts() bool                                        { return p.readsProducts }
+
+// testPolicy has n producers named p0, p1... with deps as its Deps.
+func testPolicy(name string, n int, deps [][]int) Policy {
+	p := Policy{Name: name, Deps: deps}
+	for j := 0; j < n; j++ {
+		p.Produce = append(p.Produce, nopProducer{})
+		p.Config.Produce = append(p.Config.Produce, config.Producer{Type: "file", Name: "p" + strconv.Itoa(j)})
+	}
+	return p
+}
+
+// runParallel fails the test rather than hanging on a deadlock.
+func runParallel(t *testing.T, policies []Policy, n int, fn func(i, j int) error) error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() {
+		result <- parallel(policies, n, fn)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("parallel deadlocked")
+		return nil
+	}
+}
+
+func TestParallelBound(t *testing.T) {
+	policies := []Policy{testPolicy("a", 10, nil), testPolicy("b", 10, nil)}
+	for _, n := range []int{1, 3, 8} {
+		var running, max, calls int32
+		err := runParallel(t, policies, n, func(i, j int) error {
+			now := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&max)
+				if now <= seen || atomic.CompareAndSwapInt32(&max, seen, now) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&calls, 1)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 20 {
+			t.Errorf("n=%d: %d producers ran, expected 20", n, calls)
+		}
+		if max > int32(n) {
+			t.Errorf("n=%d: %d producers ran at once", n, max)
+		}
+		if n > 1 && max < 2 {
+			t.Errorf("n=%d: producers didn't run concurrently", n)
+		}
+	}
+}
+
+func TestParallelErrorOrder(t *testing.T) {
+	policies := []Policy{testPolicy("a", 4, nil), testPolicy("b", 4, nil)}
+	err := runParallel(t, policies, 8, func(i, j int) error {
+		// Later producers fail first
+		time.Sleep(time.Duration(8-4*i-j) * time.Millisecond)
+		if j%2 == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	errs, ok := err.(ProducerErrors)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := "policy a: produce file p1: failed; policy a: produce file p3: failed; " +
+		"policy b: produce file p1: failed; policy b: produce file p3: failed"
+	if len(errs) != 4 || errs.Error() != want {
+		t.Errorf("unexpected errors %q", errs.Error())
+	}
+}
+
+func TestParallelPanic(t *testing.T) {
+	// p1 needs p0, which panics
+	policies := []Policy{testPolicy("a", 3, [][]int{nil, {0}, nil})}
+	var calls int32
+	err := runParallel(t, policies, 1, func(i, j int) error {
+		atomic.AddInt32(&calls, 1)
+		if j == 0 {
+			panic("oops")
+		}
+		return nil
+	})
+
+	errs, ok := err.(ProducerErrors)
+	if !ok || len(errs) != 1 || errs.Error() != "policy a: produce file p0: panic: oops" {
+		t.Errorf("unexpected error %v", err)
+	}
+	// p2 still runs, and gets the semaphore p0 held
+	if calls != 2 {
+		t.Errorf("%d producers ran, expected 2", calls)
+	}
+}
+
+func TestParallelDependencies(t *testing.T) {
+	// p1 and p2 need p0, p3 needs p1, p4 reads products of all before it
+	policy := testPolicy("a", 5, [][]int{nil, {0}, {0}, {1}, nil})
+	policy.Produce[4] = nopProducer{readsProducts: true}
+
+	for _, c := range []struct {
+		fail  int
+		ran   string
+		error string
+	}{
+		{-1, "0,1,2,3,4", ""},
+		{0, "0", "policy a: produce file p0: failed"},
+		{1, "0,1,2", "policy a: produce file p1: failed"},
+		{3, "0,1,2,3", "policy a: produce file p3: failed"},
+	} {
+		// One at a time, a producer waiting for a broken one must not
+		// hold the only slot
+		for _, n := range []int{1, 8} {
+			var mu sync.Mutex
+			done := make(map[int]bool)
+			var order []int
+			err := runParallel(t, []Policy{policy}, n, func(i, j int) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, k := range policy.needs(j) {
+					if !done[k] {
+						t.Errorf("p%d ran before p%d", j, k)
+					}
+				}
+				order = append(order, j)
+				if j == c.fail {
+					return errors.New("failed")
+				}
+				done[j] = true
+				return nil
+			})
+
+			ran := make([]bool, 5)
+			for _, j := range order {
+				ran[j] = true
+			}
+			var got string
+			for j := range ran {
+				if ran[j] {
+					if len(got) > 0 {
+						got += ","
+					}
+					got += strconv.Itoa(j)
+				}
+			}
+			if got != c.ran {
+				t.Errorf("fail p%d, n=%d: ran %s, expected %s", c.fail, n, got, c.ran)
+			}
+			if (err == nil && len(c.error) > 0) || (err != nil && err.Error() != c.error) {
+				t.Errorf("fail p%d, n=%d: unexpected error %v", c.fail, n, err)
+			}
+		}
+	}
+}
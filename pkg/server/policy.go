@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/audit"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/config"
+	"github.com/alvelcom/berny/pkg/probes"
+	"github.com/alvelcom/berny/pkg/producers"
+)
+
+// Policy gives machines that pass its probes whatever its producers
+// make. Policies are decoded from config, or built in code
+// and added with Handler.AddPolicy.
+type Policy struct {
+	Name    string
+	Verify  []probes.Probe
+	Produce []producers.Producer
+	// Deps lists, for every producer, indexes of the producers it refers
+	// to through the produce variable
+	Deps [][]int
+
+	// Config is what the policy was decoded from, if it was
+	Config config.Policy
+}
+
+func CastBackends(bs []config.Backend, ctx *hcl.EvalContext) (*backend.Map, error) {
+	m := backend.NewMap()
+	for _, b := range bs {
+		err := m.Add(b, ctx)
+		if err != nil {
+			return m, blockError(b.Config, err)
+		}
+	}
+	return m, nil
+}
+
+// CastPolicies decodes policies. Products are saved under the policy's
+// name and named after their producers, so policy names must make unique
+// directory names and producer names must name distinct paths within a
+// policy.
+func CastPolicies(ps []config.Policy, ctx *hcl.EvalContext) ([]Policy, error) {
+	policies := []Policy{}
+	names := make(map[string]bool)
+	for _, p := range ps {
+		if err := checkPolicyName(p.Name); err != nil {
+			return nil, err
+		}
+		if names[p.Name] {
+			return nil, errors.New("policy " + p.Name + ": defined twice")
+		}
+		names[p.Name] = true
+
+		// Producers make their products under their name, x509 "b" makes
+		// b/key.pem, so no name may be another's or lead into it
+		var produced []string
+		for _, producer := range p.Produce {
+			name := path.Clean(producer.Name)
+			for _, other := range produced {
+				if name == other || strings.HasPrefix(name, other+"/") || strings.HasPrefix(other, name+"/") {
+					return nil, blockError(producer.Config, errors.New(
+						"policy "+p.Name+": products of producer "+producer.Name+" collide with ones of producer "+other))
+				}
+			}
+			produced = append(produced, name)
+		}
+
+		policy := Policy{
+			Name:   p.Name,
+			Config: p,
+		}
+
+		for _, probe := range p.Verify {
+			body := probe.Config
+			probe, err := probes.New(probe, ctx)
+			if err != nil {
+				return nil, blockError(body, err)
+			}
+			policy.Verify = append(policy.Verify, probe)
+		}
+
+		for _, producer := range p.Produce {
+			body := producer.Config
+			producer, err := producers.New(producer, ctx)
+			if err != nil {
+				return nil, blockError(body, err)
+			}
+			policy.Produce = append(policy.Produce, producer)
+		}
+
+		deps, diags := producers.Dependencies(p.Produce, policy.Produce)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		policy.Deps = deps
+
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// checkPolicyName makes sure a policy name is a directory name of its own.
+func checkPolicyName(name string) error {
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return errors.New("policy " + strconv.Quote(name) + ": name can't be a directory name")
+	}
+	return nil
+}
+
+// blockError points errors other than diagnostics at the block they came
+// from.
+func blockError(body hcl.Body, err error) error {
+	if _, ok := err.(hcl.Diagnostics); ok {
+		return err
+	}
+
+	return hcl.Diagnostics{{
+		Severity: hcl.DiagError,
+		Summary:  err.Error(),
+		Subject:  body.MissingItemRange().Ptr(),
+	}}
+}
+
+// Probe runs probes until one fails, results are for the audit log.
+func (p *Policy) Probe(r *http.Request, mi *api.MachineInfo) ([]audit.Probe, error) {
+	var results []audit.Probe
+	for _, probe := range p.Verify {
+		err := probe.Verify(r, mi)
+		result := audit.Probe{Type: probe.Type()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// needs lists producers the j-th one runs after: the ones it refers to
+// and, if it reads products, all before it.
+func (p *Policy) needs(j int) []int {
+	var ks []int
+	if j < len(p.Deps) {
+		ks = append(ks, p.Deps[j]...)
+	}
+	if readsProducts(p.Produce[j]) {
+		for k := 0; k < j; k++ {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// ProducerContext copies c for a producer of the policy. Its produce
+// variable holds outputs of the policy's producers by type and name,
+// produced holds products of the ones that ran Produce, nil for the rest.
+// Policies built in code have no config to name producers by, so their
+// produce variable is empty.
+func (p *Policy) ProducerContext(c *producers.Context, produced [][]api.Product) *producers.Context {
+	pc := *c
+	pc.Policy = p.Name
+	pc.Products = nil
+
+	types := make(map[string]map[string]cty.Value)
+	for j, block := range p.Config.Produce {
+		if j >= len(p.Produce) {
+			break
+		}
+		var products []api.Product
+		if j < len(produced) {
+			products = produced[j]
+		}
+
+		if types[block.Type] == nil {
+			types[block.Type] = make(map[string]cty.Value)
+		}
+		types[block.Type][block.Name] = producers.Outputs(p.Produce[j], &pc, products)
+	}
+
+	produce := make(map[string]cty.Value, len(types))
+	for type_, names := range types {
+		produce[type_] = cty.ObjectVal(names)
+	}
+	pc.EvalContext = c.EvalContext.NewChild()
+	pc.EvalContext.Variables = map[string]cty.Value{"produce": cty.ObjectVal(produce)}
+	return &pc
+}
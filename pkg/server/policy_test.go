@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hclparse"
+
+	"github.com/alvelcom/berny/pkg/config"
+)
+
+// loadConfig writes src to a temporary config and loads it.
+func loadConfig(t *testing.T, src string) *config.Config {
+	dir, err := ioutil.TempDir("", "berny-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "berny.hcl")
+	if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, diags := config.Load(hclparse.NewParser(), fn, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	return c
+}
+
+func TestPolicyNeeds(t *testing.T) {
+	c := loadConfig(t, `
+policy "web" {
+  produce x509 "ca" {
+    backend     = backend.x509.main
+    common_name = "ca"
+  }
+  produce x509 "web" {
+    backend     = backend.x509.main
+    common_name = req.fqdn
+  }
+  produce file "ca.txt" {
+    content = produce.x509.ca.cert
+  }
+  produce x509 "admin" {
+    backend     = backend.x509.main
+    common_name = "admin"
+  }
+  produce template "list.txt" {
+    content = "${produce.x509.web.cert}${join(",", [for p in products : join("/", p.name)])}"
+  }
+}
+`)
+	policies, err := CastPolicies(c.Policies, c.EvalContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Certificates run right away, file "ca.txt" waits for the CA it refers
+	// to, template "list.txt" reads products so it waits for every producer
+	// before it too
+	want := []string{"[]", "[]", "[0]", "[]", "[1 0 1 2 3]"}
+	for j := range want {
+		if got := fmt.Sprint(policies[0].needs(j)); got != want[j] {
+			t.Errorf("%s: expected %s, got %s", c.Policies[0].Produce[j].Name, want[j], got)
+		}
+	}
+}
+
+func TestPolicyProductsCollide(t *testing.T) {
+	for _, v := range []struct {
+		names []string
+		ok    bool
+	}{
+		{[]string{"b", "b.txt", "c/b"}, true},
+		{[]string{"b", "b"}, false},
+		// x509 "b" makes b/key.pem
+		{[]string{"b", "b/key.pem"}, false},
+		{[]string{"b/key.pem", "b"}, false},
+		{[]string{"b", "./b//key.pem"}, false},
+	} {
+		src := "policy \"web\" {\n"
+		for _, name := range v.names {
+			src += fmt.Sprintf("  produce file %q {\n    content = \"x\"\n  }\n", name)
+		}
+		src += "}\n"
+
+		c := loadConfig(t, src)
+		if _, err := CastPolicies(c.Policies, c.EvalContext); (err == nil) != v.ok {
+			t.Errorf("%v: unexpected error %v", v.names, err)
+		}
+	}
+}
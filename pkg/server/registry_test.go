@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/probes"
+	"github.com/alvelcom/berny/pkg/producers"
+)
+
+// Types registered the way a server embedding berny would add its own.
+func init() {
+	backend.RegisterX509("test_labeled", func() backend.X509 { return new(labeledX509) })
+	probes.Register("test_domain", func() probes.Probe { return new(domainProbe) })
+	producers.Register("test_greeting", func(name string) producers.Producer {
+		return &greeting{Name: name}
+	})
+}
+
+type labeledX509 struct {
+	stubX509
+	Label string `hcl:"label"`
+}
+
+// domainProbe passes machines of a domain.
+type domainProbe struct {
+	Domain string `hcl:"domain"`
+}
+
+func (p *domainProbe) Type() string {
+	return "test_domain"
+}
+
+func (p *domainProbe) Verify(r *http.Request, mi *api.MachineInfo) error {
+	if !strings.HasSuffix(mi.FQDN, "."+p.Domain) {
+		return errors.New("wrong domain")
+	}
+	return nil
+}
+
+// greeting produces a file of its text.
+type greeting struct {
+	Name string
+	Text hcl.Expression `hcl:"text"`
+}
+
+func (g *greeting) Prepare(c *producers.Context) (producers.TaskRequests, error) {
+	return nil, nil
+}
+
+func (g *greeting) Produce(c *producers.Context) ([]api.Product, error) {
+	val, diags := g.Text.Value(c.EvalContext)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if val.Type() != cty.String || !val.IsWhollyKnown() {
+		return nil, errors.New("text: expected a string")
+	}
+	return []api.Product{{Name: []string{g.Name}, Body: []byte(val.AsString()), Mask: 0644}}, nil
+}
+
+func TestRegisteredTypes(t *testing.T) {
+	ht := newHarvestTest(t, `
+backend x509 "labeled" {
+  type  = "test_labeled"
+  label = "staging"
+}
+
+policy "web" {
+  verify test_domain {
+    domain = "example.com"
+  }
+
+  produce test_greeting "hello.txt" {
+    text = "hello ${req.fqdn}"
+  }
+}
+`, Options{})
+	defer ht.Close()
+
+	b, ok := ht.h.Current().Backends.X509["labeled"]
+	if !ok {
+		t.Fatal("backend of a registered type isn't loaded")
+	}
+	// Backends are wrapped for metrics
+	if l, ok := b.(*timedX509).X509.(*labeledX509); !ok || l.Label != "staging" {
+		t.Errorf("unexpected backend %#v", b)
+	}
+
+	for _, v := range []struct {
+		fqdn     string
+		products []string
+	}{
+		{"web-1.example.com", []string{"web/hello.txt"}},
+		{"web-1.example.org", nil},
+	} {
+		_, resp := ht.harvest(t, &api.Request{Machine: machine(v.fqdn)})
+		if names := productNames(resp.Products); !reflect.DeepEqual(names, v.products) {
+			t.Errorf("%s: unexpected products %v", v.fqdn, names)
+		}
+		if len(resp.Products) > 0 && string(resp.Products[0].Body) != "hello "+v.fqdn {
+			t.Errorf("%s: unexpected greeting %q", v.fqdn, resp.Products[0].Body)
+		}
+	}
+
+	for _, types := range [][]string{backend.Types(backend.KindX509), probes.Types(), producers.Types()} {
+		var found bool
+		for _, type_ := range types {
+			found = found || strings.HasPrefix(type_, "test_")
+		}
+		if !found {
+			t.Errorf("registered type isn't listed in %v", types)
+		}
+	}
+
+	schema, err := producers.Schema("test_greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Attributes) != 1 || schema.Attributes[0].Name != "text" {
+		t.Errorf("unexpected schema %+v", schema)
+	}
+}
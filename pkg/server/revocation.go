@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/inventory"
+)
+
+// WatchCRLs regenerates CRLs of every x509 backend. They are valid for two
+// intervals, so a single failed round goes unnoticed by clients.
+func (h *Handler) WatchCRLs(interval time.Duration) {
+	for {
+		h.refreshCRLs(interval)
+		time.Sleep(interval)
+	}
+}
+
+func (h *Handler) refreshCRLs(interval time.Duration) {
+	revocations, err := h.inventory.Revocations()
+	if err != nil {
+		h.log.Error("can't read revocations", "error", err)
+		return
+	}
+
+	now := time.Now()
+	crls := make(map[string][]byte)
+	for name, b := range h.Current().Backends.X509 {
+		issuer, err := backendIssuer(b)
+		if err != nil {
+			h.log.Error("can't generate crl", "backend", name, "error", err)
+			continue
+		}
+
+		var revoked []pkix.RevokedCertificate
+		for _, r := range revocations {
+			if r.Issuer != issuer.Subject.String() {
+				continue
+			}
+
+			serial, ok := new(big.Int).SetString(strings.Replace(r.Serial, ":", "", -1), 16)
+			if !ok {
+				h.log.Warn("bad serial in revocations", "backend", name, "serial", r.Serial)
+				continue
+			}
+			revoked = append(revoked, pkix.RevokedCertificate{
+				SerialNumber:   serial,
+				RevocationTime: r.RevokedAt,
+				Extensions:     reasonExtension(r.Reason),
+			})
+		}
+
+		crl, err := b.CRL(revoked, now, now.Add(2*interval))
+		if err != nil {
+			h.log.Error("can't generate crl", "backend", name, "error", err)
+			continue
+		}
+		crls[name] = crl
+	}
+	h.crls.Store(crls)
+}
+
+// reasonExtension encodes CRLReason, unspecified is left out as RFC 5280
+// asks.
+func reasonExtension(reason int) []pkix.Extension {
+	if reason == inventory.ReasonUnspecified {
+		return nil
+	}
+
+	value, err := asn1.Marshal(asn1.Enumerated(reason))
+	if err != nil {
+		panic(err)
+	}
+	return []pkix.Extension{{
+		Id:    asn1.ObjectIdentifier{2, 5, 29, 21},
+		Value: value,
+	}}
+}
+
+// ServeCRL gives out the last generated CRL of the backend named by the
+// path, mount it with http.StripPrefix.
+func (h *Handler) ServeCRL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	crls, _ := h.crls.Load().(map[string][]byte)
+	crl, ok := crls[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// ServeOCSP is an RFC 6960 responder for certificates of a backend: POST
+// <backend> or GET <backend>/<base64 request>, mount it with
+// http.StripPrefix.
+func (h *Handler) ServeOCSP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	name := path
+	var der []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		i := strings.Index(path, "/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		name = path[:i]
+
+		var encoded string
+		encoded, err = url.PathUnescape(path[i+1:])
+		if err == nil {
+			der, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case "POST":
+		der, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, ok := h.Current().Backends.X509[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+
+	var req *ocsp.Request
+	if err == nil {
+		req, err = ocsp.ParseRequest(der)
+	}
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	resp, err := h.ocspResponse(b, req)
+	if err != nil {
+		h.log.Error("can't respond to ocsp", "backend", name, "error", err)
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+	w.Write(resp)
+}
+
+func (h *Handler) ocspResponse(b backend.X509, req *ocsp.Request) ([]byte, error) {
+	issuer, err := backendIssuer(b)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(h.crlInterval),
+		IssuerHash:   req.HashAlgorithm,
+	}
+
+	// A request about another CA's certificate gets unknown back
+	keyHash, err := issuerKeyHash(issuer, req)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keyHash, req.IssuerKeyHash) {
+		return b.OCSP(template)
+	}
+
+	serial := req.SerialNumber.Text(16)
+	revocations, err := h.inventory.Revocations()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range revocations {
+		if r.Issuer == issuer.Subject.String() && inventory.SameSerial(r.Serial, serial) {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = r.RevokedAt
+			template.RevocationReason = r.Reason
+			return b.OCSP(template)
+		}
+	}
+
+	certs, err := h.inventory.Certificates(inventory.Query{Serial: serial})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		if c.Issuer == issuer.Subject.String() {
+			template.Status = ocsp.Good
+			break
+		}
+	}
+	return b.OCSP(template)
+}
+
+// issuerKeyHash hashes the issuer's public key the way the request did.
+func issuerKeyHash(issuer *x509.Certificate, req *ocsp.Request) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+
+	if !req.HashAlgorithm.Available() {
+		return nil, errors.New("unsupported hash algorithm")
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+func backendIssuer(b backend.X509) (*x509.Certificate, error) {
+	chain, err := b.CA()
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("backend has no CA certificate")
+	}
+	return x509.ParseCertificate(chain[0])
+}
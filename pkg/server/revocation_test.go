@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/inventory"
+)
+
+type revocationTest struct {
+	dir     string
+	ca      *x509.Certificate
+	backend backend.X509
+	inv     *inventory.File
+	h       *Handler
+}
+
+// newCA makes CAs with the same subject, emailAddress included.
+func newCA(t *testing.T) *testca.CA {
+	return testca.NewFrom(t, elliptic.P256(), &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "Test CA",
+			ExtraNames: []pkix.AttributeTypeAndValue{{
+				Type:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1},
+				Value: "ca@example.com",
+			}},
+		},
+	})
+}
+
+// newRevocationTest serves a file backend "ca" with an inventory.
+func newRevocationTest(t *testing.T) *revocationTest {
+	dir, err := ioutil.TempDir("", "berny-revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newCA(t)
+	write := func(name string, data []byte) string {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	certFile := write("ca.pem", testca.CertPEM(ca.Cert.Raw))
+	keyFile := write("ca-key.pem", testca.KeyPEM(t, ca.Key))
+	config := write("berny.hcl", []byte(fmt.Sprintf(`
+backend x509 "ca" {
+  type = "file"
+  cert = %q
+  key  = %q
+}
+`, certFile, keyFile)))
+
+	s, err := Load(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := inventory.NewFile(filepath.Join(dir, "inventory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &revocationTest{
+		dir:     dir,
+		ca:      ca.Cert,
+		backend: s.Backends.X509["ca"],
+		inv:     inv,
+		h:       New(s, Options{Inventory: inv}),
+	}
+}
+
+func (rt *revocationTest) Close() {
+	rt.inv.Close()
+	os.RemoveAll(rt.dir)
+}
+
+// issue signs a certificate, recorded ones are known to the inventory.
+func (rt *revocationTest) issue(t *testing.T, serial int64, record bool) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _, err := rt.backend.Sign(&x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "web-1.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		PublicKey:    &key.PublicKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record {
+		err := rt.inv.AddCertificate(inventory.Certificate{
+			Kind:     "x509",
+			Serial:   fmt.Sprintf("%x", cert.SerialNumber),
+			Issuer:   cert.Issuer.String(),
+			Subject:  cert.Subject.String(),
+			NotAfter: cert.NotAfter,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cert
+}
+
+func (rt *revocationTest) revoke(t *testing.T, cert *x509.Certificate, at time.Time, reason int) {
+	err := rt.inv.AddRevocation(inventory.Revocation{
+		// The way openssl prints it, revoke accepts that
+		Serial:    fmt.Sprintf("%X", cert.SerialNumber),
+		Issuer:    cert.Issuer.String(),
+		RevokedAt: at,
+		Reason:    reason,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeCRL(t *testing.T) {
+	rt := newRevocationTest(t)
+	defer rt.Close()
+
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+	compromised := rt.issue(t, 0x1234, true)
+	retired := rt.issue(t, 0x5678, true)
+	rt.issue(t, 0x9abc, true)
+	rt.revoke(t, compromised, at, 1) // keyCompromise
+	rt.revoke(t, retired, at, inventory.ReasonUnspecified)
+	rt.h.refreshCRLs(time.Hour)
+
+	w := httptest.NewRecorder()
+	rt.h.ServeCRL(w, httptest.NewRequest("GET", "/ca", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pkix-crl" {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	crl, err := x509.ParseCRL(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.ca.CheckCRLSignature(crl); err != nil {
+		t.Error(err)
+	}
+
+	var tbs struct {
+		Version   int `asn1:"optional,default:0"`
+		Signature pkix.AlgorithmIdentifier
+		Issuer    asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(crl.TBSCertList.Raw, &tbs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tbs.Issuer.FullBytes, rt.ca.RawSubject) {
+		t.Error("CRL issuer isn't byte-equal to the CA's subject")
+	}
+
+	list := crl.TBSCertList.RevokedCertificates
+	if len(list) != 2 {
+		t.Fatalf("expected 2 revoked certificates, got %d", len(list))
+	}
+	if list[0].SerialNumber.Cmp(compromised.SerialNumber) != 0 || !list[0].RevocationTime.Equal(at) {
+		t.Errorf("unexpected entry %+v", list[0])
+	}
+	if len(list[0].Extensions) != 1 || !list[0].Extensions[0].Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 21}) {
+		t.Fatalf("expected a reason code, got %+v", list[0].Extensions)
+	}
+	var reason asn1.Enumerated
+	if _, err := asn1.Unmarshal(list[0].Extensions[0].Value, &reason); err != nil || reason != 1 {
+		t.Errorf("expected keyCompromise, got %d", reason)
+	}
+	// Unspecified is left out
+	if list[1].SerialNumber.Cmp(retired.SerialNumber) != 0 || len(list[1].Extensions) != 0 {
+		t.Errorf("unexpected entry %+v", list[1])
+	}
+
+	w = httptest.NewRecorder()
+	rt.h.ServeCRL(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown backend, got %d", w.Code)
+	}
+}
+
+// ocspRequest asks rt's responder about cert over GET or POST.
+func (rt *revocationTest) ocspRequest(t *testing.T, method string, cert, issuer *x509.Certificate) []byte {
+	der, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r *http.Request
+	switch method {
+	case "GET":
+		r = httptest.NewRequest("GET", "/ca/"+url.PathEscape(base64.StdEncoding.EncodeToString(der)), nil)
+	case "POST":
+		r = httptest.NewRequest("POST", "/ca", bytes.NewReader(der))
+	}
+
+	w := httptest.NewRecorder()
+	rt.h.ServeOCSP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/ocsp-response" {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	return w.Body.Bytes()
+}
+
+func TestServeOCSP(t *testing.T) {
+	rt := newRevocationTest(t)
+	defer rt.Close()
+
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+	good := rt.issue(t, 0x1234, true)
+	revoked := rt.issue(t, 0x5678, true)
+	unknown := rt.issue(t, 0x9abc, false)
+	rt.revoke(t, revoked, at, 1)
+
+	for _, method := range []string{"GET", "POST"} {
+		resp, err := ocsp.ParseResponseForCert(rt.ocspRequest(t, method, good, rt.ca), good, rt.ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != ocsp.Good || resp.SerialNumber.Cmp(good.SerialNumber) != 0 {
+			t.Errorf("%s: expected good, got %d", method, resp.Status)
+		}
+		if !resp.NextUpdate.After(resp.ThisUpdate) {
+			t.Errorf("%s: unexpected validity %v - %v", method, resp.ThisUpdate, resp.NextUpdate)
+		}
+
+		resp, err = ocsp.ParseResponseForCert(rt.ocspRequest(t, method, revoked, rt.ca), revoked, rt.ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != ocsp.Revoked || resp.RevocationReason != ocsp.KeyCompromise || !resp.RevokedAt.Equal(at) {
+			t.Errorf("%s: expected revoked, got %d %d %v", method, resp.Status, resp.RevocationReason, resp.RevokedAt)
+		}
+
+		resp, err = ocsp.ParseResponseForCert(rt.ocspRequest(t, method, unknown, rt.ca), unknown, rt.ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != ocsp.Unknown {
+			t.Errorf("%s: expected unknown, got %d", method, resp.Status)
+		}
+	}
+}
+
+func TestServeOCSPOtherCA(t *testing.T) {
+	rt := newRevocationTest(t)
+	defer rt.Close()
+
+	good := rt.issue(t, 0x1234, true)
+	rt.revoke(t, rt.issue(t, 0x5678, true), time.Now(), 1)
+
+	// Same serials and subject, another CA's key
+	other := newCA(t)
+	for _, serial := range []*big.Int{good.SerialNumber, big.NewInt(0x5678)} {
+		tmpl := *good
+		tmpl.SerialNumber = serial
+		der, _, err := other.Sign(&tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := ocsp.ParseResponse(rt.ocspRequest(t, "POST", cert, other.Cert), rt.ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != ocsp.Unknown {
+			t.Errorf("serial %x: expected unknown, got %d", serial, resp.Status)
+		}
+	}
+}
+
+func TestServeOCSPBadRequests(t *testing.T) {
+	rt := newRevocationTest(t)
+	defer rt.Close()
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/ca", bytes.NewReader([]byte("garbage"))),
+		httptest.NewRequest("GET", "/ca/not-base64!", nil),
+	} {
+		w := httptest.NewRecorder()
+		rt.h.ServeOCSP(w, r)
+		if !bytes.Equal(w.Body.Bytes(), ocsp.MalformedRequestErrorResponse) {
+			t.Errorf("%s %s: expected a malformed request response", r.Method, r.URL.Path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	rt.h.ServeOCSP(w, httptest.NewRequest("POST", "/other", bytes.NewReader(nil)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown backend, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	rt.h.ServeOCSP(w, httptest.NewRequest("PUT", "/ca", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/producers"
+)
+
+// Round runs the producers of policies a request matched. A producer is
+// prepared once the producers it needs have produced, so it sees their
+// outputs, and waits for the next round while any of them asks for tasks.
+// The harvest endpoint and bernyd explain both run rounds.
+type Round struct {
+	Policies []Policy
+	// Context is the request's, every producer gets a copy of its own
+	Context *producers.Context
+	// Parallelism is how many producers run at once, DefaultParallelism
+	// if zero
+	Parallelism int
+	// DryRun only runs phases producers allow with producers.DryRunner,
+	// producers that don't implement it aren't run at all
+	DryRun bool
+
+	// Steps tell how far every producer got, by policy and producer
+	Steps [][]Step
+}
+
+// Step is how far a producer got in a round.
+type Step struct {
+	// WaitsFor is the producer of the policy this one needs and that
+	// hasn't produced, -1 if none
+	WaitsFor int
+	// Prepared and Produced tell which phases ran, dry runs skip those
+	// with side effects
+	Prepared bool
+	Produced bool
+	Tasks    producers.TaskRequests
+	Products []api.Product
+}
+
+// NewRound sets up a round of policies' producers.
+func NewRound(policies []Policy, c *producers.Context, parallelism int) *Round {
+	r := &Round{
+		Policies:    policies,
+		Context:     c,
+		Parallelism: parallelism,
+		Steps:       make([][]Step, len(policies)),
+	}
+	for i := range policies {
+		r.Steps[i] = make([]Step, len(policies[i].Produce))
+		for j := range r.Steps[i] {
+			r.Steps[i][j].WaitsFor = -1
+		}
+	}
+	return r
+}
+
+// Prepare prepares every producer that doesn't wait for another one.
+// Producers others need are produced right away, their products are
+// thrown away if the round ends up asking for tasks.
+func (r *Round) Prepare() error {
+	needed := make([][]bool, len(r.Policies))
+	for i := range r.Policies {
+		needed[i] = make([]bool, len(r.Policies[i].Produce))
+		for j := range needed[i] {
+			for _, k := range r.Policies[i].needs(j) {
+				needed[i][k] = true
+			}
+		}
+	}
+
+	return parallel(r.Policies, r.parallelism(), func(i, j int) error {
+		step := &r.Steps[i][j]
+		for _, k := range r.Policies[i].needs(j) {
+			if !r.Steps[i][k].Produced {
+				step.WaitsFor = k
+				return nil
+			}
+		}
+
+		prepare, produce := r.allowed(r.Policies[i].Produce[j])
+		if !prepare {
+			return nil
+		}
+		tasks, err := r.Policies[i].Produce[j].Prepare(r.context(i, j))
+		if err != nil {
+			return err
+		}
+		step.Prepared = true
+		step.Tasks = tasks
+		if len(tasks) > 0 || !needed[i][j] || !produce {
+			return nil
+		}
+		return r.produce(i, j)
+	})
+}
+
+// Produce produces every producer that's prepared, asked for no tasks
+// and hasn't produced yet.
+func (r *Round) Produce() error {
+	return parallel(r.Policies, r.parallelism(), func(i, j int) error {
+		step := &r.Steps[i][j]
+		_, produce := r.allowed(r.Policies[i].Produce[j])
+		if !step.Prepared || len(step.Tasks) > 0 || step.Produced || !produce {
+			return nil
+		}
+		return r.produce(i, j)
+	})
+}
+
+func (r *Round) produce(i, j int) error {
+	c := r.context(i, j)
+	producer := r.Policies[i].Produce[j]
+	if readsProducts(producer) {
+		// Producers before this one are done
+		for _, step := range r.Steps[i][:j] {
+			c.Products = append(c.Products, step.Products...)
+		}
+	}
+
+	products, err := producer.Produce(c)
+	if err != nil {
+		return err
+	}
+	if products == nil {
+		products = []api.Product{}
+	}
+	r.Steps[i][j].Products = products
+	r.Steps[i][j].Produced = true
+	return nil
+}
+
+// context is the j-th producer's, outputs of producers it doesn't need
+// stay unknown.
+func (r *Round) context(i, j int) *producers.Context {
+	policy := &r.Policies[i]
+	done := make([][]api.Product, len(policy.Produce))
+	for _, k := range policy.needs(j) {
+		done[k] = r.Steps[i][k].Products
+	}
+	return policy.ProducerContext(r.Context, done)
+}
+
+func (r *Round) allowed(p producers.Producer) (prepare, produce bool) {
+	if !r.DryRun {
+		return true, true
+	}
+	if dr, ok := p.(producers.DryRunner); ok {
+		return dr.DryRun()
+	}
+	return false, false
+}
+
+func (r *Round) parallelism() int {
+	if r.Parallelism <= 0 {
+		return DefaultParallelism
+	}
+	return r.Parallelism
+}
@@ -0,0 +1,528 @@
+// Package server is berny's harvest endpoint as an http.Handler, together
+// with CA, CRL, OCSP, metrics and readiness endpoints. bernyd is a thin
+// wrapper around it, other HTTP servers can mount it as well.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/audit"
+	"github.com/alvelcom/berny/pkg/inventory"
+	"github.com/alvelcom/berny/pkg/logging"
+	"github.com/alvelcom/berny/pkg/producers"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// DefaultCRLInterval is how often CRLs are regenerated unless told
+// otherwise.
+const DefaultCRLInterval = time.Hour
+
+// Hooks let the embedding server take part in a harvest, any of them may
+// be nil.
+type Hooks struct {
+	// PreProbe runs before policies are matched, an error rejects the
+	// request
+	PreProbe func(r *http.Request, req *api.Request) error
+	// PostProduce sees products before they are delivered and may change
+	// them, an error fails the request
+	PostProduce func(r *http.Request, req *api.Request, products []api.Product) ([]api.Product, error)
+	// OnError is told about every failed request, type_ is the same as in
+	// the berny_errors_total metric
+	OnError func(r *http.Request, type_ string, err error)
+}
+
+type Options struct {
+	// Log is where requests are logged, nothing is logged if nil
+	Log *logging.Logger
+	// Inventory records issued certificates and harvests, it enables
+	// revocation endpoints
+	Inventory inventory.Store
+	// Audit gets a record of every harvest
+	Audit *audit.Log
+	// CRLInterval is how often CRLs are regenerated, also OCSP responses'
+	// validity; DefaultCRLInterval if zero
+	CRLInterval time.Duration
+	// Parallelism is how many producers of a harvest run at once,
+	// DefaultParallelism if zero
+	Parallelism int
+	Hooks       Hooks
+}
+
+type Handler struct {
+	state     atomic.Value // *State, with added policies
+	inventory inventory.Store
+	crls      atomic.Value // map[string][]byte, DER by backend name
+	audit     *audit.Log
+	metrics   *serverMetrics
+	log       *logging.Logger
+	hooks     Hooks
+
+	crlInterval time.Duration
+	parallelism int
+
+	// Policies added in code survive config reloads
+	mu       sync.Mutex
+	config   *State
+	policies []Policy
+}
+
+// New creates a handler serving s, Swap replaces it later.
+func New(s *State, opts Options) *Handler {
+	h := &Handler{
+		inventory:   opts.Inventory,
+		audit:       opts.Audit,
+		log:         opts.Log,
+		hooks:       opts.Hooks,
+		crlInterval: opts.CRLInterval,
+		parallelism: opts.Parallelism,
+	}
+	if h.log == nil {
+		h.log, _ = logging.New(ioutil.Discard, "logfmt", logging.Error)
+	}
+	if h.crlInterval <= 0 {
+		h.crlInterval = DefaultCRLInterval
+	}
+	if h.parallelism <= 0 {
+		h.parallelism = DefaultParallelism
+	}
+	h.metrics = newServerMetrics(h)
+	// No policies are added yet to collide with s's
+	h.Swap(s)
+	return h
+}
+
+// Current returns the state requests are served with.
+func (h *Handler) Current() *State {
+	return h.state.Load().(*State)
+}
+
+// Swap replaces the configuration, requests in flight finish with the
+// old one. It keeps the old one if s has a policy named like one added
+// in code.
+func (h *Handler) Swap(s *State) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := uniqueNames(s.Policies, h.policies); err != nil {
+		return err
+	}
+	h.config = h.metrics.instrument(s)
+	h.publish()
+	return nil
+}
+
+// AddPolicy serves a policy built in code next to ones from the config.
+// Its producers can use config's backends, they are in the producer
+// context. Tasks and products are named after policies, so p can't share
+// a name with another one.
+func (h *Handler) AddPolicy(p Policy) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := checkPolicyName(p.Name); err != nil {
+		return err
+	}
+	policies := append(append([]Policy(nil), h.policies...), p)
+	if err := uniqueNames(h.config.Policies, policies); err != nil {
+		return err
+	}
+	h.policies = policies
+	h.publish()
+	return nil
+}
+
+// uniqueNames makes sure policies added in code are named unlike each
+// other and config's.
+func uniqueNames(config, added []Policy) error {
+	names := make(map[string]bool)
+	for _, p := range config {
+		names[p.Name] = true
+	}
+	for _, p := range added {
+		if names[p.Name] {
+			return errors.New("policy " + p.Name + ": defined twice")
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
+
+func (h *Handler) publish() {
+	s := *h.config
+	s.Policies = append(append([]Policy(nil), h.config.Policies...), h.policies...)
+	h.state.Store(&s)
+}
+
+// Routes mounts every endpoint at its usual path: /v1/harvest, /v1/ca/,
+// /metrics, /healthz, /readyz and, with an inventory, /v1/crl/ and
+// /v1/ocsp/. Call WatchCRLs as well for the latter.
+func (h *Handler) Routes(mux *http.ServeMux) {
+	mux.Handle("/v1/harvest", h)
+	mux.Handle("/v1/ca/", http.StripPrefix("/v1/ca/", http.HandlerFunc(h.ServeCA)))
+	mux.Handle("/metrics", h.Metrics())
+	mux.HandleFunc("/healthz", ServeHealthz)
+	mux.HandleFunc("/readyz", h.ServeReadyz)
+	if h.inventory != nil {
+		// Revocation status is only known with an inventory
+		mux.Handle("/v1/crl/", http.StripPrefix("/v1/crl/", http.HandlerFunc(h.ServeCRL)))
+		mux.Handle("/v1/ocsp/", http.StripPrefix("/v1/ocsp/", http.HandlerFunc(h.ServeOCSP)))
+	}
+}
+
+// Metrics serves metrics in Prometheus text format.
+func (h *Handler) Metrics() http.Handler {
+	return h.metrics.registry
+}
+
+// A bit of middleware sugar
+func readJSON(r *http.Request, j interface{}) error {
+	if r.Body == nil {
+		return errors.New("read json: no body")
+	}
+	return json.NewDecoder(r.Body).Decode(j)
+}
+
+func writeJSON(w http.ResponseWriter, log *logging.Logger, j interface{}) {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(j); err != nil {
+		log.Warn("can't write response", "error", err)
+	}
+}
+
+// writeError sends {"error": msg}, clients retry 5xx responses only.
+func writeError(w http.ResponseWriter, log *logging.Logger, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
+		log.Warn("can't write response", "error", err)
+	}
+}
+
+func errorStatus(type_ string, err error) int {
+	switch type_ {
+	case "task_response":
+		return http.StatusBadRequest
+	case "pre_probe":
+		return http.StatusForbidden
+	case "duplicate_task":
+		// retrying won't help, the same tasks would be asked
+		return http.StatusConflict
+	case "prepare", "produce":
+		if configFailed(err) {
+			return http.StatusUnprocessableEntity
+		}
+		return http.StatusInternalServerError
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// configFailed tells if every producer failed on its config, so the same
+// request would fail again.
+func configFailed(err error) bool {
+	var errs ProducerErrors
+	if !errors.As(err, &errs) {
+		errs = ProducerErrors{err}
+	}
+	for _, err := range errs {
+		var eval *producers.EvalError
+		if !errors.As(err, &eval) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID names a harvest request in logs, the audit log and the
+// response, so both sides can refer to it.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// ServeHTTP is the harvest endpoint.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newRequestID()
+	w.Header().Set(api.RequestIDHeader, requestID)
+	log := h.log.With("request_id", requestID, "remote_addr", r.RemoteAddr)
+
+	state := h.Current()
+
+	badRequest := func(err error) {
+		log.Warn("bad request", "error", err)
+		h.metrics.errors.Inc("bad_request")
+		if h.hooks.OnError != nil {
+			h.hooks.OnError(r, "bad_request", err)
+		}
+		writeError(w, log, http.StatusBadRequest, "bad")
+	}
+
+	var req api.Request
+	if err := readJSON(r, &req); err != nil {
+		badRequest(err)
+		return
+	}
+
+	if req.Machine == nil {
+		badRequest(errors.New("no machine info"))
+		return
+	}
+	log = log.With("fqdn", req.Machine.FQDN)
+
+	requestIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		requestIP = r.RemoteAddr
+	}
+	producerContext := state.NewProducerContext(requestIP, req.Machine)
+	producerContext.Inventory = h.inventory
+	producerContext.Ctx = r.Context()
+	if path.IsAbs(req.Dir) {
+		producerContext.Dir = path.Clean(req.Dir)
+	}
+
+	record := audit.Record{
+		RequestID: requestID,
+		Time:      time.Now(),
+		RequestIP: requestIP,
+		Machine:   *req.Machine,
+	}
+	defer h.recordHarvest(&record)
+	fail := func(type_ string, err error) {
+		log.Error("harvest failed", "type", type_, "error", err)
+		h.metrics.errors.Inc(type_)
+		if h.hooks.OnError != nil {
+			h.hooks.OnError(r, type_, err)
+		}
+		record.Error = err.Error()
+		writeError(w, log, errorStatus(type_, err), err.Error())
+	}
+
+	if h.hooks.PreProbe != nil {
+		if err := h.hooks.PreProbe(r, &req); err != nil {
+			fail("pre_probe", err)
+			return
+		}
+	}
+
+	for i := range req.TaskResponses {
+		taskResp, err := task.FromAPIResponse(req.TaskResponses[i])
+		if err != nil {
+			fail("task_response", err)
+			return
+		}
+
+		id, err := producers.ParseTaskID(req.TaskResponses[i].Name)
+		if err != nil {
+			fail("task_response", err)
+			return
+		}
+		if _, dup := producerContext.TaskResponses[id]; dup {
+			fail("task_response", fmt.Errorf("task %s answered twice", id))
+			return
+		}
+		producerContext.TaskResponses[id] = taskResp
+	}
+
+	log.Info("harvest", "task_responses", len(req.TaskResponses))
+	for _, tr := range req.TaskResponses {
+		log.Debug("task response", "task", tr)
+	}
+
+	var policies []Policy
+	for _, policy := range state.Policies {
+		probes, err := policy.Probe(r, req.Machine)
+		record.Policies = append(record.Policies, audit.Policy{
+			Name:     policy.Name,
+			Verified: err == nil,
+			Probes:   probes,
+		})
+		if err != nil {
+			log.Info("policy not verified", "policy", policy.Name, "error", err)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+
+	var resp api.Response
+	if len(policies) == 0 {
+		resp.Errors = append(resp.Errors, api.Error{
+			Type:    "verify",
+			Message: "no policy matched",
+		})
+		h.metrics.errors.Inc("verify")
+		if h.hooks.OnError != nil {
+			h.hooks.OnError(r, "verify", errors.New("no policy matched"))
+		}
+		record.Error = "no policy matched"
+		log.Info("no policy matched")
+		writeJSON(w, log, resp)
+		return
+	}
+
+	// Producers run concurrently, each with a context of its own; results
+	// are collected in config order
+	round := NewRound(policies, producerContext, h.parallelism)
+	if err := round.Prepare(); err != nil {
+		fail("prepare", err)
+		return
+	}
+
+	asked := make(map[producers.TaskID]bool)
+	for i, policy := range policies {
+		for _, step := range round.Steps[i] {
+			tasks := step.Tasks
+			ids := make([]producers.TaskID, 0, len(tasks))
+			for id := range tasks {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(a, b int) bool { return ids[a].String() < ids[b].String() })
+
+			for _, id := range ids {
+				if id.Policy != policy.Name {
+					fail("prepare", fmt.Errorf("policy %s: task %s is named after another policy", policy.Name, id))
+					return
+				}
+				// A producer that asks for a task it has the response to
+				// would keep the client solving it forever
+				if _, ok := producerContext.TaskResponses[id]; ok || asked[id] {
+					fail("duplicate_task", fmt.Errorf("policy %s: task %s asked again", policy.Name, id))
+					return
+				}
+				asked[id] = true
+
+				t := tasks[id]
+				if n, ok := t.(task.Namespacer); ok {
+					n.Namespace([]string{policy.Name})
+				}
+				at := t.ToAPI(id.Name())
+				resp.Tasks = append(resp.Tasks, at)
+				record.Tasks = append(record.Tasks, audit.Task{Type: at.Type, Name: at.Name})
+			}
+		}
+	}
+
+	if len(resp.Tasks) > 0 {
+		log.Info("tasks asked", "tasks", len(resp.Tasks))
+		writeJSON(w, log, resp)
+		return
+	}
+
+	if err := round.Produce(); err != nil {
+		fail("produce", err)
+		return
+	}
+
+	// Names from config can't collide, but names plugins make up can
+	delivered := make(map[string]bool)
+	for i, policy := range policies {
+		for _, step := range round.Steps[i] {
+			for _, product := range step.Products {
+				product.Name = task.Prefix([]string{policy.Name}, product.Name)
+				name := strings.Join(product.Name, "/")
+				if delivered[name] {
+					fail("produce", fmt.Errorf("policy %s: product %s produced twice", policy.Name, name))
+					return
+				}
+				delivered[name] = true
+				resp.Products = append(resp.Products, product)
+			}
+		}
+	}
+
+	if h.hooks.PostProduce != nil {
+		resp.Products, err = h.hooks.PostProduce(r, &req, resp.Products)
+		if err != nil {
+			fail("post_produce", err)
+			return
+		}
+	}
+
+	for _, p := range resp.Products {
+		record.Products = append(record.Products, audit.NewProduct(p))
+	}
+	log.Info("products delivered", "products", resp.Products)
+	writeJSON(w, log, resp)
+}
+
+// recordHarvest accounts for the request in metrics, writes the audit
+// record and keeps the last harvest of every machine in the inventory.
+func (h *Handler) recordHarvest(record *audit.Record) {
+	h.metrics.observe(record)
+
+	if h.audit != nil {
+		if err := h.audit.Append(record); err != nil {
+			h.log.Error("can't write audit record", "request_id", record.RequestID, "error", err)
+		}
+	}
+
+	if h.inventory == nil {
+		return
+	}
+
+	harvest := inventory.Harvest{
+		At:        record.Time,
+		RequestIP: record.RequestIP,
+		Machine:   record.Machine,
+		Tasks:     len(record.Tasks),
+		Products:  len(record.Products),
+		Error:     record.Error,
+	}
+	for _, p := range record.Policies {
+		if p.Verified {
+			harvest.Policies = append(harvest.Policies, p.Name)
+		}
+	}
+	if err := h.inventory.AddHarvest(harvest); err != nil {
+		h.log.Error("can't record harvest", "request_id", record.RequestID, "error", err)
+	}
+}
+
+// ServeCA gives out public CA material of x509 backends, no
+// authentication required. The path is the backend name, mount it with
+// http.StripPrefix.
+func (h *Handler) ServeCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	b, ok := h.Current().Backends.X509[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	chain, err := b.CA()
+	if err != nil {
+		h.log.Error("can't read ca", "backend", name, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	for _, der := range chain {
+		pem.Encode(w, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		})
+	}
+}
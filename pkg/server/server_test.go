@@ -0,0 +1,598 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/producers"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// harvestTest serves policies next to a file x509 backend "ca".
+type harvestTest struct {
+	dir string
+	ca  *testca.CA
+	h   *Handler
+}
+
+func newHarvestTest(t *testing.T, policies string, opts Options) *harvestTest {
+	dir, err := ioutil.TempDir("", "berny-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ht := &harvestTest{dir: dir, ca: testca.New(t, "Test CA")}
+	ht.write(t, "ca.pem", testca.CertPEM(ht.ca.Cert.Raw))
+	ht.write(t, "ca-key.pem", testca.KeyPEM(t, ht.ca.Key))
+	ht.h = New(ht.load(t, policies), opts)
+	return ht
+}
+
+func (ht *harvestTest) Close() {
+	os.RemoveAll(ht.dir)
+}
+
+func (ht *harvestTest) write(t *testing.T, name string, data []byte) string {
+	fn := filepath.Join(ht.dir, name)
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// load reads a config of policies, they may use backend.x509.ca.
+func (ht *harvestTest) load(t *testing.T, policies string) *State {
+	fn := ht.write(t, "berny.be", []byte(fmt.Sprintf(`
+backend x509 "ca" {
+  type = "file"
+  cert = %q
+  key  = %q
+}
+`, filepath.Join(ht.dir, "ca.pem"), filepath.Join(ht.dir, "ca-key.pem"))+policies))
+
+	s, err := Load(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// harvest posts a request to the harvest endpoint.
+func (ht *harvestTest) harvest(t *testing.T, req *api.Request) (*httptest.ResponseRecorder, api.Response) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ht.post(t, body)
+}
+
+func (ht *harvestTest) post(t *testing.T, body []byte) (*httptest.ResponseRecorder, api.Response) {
+	w := httptest.NewRecorder()
+	ht.h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/harvest", bytes.NewReader(body)))
+
+	var resp api.Response
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, resp
+}
+
+func machine(fqdn string) *api.MachineInfo {
+	return &api.MachineInfo{FQDN: fqdn, IPs: []string{"10.0.0.1"}}
+}
+
+// clientEnv keeps products the way a client's directory does.
+type clientEnv map[string][]byte
+
+func (e clientEnv) ReadProduct(name []string) ([]byte, error) {
+	b, ok := e[strings.Join(name, "/")]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return b, nil
+}
+
+func (e clientEnv) save(ps []api.Product) {
+	for _, p := range ps {
+		e[strings.Join(p.Name, "/")] = p.Body
+	}
+}
+
+// solve solves tasks the way a client does.
+func (e clientEnv) solve(t *testing.T, tasks []api.Task) []api.TaskResponse {
+	var resps []api.TaskResponse
+	for _, at := range tasks {
+		ps, resp, err := task.Solve(at, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.save(ps)
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+func productNames(ps []api.Product) []string {
+	var names []string
+	for _, p := range ps {
+		names = append(names, strings.Join(p.Name, "/"))
+	}
+	return names
+}
+
+// stubProducer makes a single product, or fails.
+type stubProducer struct {
+	name       string
+	body       string
+	prepareErr error
+	produceErr error
+}
+
+func (p stubProducer) Prepare(c *producers.Context) (producers.TaskRequests, error) {
+	return nil, p.prepareErr
+}
+
+func (p stubProducer) Produce(c *producers.Context) ([]api.Product, error) {
+	if p.produceErr != nil {
+		return nil, p.produceErr
+	}
+	return []api.Product{{Name: []string{p.name}, Body: []byte(p.body), Mask: 0644}}, nil
+}
+
+// askingProducer asks for a key every round, even once it's answered.
+type askingProducer struct {
+	name string
+}
+
+func (p askingProducer) Prepare(c *producers.Context) (producers.TaskRequests, error) {
+	return producers.TaskRequests{
+		c.TaskID(p.name, ""): &task.ECDSAKey{
+			Curve:    "P-256",
+			Template: api.Product{Name: []string{p.name, "key.pem"}, Mask: 0600},
+		},
+	}, nil
+}
+
+func (p askingProducer) Produce(c *producers.Context) ([]api.Product, error) {
+	return nil, nil
+}
+
+func TestHarvestRepeatedTask(t *testing.T) {
+	var errorTypes []string
+	ht := newHarvestTest(t, ``, Options{Hooks: Hooks{
+		OnError: func(r *http.Request, type_ string, err error) {
+			errorTypes = append(errorTypes, type_)
+		},
+	}})
+	defer ht.Close()
+	ht.h.AddPolicy(Policy{Name: "code", Produce: []producers.Producer{askingProducer{name: "key"}}})
+
+	req := &api.Request{Machine: machine("web-1.example.com")}
+	w, resp := ht.harvest(t, req)
+	if w.Code != http.StatusOK || len(resp.Tasks) != 1 {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	resps := clientEnv{}.solve(t, resp.Tasks)
+
+	// The client would solve the same task forever
+	req.TaskResponses = resps
+	if w, _ = ht.harvest(t, req); w.Code != http.StatusConflict {
+		t.Errorf("task asked again: unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	req.TaskResponses = append(resps, resps...)
+	if w, _ = ht.harvest(t, req); w.Code != http.StatusBadRequest {
+		t.Errorf("task answered twice: unexpected status %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "answered twice") {
+		t.Errorf("unexpected error %s", w.Body)
+	}
+
+	if want := []string{"duplicate_task", "task_response"}; !reflect.DeepEqual(errorTypes, want) {
+		t.Errorf("unexpected errors reported %v", errorTypes)
+	}
+}
+
+func TestHarvestRounds(t *testing.T) {
+	ht := newHarvestTest(t, `
+policy "web" {
+  produce x509 "tls" {
+    backend     = backend.x509.ca
+    common_name = req.fqdn
+  }
+  produce file "tls.txt" {
+    content = produce.x509.tls.cert
+  }
+  produce file "motd" {
+    content = "welcome to ${req.fqdn}"
+  }
+}
+`, Options{})
+	defer ht.Close()
+
+	// The key is made by the client first
+	req := &api.Request{Machine: machine("web-1.example.com")}
+	w, resp := ht.harvest(t, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if len(resp.Tasks) != 1 || resp.Tasks[0].Type != "ecdsa-key" ||
+		!reflect.DeepEqual(resp.Tasks[0].Name, []string{"web", "tls"}) || len(resp.Products) != 0 {
+		t.Fatalf("unexpected first round %+v", resp)
+	}
+
+	env := make(clientEnv)
+	req.TaskResponses = env.solve(t, resp.Tasks)
+	w, resp = ht.harvest(t, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if len(resp.Tasks) != 0 {
+		t.Fatalf("tasks asked again: %+v", resp.Tasks)
+	}
+	want := []string{"web/tls/cert.pem", "web/tls/chain.pem", "web/tls/fullchain.pem", "web/tls.txt", "web/motd"}
+	if names := productNames(resp.Products); !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected products %v", names)
+	}
+	env.save(resp.Products)
+
+	block, _ := pem.Decode(env["web/tls/cert.pem"])
+	if block == nil {
+		t.Fatal("no certificate delivered")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(ht.ca.Cert); err != nil {
+		t.Error(err)
+	}
+	if cert.Subject.CommonName != "web-1.example.com" {
+		t.Errorf("unexpected common name %q", cert.Subject.CommonName)
+	}
+
+	block, _ = pem.Decode(env["web/tls/key.pem"])
+	if block == nil {
+		t.Fatal("no key saved by the client")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || pub.X.Cmp(key.X) != 0 || pub.Y.Cmp(key.Y) != 0 {
+		t.Error("certificate isn't for the client's key")
+	}
+
+	if !bytes.Equal(env["web/tls.txt"], env["web/tls/cert.pem"]) {
+		t.Errorf("output of the x509 producer isn't the certificate: %q", env["web/tls.txt"])
+	}
+	if string(env["web/motd"]) != "welcome to web-1.example.com" {
+		t.Errorf("unexpected motd %q", env["web/motd"])
+	}
+}
+
+func TestHarvestPrepareNeedsProducts(t *testing.T) {
+	// The keystore is assembled in Prepare, with a certificate named after
+	// another producer's content
+	ht := newHarvestTest(t, `
+policy "web" {
+  produce file "name" {
+    content = "node-${req.fqdn}"
+  }
+  produce x509 "tls" {
+    backend           = backend.x509.ca
+    common_name       = produce.file.name.content
+    output_formats    = ["p12"]
+    keystore_password = "secret"
+  }
+}
+`, Options{})
+	defer ht.Close()
+
+	env := make(clientEnv)
+	req := &api.Request{Machine: machine("web-1.example.com")}
+	var types []string
+	for {
+		w, resp := ht.harvest(t, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+		}
+		if len(resp.Tasks) == 0 {
+			env.save(resp.Products)
+			break
+		}
+		for _, at := range resp.Tasks {
+			types = append(types, at.Type)
+		}
+		req.TaskResponses = append(req.TaskResponses, env.solve(t, resp.Tasks)...)
+	}
+	if !reflect.DeepEqual(types, []string{"ecdsa-key", "keystore"}) {
+		t.Errorf("unexpected tasks %v", types)
+	}
+
+	block, _ := pem.Decode(env["web/tls/cert.pem"])
+	if block == nil {
+		t.Fatal("no certificate delivered")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "node-web-1.example.com" {
+		t.Errorf("unexpected common name %q", cert.Subject.CommonName)
+	}
+	if _, ok := env["web/tls/keystore.p12"]; !ok {
+		t.Error("no keystore saved by the client")
+	}
+}
+
+func TestHarvestPaths(t *testing.T) {
+	ht := newHarvestTest(t, `
+policy "web" {
+  produce x509 "tls" {
+    backend     = backend.x509.ca
+    common_name = req.fqdn
+  }
+  produce file "nginx.conf" {
+    content = "ssl_certificate ${produce.x509.tls.cert_path};"
+  }
+}
+`, Options{})
+	defer ht.Close()
+
+	for _, v := range []struct {
+		dir  string
+		path string
+	}{
+		{"/var/run/berny/", "/var/run/berny/web/tls/cert.pem"},
+		// Relative to a directory the server doesn't know
+		{"", "web/tls/cert.pem"},
+		{"run/berny", "web/tls/cert.pem"},
+	} {
+		env := make(clientEnv)
+		req := &api.Request{Machine: machine("web-1.example.com"), Dir: v.dir}
+		_, resp := ht.harvest(t, req)
+		req.TaskResponses = env.solve(t, resp.Tasks)
+		_, resp = ht.harvest(t, req)
+		env.save(resp.Products)
+
+		if want := "ssl_certificate " + v.path + ";"; string(env["web/nginx.conf"]) != want {
+			t.Errorf("%q: unexpected config %q", v.dir, env["web/nginx.conf"])
+		}
+	}
+}
+
+func TestHarvestHooks(t *testing.T) {
+	var errorTypes []string
+	var postErr error
+	opts := Options{Hooks: Hooks{
+		PreProbe: func(r *http.Request, req *api.Request) error {
+			if req.Machine.FQDN == "evil.example.com" {
+				return errors.New("denied")
+			}
+			return nil
+		},
+		PostProduce: func(r *http.Request, req *api.Request, ps []api.Product) ([]api.Product, error) {
+			if postErr != nil {
+				return nil, postErr
+			}
+			return append(ps, api.Product{Name: []string{"hooked"}, Body: []byte(req.Machine.FQDN)}), nil
+		},
+		OnError: func(r *http.Request, type_ string, err error) {
+			errorTypes = append(errorTypes, type_)
+		},
+	}}
+	ht := newHarvestTest(t, `
+policy "web" {
+  produce file "motd" {
+    content = "hi"
+  }
+}
+`, opts)
+	defer ht.Close()
+
+	w, resp := ht.harvest(t, &api.Request{Machine: machine("web-1.example.com")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if names := productNames(resp.Products); !reflect.DeepEqual(names, []string{"web/motd", "hooked"}) {
+		t.Errorf("unexpected products %v", names)
+	}
+	if len(errorTypes) != 0 {
+		t.Errorf("errors reported for a good harvest: %v", errorTypes)
+	}
+
+	w, _ = ht.harvest(t, &api.Request{Machine: machine("evil.example.com")})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a rejected request to be forbidden, got %d", w.Code)
+	}
+
+	postErr = errors.New("nope")
+	w, _ = ht.harvest(t, &api.Request{Machine: machine("web-1.example.com")})
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "nope") {
+		t.Errorf("unexpected response to a failed hook %d: %s", w.Code, w.Body)
+	}
+
+	if !reflect.DeepEqual(errorTypes, []string{"pre_probe", "post_produce"}) {
+		t.Errorf("unexpected errors reported %v", errorTypes)
+	}
+}
+
+func TestAddPolicySwap(t *testing.T) {
+	ht := newHarvestTest(t, `
+policy "config" {
+  produce file "a" {
+    content = "a"
+  }
+}
+`, Options{})
+	defer ht.Close()
+
+	code := Policy{
+		Name:    "code",
+		Produce: []producers.Producer{stubProducer{name: "b", body: "b"}},
+	}
+	if err := ht.h.AddPolicy(code); err != nil {
+		t.Fatal(err)
+	}
+	// Their tasks and products would mix
+	for _, name := range []string{"config", "code", "a/b", ""} {
+		if err := ht.h.AddPolicy(Policy{Name: name}); err == nil {
+			t.Errorf("policy %q added", name)
+		}
+	}
+	_, resp := ht.harvest(t, &api.Request{Machine: machine("web-1.example.com")})
+	if names := productNames(resp.Products); !reflect.DeepEqual(names, []string{"config/a", "code/b"}) {
+		t.Errorf("unexpected products %v", names)
+	}
+
+	// A reload replaces config policies only
+	if err := ht.h.Swap(ht.load(t, `
+policy "reloaded" {
+  produce file "c" {
+    content = "c"
+  }
+}
+`)); err != nil {
+		t.Fatal(err)
+	}
+	_, resp = ht.harvest(t, &api.Request{Machine: machine("web-1.example.com")})
+	if names := productNames(resp.Products); !reflect.DeepEqual(names, []string{"reloaded/c", "code/b"}) {
+		t.Errorf("unexpected products after a reload %v", names)
+	}
+
+	// A config that took the added policy's name isn't swapped in
+	if err := ht.h.Swap(ht.load(t, `
+policy "code" {
+  produce file "d" {
+    content = "d"
+  }
+}
+`)); err == nil {
+		t.Error("expected a config with an added policy's name to fail")
+	}
+	_, resp = ht.harvest(t, &api.Request{Machine: machine("web-1.example.com")})
+	if names := productNames(resp.Products); !reflect.DeepEqual(names, []string{"reloaded/c", "code/b"}) {
+		t.Errorf("unexpected products after a failed reload %v", names)
+	}
+}
+
+func TestHarvestErrorStatus(t *testing.T) {
+	good, err := json.Marshal(&api.Request{Machine: machine("web-1.example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badResponse, err := json.Marshal(&api.Request{
+		Machine: machine("web-1.example.com"),
+		TaskResponses: []api.TaskResponse{{
+			Name: []string{"code", "p"},
+			Type: "no-such-task",
+			Body: json.RawMessage(`{}`),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		name     string
+		body     []byte
+		producer stubProducer
+		preProbe error
+		code     int
+		type_    string
+	}{
+		{"not json", []byte(`{`), stubProducer{name: "p"}, nil, http.StatusBadRequest, "bad_request"},
+		{"no machine", []byte(`{}`), stubProducer{name: "p"}, nil, http.StatusBadRequest, "bad_request"},
+		{"bad task response", badResponse, stubProducer{name: "p"}, nil, http.StatusBadRequest, "task_response"},
+		{"pre probe", good, stubProducer{name: "p"}, errors.New("denied"), http.StatusForbidden, "pre_probe"},
+		{"prepare", good, stubProducer{name: "p", prepareErr: errors.New("oops")}, nil, http.StatusInternalServerError, "prepare"},
+		{"produce", good, stubProducer{name: "p", produceErr: errors.New("oops")}, nil, http.StatusInternalServerError, "produce"},
+		{"prepare config", good, stubProducer{name: "p", prepareErr: &producers.EvalError{Err: errors.New("oops")}}, nil, http.StatusUnprocessableEntity, "prepare"},
+		{"produce config", good, stubProducer{name: "p", produceErr: &producers.EvalError{Err: errors.New("oops")}}, nil, http.StatusUnprocessableEntity, "produce"},
+	} {
+		var errorTypes []string
+		ht := newHarvestTest(t, ``, Options{Hooks: Hooks{
+			PreProbe: func(r *http.Request, req *api.Request) error {
+				return v.preProbe
+			},
+			OnError: func(r *http.Request, type_ string, err error) {
+				errorTypes = append(errorTypes, type_)
+			},
+		}})
+		ht.h.AddPolicy(Policy{Name: "code", Produce: []producers.Producer{v.producer}})
+
+		w, _ := ht.post(t, v.body)
+		if w.Code != v.code {
+			t.Errorf("%s: expected status %d, got %d: %s", v.name, v.code, w.Code, w.Body)
+		}
+		if !reflect.DeepEqual(errorTypes, []string{v.type_}) {
+			t.Errorf("%s: unexpected errors reported %v", v.name, errorTypes)
+		}
+		ht.Close()
+	}
+}
+
+func TestHarvestEvalError(t *testing.T) {
+	ht := newHarvestTest(t, `
+policy "web" {
+  produce file "ip.txt" {
+    content = req.ips[5]
+  }
+  produce file "list.txt" {
+    content = ["a", "b"]
+  }
+}
+`, Options{})
+	defer ht.Close()
+
+	req := &api.Request{Machine: machine("web-1.example.com")}
+	// Clients don't retry, the config fails the same way every time
+	w, _ := ht.harvest(t, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	// Unless something else failed too
+	ht.h.AddPolicy(Policy{Name: "code", Produce: []producers.Producer{
+		stubProducer{name: "p", produceErr: errors.New("backend is down")},
+	}})
+	w, _ = ht.harvest(t, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestHarvestNoPolicy(t *testing.T) {
+	ht := newHarvestTest(t, `
+policy "web" {
+  verify identity {}
+}
+`, Options{})
+	defer ht.Close()
+
+	w, resp := ht.harvest(t, &api.Request{Machine: machine("web-1.example.com")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Type != "verify" || len(resp.Products) != 0 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/backend"
+	"github.com/alvelcom/berny/pkg/config"
+	"github.com/alvelcom/berny/pkg/logging"
+	"github.com/alvelcom/berny/pkg/producers"
+)
+
+// State is everything built from a config file. It's immutable once
+// loaded, reloading builds a new one.
+type State struct {
+	Backends    *backend.Map
+	Policies    []Policy
+	EvalContext *hcl.EvalContext
+
+	// Files are the parsed config files, for diagnostics
+	Files map[string]*hcl.File
+}
+
+// ConfigError carries HCL diagnostics together with the parsed files, so
+// they can be printed with source snippets.
+type ConfigError struct {
+	Diags hcl.Diagnostics
+	Files map[string]*hcl.File
+}
+
+func (e *ConfigError) Error() string {
+	return e.Diags.Error()
+}
+
+// Load parses, decodes and instantiates a config file or directory.
+// Parsing and decoding errors are returned as *ConfigError.
+func Load(fn string, vars map[string]string) (*State, error) {
+	parser := hclparse.NewParser()
+	wrap := func(err error) error {
+		if diags, ok := err.(hcl.Diagnostics); ok {
+			return &ConfigError{diags, parser.Files()}
+		}
+		return err
+	}
+
+	c, diags := config.Load(parser, fn, vars)
+	if len(diags) > 0 {
+		return nil, wrap(diags)
+	}
+
+	backends, err := CastBackends(c.Backends, c.EvalContext)
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	policies, err := CastPolicies(c.Policies, c.EvalContext)
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	return &State{
+		Backends:    backends,
+		Policies:    policies,
+		EvalContext: c.EvalContext,
+		Files:       parser.Files(),
+	}, nil
+}
+
+// ExplainError attaches config sources to diagnostics that come from
+// evaluating expressions of a loaded config.
+func (s *State) ExplainError(err error) error {
+	var diags hcl.Diagnostics
+	if errors.As(err, &diags) {
+		return &ConfigError{diags, s.Files}
+	}
+	return err
+}
+
+// NewProducerContext is what producers of a request work with: the
+// config's functions and variables plus req and backend.
+func (s *State) NewProducerContext(requestIP string, mi *api.MachineInfo) *producers.Context {
+	ctx := s.EvalContext.NewChild()
+	ctx.Variables = map[string]cty.Value{
+		"req":     ReqVar(requestIP, mi),
+		"backend": BackendVar(s.Backends),
+	}
+
+	return &producers.Context{
+		Backends:      s.Backends,
+		EvalContext:   ctx,
+		TaskResponses: make(producers.TaskResponses),
+		Machine:       mi,
+		RequestIP:     requestIP,
+	}
+}
+
+// LogDiagnostics logs an entry per diagnostic, snippets are left for
+// WriteDiagnostics.
+func LogDiagnostics(log *logging.Logger, err error) {
+	diags, ok := err.(hcl.Diagnostics)
+	if cerr, isConfigErr := err.(*ConfigError); isConfigErr {
+		diags, ok = cerr.Diags, true
+	}
+	if !ok {
+		log.Error("config error", "error", err)
+		return
+	}
+
+	for _, d := range diags {
+		var at string
+		if d.Subject != nil {
+			at = d.Subject.String()
+		}
+		log.Error("config error", "error", d.Summary, "detail", d.Detail, "at", at)
+	}
+}
+
+// WriteDiagnostics prints err, HCL diagnostics get source snippets.
+func WriteDiagnostics(w io.Writer, err error) {
+	switch err := err.(type) {
+	case *ConfigError:
+		hcl.NewDiagnosticTextWriter(w, err.Files, 78, false).WriteDiagnostics(err.Diags)
+	case hcl.Diagnostics:
+		hcl.NewDiagnosticTextWriter(w, nil, 78, false).WriteDiagnostics(err)
+	default:
+		fmt.Fprintln(w, err)
+	}
+}
+
+// BackendVar exposes backends to expressions as backend.<kind>.<name>.
+func BackendVar(b *backend.Map) cty.Value {
+	x509 := make(map[string]cty.Value)
+	for key, value := range b.X509 {
+		var tmp *backend.X509 = &value
+		x509[key] = cty.ObjectVal(map[string]cty.Value{
+			"_x509": cty.CapsuleVal(backend.X509Type, &tmp),
+		})
+	}
+
+	ssh := make(map[string]cty.Value)
+	for key, value := range b.SSH {
+		var tmp *backend.SSH = &value
+		ssh[key] = cty.ObjectVal(map[string]cty.Value{
+			"_ssh": cty.CapsuleVal(backend.SSHType, &tmp),
+		})
+	}
+
+	secret := make(map[string]cty.Value)
+	for key, value := range b.Secret {
+		var tmp *backend.Secret = &value
+		secret[key] = cty.ObjectVal(map[string]cty.Value{
+			"_secret": cty.CapsuleVal(backend.SecretType, &tmp),
+		})
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		"x509":   cty.ObjectVal(x509),
+		"ssh":    cty.ObjectVal(ssh),
+		"secret": cty.ObjectVal(secret),
+	})
+}
+
+// ReqVar exposes the request to expressions as req.
+func ReqVar(requestIP string, mi *api.MachineInfo) cty.Value {
+	ips := cty.ListValEmpty(cty.String)
+	if len(mi.IPs) > 0 {
+		var list []cty.Value
+		for i := range mi.IPs {
+			list = append(list, cty.StringVal(mi.IPs[i]))
+		}
+		ips = cty.ListVal(list)
+	}
+
+	extra := cty.MapValEmpty(cty.String)
+	if len(mi.Extra) > 0 {
+		m := make(map[string]cty.Value)
+		for key := range mi.Extra {
+			m[key] = cty.StringVal(mi.Extra[key])
+		}
+		extra = cty.MapVal(m)
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		"fqdn":       cty.StringVal(mi.FQDN),
+		"ips":        ips,
+		"request_ip": cty.StringVal(requestIP),
+		"extra":      extra,
+
+		"host":      cty.StringVal(mi.Host),
+		"domain":    cty.StringVal(mi.Domain),
+		"cluster":   cty.StringVal(mi.Cluster),
+		"node_type": cty.StringVal(mi.NodeType),
+		"id":        cty.StringVal(mi.Id),
+		"provider":  cty.StringVal(mi.Provider),
+		"region":    cty.StringVal(mi.Region),
+		"city":      cty.StringVal(mi.City),
+		"country":   cty.StringVal(mi.Country),
+		"geo":       cty.StringVal(mi.Geo),
+	})
+}
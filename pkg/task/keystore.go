@@ -0,0 +1,127 @@
+package task
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/keystore"
+)
+
+// Keystore combines a private key, that never left the client, with its
+// certificate chain into PKCS#12 and JKS keystores. Each format is saved
+// as Template with the format's extension appended.
+type Keystore struct {
+	Key      []string    `json:"key"`
+	Chain    [][]byte    `json:"chain"`
+	Formats  []string    `json:"formats"`
+	Alias    string      `json:"alias"`
+	Password string      `json:"password"`
+	Template api.Product `json:"template"`
+}
+
+// KeystoreResponse returns the chain back, so a stateless server can
+// produce the same certificate the keystore has.
+type KeystoreResponse struct {
+	Chain [][]byte `json:"chain"`
+}
+
+func (ks *Keystore) Namespace(prefix []string) {
+	ks.Key = Prefix(prefix, ks.Key)
+	ks.Template.Name = Prefix(prefix, ks.Template.Name)
+}
+
+func (ks Keystore) ToAPI(name []string) api.Task {
+	body, err := json.Marshal(ks)
+	if err != nil {
+		panic(err)
+	}
+
+	return api.Task{
+		Name: name,
+		Type: keystoreType,
+		Body: json.RawMessage(body),
+	}
+}
+
+func (ks Keystore) Solve(env Env) ([]api.Product, Response, error) {
+	if len(ks.Chain) == 0 {
+		return nil, nil, errors.New("task: keystore: empty chain")
+	}
+
+	pemKey, err := env.ReadProduct(ks.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, nil, errors.New("task: keystore: can't decode key")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, der := range ks.Chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	var products []api.Product
+	for _, format := range ks.Formats {
+		var body []byte
+		switch format {
+		case "p12":
+			body, err = pkcs12.Encode(rand.Reader, key, certs[0], certs[1:], ks.Password)
+		case "jks":
+			var store keystore.JKS
+			err = store.AddPrivateKey(ks.Alias, key, ks.Chain, ks.Password)
+			if err == nil {
+				body, err = store.Marshal(ks.Password)
+			}
+		default:
+			err = errors.New("task: keystore: unknown format " + format)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		product := ks.Template
+		product.Name = append([]string(nil), ks.Template.Name...)
+		product.Name[len(product.Name)-1] += "." + format
+		product.Body = body
+		products = append(products, product)
+	}
+
+	return products, KeystoreResponse{Chain: ks.Chain}, nil
+}
+
+func (kr KeystoreResponse) ToAPI(name []string) api.TaskResponse {
+	body, err := json.Marshal(kr)
+	if err != nil {
+		panic(err)
+	}
+
+	return api.TaskResponse{
+		Name: name,
+		Type: keystoreType,
+		Body: json.RawMessage(body),
+	}
+}
@@ -0,0 +1,121 @@
+package task
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/alvelcom/berny/internal/testca"
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+// products is an Env of products saved by previous rounds
+type products map[string][]byte
+
+func (p products) ReadProduct(name []string) ([]byte, error) {
+	body, ok := p[strings.Join(name, "/")]
+	if !ok {
+		return nil, errors.New("no product " + strings.Join(name, "/"))
+	}
+	return body, nil
+}
+
+func testChain(t *testing.T) (*ecdsa.PrivateKey, [][]byte) {
+	ca := testca.New(t, "CA")
+	leaf, key := ca.Issue(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "web-1.example.com"},
+	})
+	return key, [][]byte{leaf.Raw, ca.Cert.Raw}
+}
+
+func TestKeystorePKCS12(t *testing.T) {
+	key, chain := testChain(t)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := products{"web/key.pem": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})}
+
+	ks := Keystore{
+		Key:      []string{"web", "key.pem"},
+		Chain:    chain,
+		Formats:  []string{"p12", "jks"},
+		Alias:    "web",
+		Password: "s3cret",
+		Template: api.Product{Name: []string{"web", "keystore"}, Mask: 0600},
+	}
+	ps, resp, err := ks.Solve(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 2 || strings.Join(ps[0].Name, "/") != "web/keystore.p12" || strings.Join(ps[1].Name, "/") != "web/keystore.jks" {
+		t.Fatalf("unexpected products %+v", ps)
+	}
+	if ps[0].Mask != 0600 || len(ps[1].Body) == 0 {
+		t.Errorf("unexpected products %+v", ps)
+	}
+	if r, ok := resp.(KeystoreResponse); !ok || len(r.Chain) != 2 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	if _, _, _, err := pkcs12.DecodeChain(ps[0].Body, "wrong"); err == nil {
+		t.Error("expected a wrong password to fail")
+	}
+	p12Key, cert, caCerts, err := pkcs12.DecodeChain(ps[0].Body, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := p12Key.(*ecdsa.PrivateKey); !ok || ecKey.D.Cmp(key.D) != 0 {
+		t.Error("key doesn't match")
+	}
+	if string(cert.Raw) != string(chain[0]) {
+		t.Error("certificate doesn't match")
+	}
+	if len(caCerts) != 1 || string(caCerts[0].Raw) != string(chain[1]) {
+		t.Error("chain doesn't match")
+	}
+}
+
+func TestKeystoreErrors(t *testing.T) {
+	key, chain := testChain(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := products{"web/key.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})}
+
+	ks := Keystore{
+		Key:      []string{"web", "key.pem"},
+		Chain:    chain,
+		Formats:  []string{"p12"},
+		Alias:    "web",
+		Template: api.Product{Name: []string{"web", "keystore"}},
+	}
+	if _, _, err := ks.Solve(env); err != nil {
+		t.Errorf("PKCS#8 key: %v", err)
+	}
+
+	bad := ks
+	bad.Formats = []string{"bks"}
+	if _, _, err := bad.Solve(env); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+
+	bad = ks
+	bad.Chain = nil
+	if _, _, err := bad.Solve(env); err == nil {
+		t.Error("expected an empty chain to fail")
+	}
+
+	bad = ks
+	bad.Key = []string{"web", "missing.pem"}
+	if _, _, err := bad.Solve(env); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+}
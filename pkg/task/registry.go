@@ -0,0 +1,49 @@
+package task
+
+import (
+	"github.com/alvelcom/berny/internal/registry"
+)
+
+// Kind is a task type. Tasks and responses travel as JSON: they are
+// encoded by their ToAPI and decoded with encoding/json into the empty
+// values New and NewResponse return.
+type Kind struct {
+	New         func() Task
+	NewResponse func() Response
+}
+
+var types = registry.New("task")
+
+func init() {
+	Register(ecdsaKeyType, Kind{
+		New:         func() Task { return new(ECDSAKey) },
+		NewResponse: func() Response { return new(ECDSAKeyResponse) },
+	})
+	Register(sshPublicKeyType, Kind{
+		New:         func() Task { return new(SSHPublicKey) },
+		NewResponse: func() Response { return new(SSHPublicKeyResponse) },
+	})
+	Register(keystoreType, Kind{
+		New:         func() Task { return new(Keystore) },
+		NewResponse: func() Response { return new(KeystoreResponse) },
+	})
+}
+
+// Register makes a task type known to clients and servers, both have to
+// register it. It panics if the type is taken.
+func Register(type_ string, k Kind) {
+	types.Register(type_, k)
+}
+
+func lookup(type_ string) (Kind, error) {
+	k, ok := types.Lookup(type_)
+	if !ok {
+		return Kind{}, ErrBadType
+	}
+	return k.(Kind), nil
+}
+
+// Types lists registered task types.
+func Types() []string {
+	return types.Types()
+}
@@ -0,0 +1,103 @@
+package task_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alvelcom/berny/pkg/api"
+	"github.com/alvelcom/berny/pkg/task"
+)
+
+// upper is a task type registered outside of this package: clients save an
+// upper case copy of a product and tell its length.
+type upper struct {
+	Source []string `json:"source"`
+}
+
+type upperResponse struct {
+	Length int `json:"length"`
+}
+
+func init() {
+	task.Register("test-upper", task.Kind{
+		New:         func() task.Task { return new(upper) },
+		NewResponse: func() task.Response { return new(upperResponse) },
+	})
+}
+
+func (u upper) ToAPI(name []string) api.Task {
+	body, err := json.Marshal(u)
+	if err != nil {
+		panic(err)
+	}
+	return api.Task{Name: name, Type: "test-upper", Body: body}
+}
+
+func (u upper) Solve(env task.Env) ([]api.Product, task.Response, error) {
+	b, err := env.ReadProduct(u.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	b = bytes.ToUpper(b)
+	ps := []api.Product{{Name: append(u.Source, "upper"), Body: b, Mask: 0644}}
+	return ps, upperResponse{Length: len(b)}, nil
+}
+
+func (r upperResponse) ToAPI(name []string) api.TaskResponse {
+	body, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	return api.TaskResponse{Name: name, Type: "test-upper", Body: body}
+}
+
+type env map[string][]byte
+
+func (e env) ReadProduct(name []string) ([]byte, error) {
+	b, ok := e[strings.Join(name, "/")]
+	if !ok {
+		return nil, errors.New("no product")
+	}
+	return b, nil
+}
+
+func TestRegisteredTask(t *testing.T) {
+	// Server asks, client solves, server reads the response
+	at := upper{Source: []string{"web", "motd"}}.ToAPI([]string{"web", "shout"})
+	ps, atr, err := task.Solve(at, env{"web/motd": []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || string(ps[0].Body) != "HELLO" ||
+		!reflect.DeepEqual(ps[0].Name, []string{"web", "motd", "upper"}) {
+		t.Errorf("unexpected products %+v", ps)
+	}
+	if !reflect.DeepEqual(atr.Name, at.Name) {
+		t.Errorf("response is named %v, not after the task", atr.Name)
+	}
+
+	resp, err := task.FromAPIResponse(atr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := resp.(*upperResponse); !ok || r.Length != 5 {
+		t.Errorf("unexpected response %#v", resp)
+	}
+
+	var listed bool
+	for _, type_ := range task.Types() {
+		listed = listed || type_ == "test-upper"
+	}
+	if !listed {
+		t.Errorf("registered type isn't listed in %v", task.Types())
+	}
+
+	at.Type = "test-lower"
+	if _, err := task.FromAPI(at); err != task.ErrBadType {
+		t.Errorf("expected an unknown type to fail, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package task
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alvelcom/berny/pkg/api"
+)
+
+// SSHPublicKey asks a client for an SSH public key to certify. It's
+// either read from Path, e.g. /etc/ssh/ssh_host_ed25519_key.pub, or, when
+// Path is empty, a new key is generated and saved as Template, with the
+// public half next to it.
+type SSHPublicKey struct {
+	Path     string      `json:"path,omitempty"`
+	Template api.Product `json:"template"`
+}
+
+type SSHPublicKeyResponse struct {
+	AuthorizedKey string `json:"authorized_key"`
+}
+
+// Namespace moves the generated key, Path is the client's own.
+func (sk *SSHPublicKey) Namespace(prefix []string) {
+	sk.Template.Name = Prefix(prefix, sk.Template.Name)
+}
+
+func (sk SSHPublicKey) ToAPI(name []string) api.Task {
+	body, err := json.Marshal(sk)
+	if err != nil {
+		panic(err)
+	}
+
+	return api.Task{
+		Name: name,
+		Type: sshPublicKeyType,
+		Body: json.RawMessage(body),
+	}
+}
+
+func (sk SSHPublicKey) Solve(env Env) ([]api.Product, Response, error) {
+	if len(sk.Path) > 0 {
+		b, err := ioutil.ReadFile(sk.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Parse it, so nothing but a public key is sent back
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp := SSHPublicKeyResponse{
+			AuthorizedKey: string(ssh.MarshalAuthorizedKey(pub)),
+		}
+		return nil, resp, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	derKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	authorizedKey := ssh.MarshalAuthorizedKey(pub)
+
+	product := sk.Template
+	product.Body = pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: derKey,
+	})
+
+	pubProduct := sk.Template
+	pubProduct.Name = append([]string(nil), sk.Template.Name...)
+	pubProduct.Name[len(pubProduct.Name)-1] += ".pub"
+	pubProduct.Body = authorizedKey
+	pubProduct.Mask = 0644
+
+	products := []api.Product{product, pubProduct}
+	resp := SSHPublicKeyResponse{
+		AuthorizedKey: string(authorizedKey),
+	}
+	return products, resp, nil
+}
+
+func (sr SSHPublicKeyResponse) ToAPI(name []string) api.TaskResponse {
+	body, err := json.Marshal(sr)
+	if err != nil {
+		panic(err)
+	}
+
+	return api.TaskResponse{
+		Name: name,
+		Type: sshPublicKeyType,
+		Body: json.RawMessage(body),
+	}
+}
+
+func (sr SSHPublicKeyResponse) PublicKey() (ssh.PublicKey, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sr.AuthorizedKey))
+	return pub, err
+}
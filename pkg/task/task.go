@@ -15,7 +15,24 @@ import (
 
 type Task interface {
 	ToAPI(name []string) api.Task
-	Solve() ([]api.Product, Response, error)
+	Solve(env Env) ([]api.Product, Response, error)
+}
+
+// Env is what a client gives tasks to work with.
+type Env interface {
+	// ReadProduct returns a product saved by a previous harvest round
+	ReadProduct(name []string) ([]byte, error)
+}
+
+// Namespacer is implemented by tasks that name products. Servers use it
+// to put products of a policy under the policy's directory.
+type Namespacer interface {
+	Namespace(prefix []string)
+}
+
+// Prefix puts name under prefix.
+func Prefix(prefix, name []string) []string {
+	return append(append([]string(nil), prefix...), name...)
 }
 
 type Response interface {
@@ -24,20 +41,22 @@ type Response interface {
 
 const (
 	// Complete list of task types
-	ecdsaKeyType = "ecdsa-key"
+	ecdsaKeyType     = "ecdsa-key"
+	sshPublicKeyType = "ssh-public-key"
+	keystoreType     = "keystore"
 )
 
 var (
 	ErrBadType = errors.New("task: unknown type")
 )
 
-func Solve(t api.Task) ([]api.Product, api.TaskResponse, error) {
+func Solve(t api.Task, env Env) ([]api.Product, api.TaskResponse, error) {
 	task, err := FromAPI(t)
 	if err != nil {
 		return nil, api.TaskResponse{}, err
 	}
 
-	products, resp, err := task.Solve()
+	products, resp, err := task.Solve(env)
 	if err != nil {
 		return nil, api.TaskResponse{}, err
 	}
@@ -46,15 +65,13 @@ func Solve(t api.Task) ([]api.Product, api.TaskResponse, error) {
 }
 
 func FromAPI(t api.Task) (Task, error) {
-	var task Task
-	switch t.Type {
-	case ecdsaKeyType:
-		task = new(ECDSAKey)
-	default:
-		return nil, ErrBadType
+	k, err := lookup(t.Type)
+	if err != nil {
+		return nil, err
 	}
 
-	err := json.Unmarshal(t.Body, task)
+	task := k.New()
+	err = json.Unmarshal(t.Body, task)
 	if err != nil {
 		return nil, err
 	}
@@ -63,15 +80,13 @@ func FromAPI(t api.Task) (Task, error) {
 }
 
 func FromAPIResponse(r api.TaskResponse) (Response, error) {
-	var resp Response
-	switch r.Type {
-	case ecdsaKeyType:
-		resp = new(ECDSAKeyResponse)
-	default:
-		return nil, ErrBadType
+	k, err := lookup(r.Type)
+	if err != nil {
+		return nil, err
 	}
 
-	err := json.Unmarshal(r.Body, resp)
+	resp := k.NewResponse()
+	err = json.Unmarshal(r.Body, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -90,6 +105,10 @@ type ECDSAKeyResponse struct {
 	Y     *big.Int `json:"y"`
 }
 
+func (ek *ECDSAKey) Namespace(prefix []string) {
+	ek.Template.Name = Prefix(prefix, ek.Template.Name)
+}
+
 func (ek ECDSAKey) ToAPI(name []string) api.Task {
 	body, err := json.Marshal(ek)
 	if err != nil {
@@ -103,7 +122,7 @@ func (ek ECDSAKey) ToAPI(name []string) api.Task {
 	}
 }
 
-func (ek ECDSAKey) Solve() ([]api.Product, Response, error) {
+func (ek ECDSAKey) Solve(env Env) ([]api.Product, Response, error) {
 	curve := ECDSACurve(ek.Curve)
 	key, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {